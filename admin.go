@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
+	request "github.com/redhatinsights/platform-go-middlewares/v2/request_id"
+)
+
+var (
+	// validOrgID matches well-formed org IDs, which are strings of digits.
+	validOrgID = regexp.MustCompile(`^[0-9]+$`)
+
+	// validName matches well-formed module and channel names.
+	validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+)
+
+// enrollmentRequest is the JSON body of a request to create an enrollment.
+// Reason and Ticket are recorded in the audit trail.
+type enrollmentRequest struct {
+	OrgID     string     `json:"org_id"`
+	Channel   string     `json:"channel"`
+	StartsAt  *time.Time `json:"starts_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Reason    string     `json:"reason"`
+	Ticket    string     `json:"ticket"`
+}
+
+// validate checks the fields of req and returns an Enrollment in moduleName, or
+// every problem found. If no channel is given, the org is enrolled in
+// "testing".
+func (req enrollmentRequest) validate(moduleName string) (Enrollment, []fieldError) {
+	var errs []fieldError
+
+	if req.OrgID == "" {
+		errs = append(errs, fieldError{"org_id", "missing required field: 'org_id'"})
+	} else if !validOrgID.MatchString(req.OrgID) {
+		errs = append(errs, fieldError{"org_id", "invalid org ID: must contain only digits"})
+	}
+	if req.Channel == "" {
+		req.Channel = "testing"
+	} else if !validName.MatchString(req.Channel) {
+		errs = append(errs, fieldError{"channel", "invalid channel name: must contain only letters, digits, '.', '_' and '-'"})
+	}
+	if req.StartsAt != nil && req.ExpiresAt != nil && !req.ExpiresAt.After(*req.StartsAt) {
+		errs = append(errs, fieldError{"expires_at", "invalid expiry: 'expires_at' must be after 'starts_at'"})
+	}
+
+	return Enrollment{
+		ModuleName: moduleName,
+		OrgID:      req.OrgID,
+		Channel:    req.Channel,
+		StartsAt:   utc(req.StartsAt),
+		ExpiresAt:  utc(req.ExpiresAt),
+	}, errs
+}
+
+// enrollmentUpdateRequest is the JSON body of a request to move an enrolled
+// org to another channel. Reason and Ticket are recorded in the audit trail.
+type enrollmentUpdateRequest struct {
+	Channel string `json:"channel"`
+	Reason  string `json:"reason"`
+	Ticket  string `json:"ticket"`
+}
+
+// validate checks the fields of req and returns every problem found.
+func (req enrollmentUpdateRequest) validate() []fieldError {
+	switch {
+	case req.Channel == "":
+		return []fieldError{{"channel", "missing required field: 'channel'"}}
+	case !validName.MatchString(req.Channel):
+		return []fieldError{{"channel", "invalid channel name: must contain only letters, digits, '.', '_' and '-'"}}
+	default:
+		return nil
+	}
+}
+
+// utc returns t converted to UTC, or nil if t is nil. Times are stored without
+// a time zone, so they must be converted before being written.
+func utc(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
+
+// handleModuleEnrollments creates an http.HandlerFunc for the API endpoint
+// /admin/modules/{module}/enrollments.
+func (s *Server) handleModuleEnrollments() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		module := r.PathValue("module")
+		if !validName.MatchString(module) {
+			writeError(w, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("invalid module name: '%s'", module))
+			return
+		}
+		annotate(r.Context(), attrModule.String(module))
+
+		switch r.Method {
+		case http.MethodGet:
+			s.listEnrollments(w, r, EnrollmentFilter{ModuleName: module})
+		case http.MethodPost:
+			var body enrollmentRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&body); err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidBody, fmt.Sprintf("cannot decode request body: %v", err))
+				return
+			}
+
+			enrollment, errs := body.validate(module)
+			if len(errs) > 0 {
+				writeFieldErrors(w, errs)
+				return
+			}
+			annotate(r.Context(), attrOrgID.String(enrollment.OrgID), attrChannel.String(enrollment.Channel))
+
+			if err := s.db.InsertOrgsModules(r.Context(), enrollment, newChange(r, body.Reason, body.Ticket)); err != nil {
+				if errors.Is(err, ErrEnrollmentExists) {
+					writeError(w, http.StatusConflict, codeConflict, fmt.Sprintf("org '%s' is already enrolled for module '%s'", enrollment.OrgID, module))
+					return
+				}
+				writeInternalError(w, err)
+				return
+			}
+
+			writeJSON(w, http.StatusCreated, enrollment)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Sprintf("method '%s' not allowed", r.Method))
+		}
+	}
+}
+
+// handleModuleEnrollment creates an http.HandlerFunc for the API endpoint
+// /admin/modules/{module}/enrollments/{org_id}.
+func (s *Server) handleModuleEnrollment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		module := r.PathValue("module")
+		if !validName.MatchString(module) {
+			writeError(w, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("invalid module name: '%s'", module))
+			return
+		}
+		orgID := r.PathValue("org_id")
+		if !validOrgID.MatchString(orgID) {
+			writeError(w, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("invalid org ID: '%s'", orgID))
+			return
+		}
+		annotate(r.Context(), attrModule.String(module), attrOrgID.String(orgID))
+
+		switch r.Method {
+		case http.MethodGet:
+			enrollments, err := s.db.ListEnrollments(r.Context(), EnrollmentFilter{ModuleName: module, OrgID: orgID}, 1, 0)
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			if len(enrollments) == 0 {
+				writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("org '%s' is not enrolled for module '%s'", orgID, module))
+				return
+			}
+			writeJSON(w, http.StatusOK, enrollments[0])
+		case http.MethodPatch:
+			var body enrollmentUpdateRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&body); err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidBody, fmt.Sprintf("cannot decode request body: %v", err))
+				return
+			}
+			if errs := body.validate(); len(errs) > 0 {
+				writeFieldErrors(w, errs)
+				return
+			}
+			annotate(r.Context(), attrChannel.String(body.Channel))
+
+			enrollment, err := s.db.UpdateOrgsModules(r.Context(), module, orgID, body.Channel, newChange(r, body.Reason, body.Ticket))
+			if err != nil {
+				if errors.Is(err, ErrEnrollmentNotFound) {
+					writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("org '%s' is not enrolled for module '%s'", orgID, module))
+					return
+				}
+				writeInternalError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, enrollment)
+		case http.MethodDelete:
+			change := newChange(r, r.URL.Query().Get("reason"), r.URL.Query().Get("ticket"))
+			if err := s.db.DeleteOrgsModules(r.Context(), module, orgID, change); err != nil {
+				if errors.Is(err, ErrEnrollmentNotFound) {
+					writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("org '%s' is not enrolled for module '%s'", orgID, module))
+					return
+				}
+				writeInternalError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Sprintf("method '%s' not allowed", r.Method))
+		}
+	}
+}
+
+// handleOrgEnrollments creates an http.HandlerFunc for the API endpoint
+// /admin/orgs/{org_id}/enrollments.
+func (s *Server) handleOrgEnrollments() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orgID := r.PathValue("org_id")
+		if !validOrgID.MatchString(orgID) {
+			writeError(w, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("invalid org ID: '%s'", orgID))
+			return
+		}
+		annotate(r.Context(), attrOrgID.String(orgID))
+
+		switch r.Method {
+		case http.MethodGet:
+			s.listEnrollments(w, r, EnrollmentFilter{OrgID: orgID})
+		default:
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Sprintf("method '%s' not allowed", r.Method))
+		}
+	}
+}
+
+// listEnrollments writes the enrollments matching filter to w, further
+// filtered and paginated by the request's query parameters.
+func (s *Server) listEnrollments(w http.ResponseWriter, r *http.Request, filter EnrollmentFilter) {
+	params, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
+		return
+	}
+	limit, offset, err := parseLimitOffset(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
+		return
+	}
+	if filter.ModuleName == "" {
+		filter.ModuleName = params.Get("module")
+	}
+	if filter.OrgID == "" {
+		filter.OrgID = params.Get("org_id")
+	}
+	filter.Channel = params.Get("channel")
+
+	enrollments, err := s.db.ListEnrollments(r.Context(), filter, limit, offset)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, enrollments)
+}
+
+// handleAudit creates an http.HandlerFunc for the API endpoint /admin/audit.
+func (s *Server) handleAudit() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			params, err := url.ParseQuery(r.URL.RawQuery)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
+				return
+			}
+			limit, offset, err := parseLimitOffset(params)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
+				return
+			}
+
+			entries, err := s.db.AuditLog(r.Context(), AuditFilter{
+				ModuleName: params.Get("module"),
+				OrgID:      params.Get("org_id"),
+			}, limit, offset)
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, entries)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Sprintf("method '%s' not allowed", r.Method))
+		}
+	}
+}
+
+// handleSeed creates an http.HandlerFunc for the API endpoint /admin/seed.
+func (s *Server) handleSeed() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if s.seed == nil {
+				writeError(w, http.StatusNotFound, codeNotFound, "no seed file configured")
+				return
+			}
+			writeJSON(w, http.StatusOK, s.seed.Status())
+		default:
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Sprintf("method '%s' not allowed", r.Method))
+		}
+	}
+}
+
+// pruneResponse is the JSON body of a response to a request to prune events.
+type pruneResponse struct {
+	OlderThan time.Time `json:"older_than"`
+	DryRun    bool      `json:"dry_run"`
+	Count     int64     `json:"count"`
+}
+
+// handlePruneEvents creates an http.HandlerFunc for the API endpoint
+// /admin/events/prune. Events older than the retention period, or than the
+// older_than parameter if given, are deleted. If the dry_run parameter is true,
+// they are only counted.
+func (s *Server) handlePruneEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			params, err := url.ParseQuery(r.URL.RawQuery)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
+				return
+			}
+
+			var resp pruneResponse
+			if p := params.Get("dry_run"); p != "" {
+				resp.DryRun, err = strconv.ParseBool(p)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("invalid parameter 'dry_run': %v", err))
+					return
+				}
+			}
+			switch p := params.Get("older_than"); {
+			case p != "":
+				resp.OlderThan, err = time.Parse(time.RFC3339, p)
+				if err != nil {
+					writeError(w, http.StatusBadRequest, codeInvalidParameter, "invalid parameter 'older_than': must be RFC 3339 formatted")
+					return
+				}
+			case s.eventRetention > 0:
+				resp.OlderThan = time.Now().Add(-s.eventRetention)
+			default:
+				writeError(w, http.StatusBadRequest, codeMissingParameter, "missing required parameter: 'older_than': event retention is disabled")
+				return
+			}
+			resp.OlderThan = resp.OlderThan.UTC().Truncate(time.Second)
+
+			if resp.DryRun {
+				resp.Count, err = s.db.CountEvents(r.Context(), resp.OlderThan)
+			} else {
+				resp.Count, err = pruneEventsOnce(r.Context(), s.db, resp.OlderThan)
+			}
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, resp)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Sprintf("method '%s' not allowed", r.Method))
+		}
+	}
+}
+
+// handleEventStats creates an http.HandlerFunc for the API endpoint
+// /admin/events/stats. Events matching the same filters as GET /event are
+// aggregated by core version, phase and time bucket.
+func (s *Server) handleEventStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			params, err := url.ParseQuery(r.URL.RawQuery)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
+				return
+			}
+			filter, err := parseEventFilter(params)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
+				return
+			}
+			bucket, err := parseStatsBucket(params)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
+				return
+			}
+
+			stats, err := s.db.AggregateEvents(r.Context(), filter, bucket)
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, stats)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Sprintf("method '%s' not allowed", r.Method))
+		}
+	}
+}
+
+// newChange creates a Change made by the identity of r, with the given reason
+// and ticket.
+func newChange(r *http.Request, reason, ticket string) Change {
+	return Change{
+		Actor:     actor(identity.GetIdentity(r.Context())),
+		Reason:    reason,
+		Ticket:    ticket,
+		RequestID: request.GetReqID(r.Context()),
+	}
+}
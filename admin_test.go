@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestAdminEnrollments(t *testing.T) {
+	type request struct {
+		method, url, body string
+		headers           map[string]string
+	}
+	type response struct {
+		code int
+		body string
+	}
+
+	associate := map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "type": "Associate", "associate": { "email": "jdoe@redhat.com" } } }`))}
+	user := map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}
+
+	// Steps run in order against the same server, so later steps observe the
+	// changes made by earlier ones.
+	steps := []struct {
+		desc  string
+		input request
+		want  response
+	}{
+		{
+			desc:  "GET module enrollments - not an associate",
+			input: request{http.MethodGet, "/api/module-update-router/v1/admin/modules/insights-core/enrollments", "", user},
+			want:  response{http.StatusUnauthorized, `{"errors":[{"status":"Unauthorized","code":"unauthorized","title":"Unauthorized","detail":"identity must be of type 'Associate'","request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "GET module enrollments - seeded",
+			input: request{http.MethodGet, "/api/module-update-router/v1/admin/modules/insights-core/enrollments", "", associate},
+			want:  response{http.StatusOK, `[{"module_name":"insights-core","org_id":"1979710","channel":"testing"}]`},
+		},
+		{
+			desc:  "POST module enrollment",
+			input: request{http.MethodPost, "/api/module-update-router/v1/admin/modules/insights-core/enrollments", `{"org_id": "1979711", "channel": "beta", "expires_at": "2999-01-01T00:00:00Z"}`, associate},
+			want:  response{http.StatusCreated, `{"module_name":"insights-core","org_id":"1979711","channel":"beta","expires_at":"2999-01-01T00:00:00Z"}`},
+		},
+		{
+			desc:  "POST module enrollment - default channel",
+			input: request{http.MethodPost, "/api/module-update-router/v1/admin/modules/insights-core-next/enrollments", `{"org_id": "1979711"}`, associate},
+			want:  response{http.StatusCreated, `{"module_name":"insights-core-next","org_id":"1979711","channel":"testing"}`},
+		},
+		{
+			desc:  "POST module enrollment - already enrolled",
+			input: request{http.MethodPost, "/api/module-update-router/v1/admin/modules/insights-core/enrollments", `{"org_id": "1979711"}`, associate},
+			want:  response{http.StatusConflict, `{"errors":[{"status":"Conflict","code":"conflict","title":"Conflict","detail":"org '1979711' is already enrolled for module 'insights-core'","request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "POST module enrollment - invalid",
+			input: request{http.MethodPost, "/api/module-update-router/v1/admin/modules/insights-core/enrollments", `{"org_id": "abc", "channel": "/beta", "starts_at": "2999-01-02T00:00:00Z", "expires_at": "2999-01-01T00:00:00Z"}`, associate},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","code":"invalid_field","title":"Invalid field in request body","detail":"invalid org ID: must contain only digits","source":{"pointer":"/org_id"},"request_id":"test-request-id"},{"status":"Bad Request","code":"invalid_field","title":"Invalid field in request body","detail":"invalid channel name: must contain only letters, digits, '.', '_' and '-'","source":{"pointer":"/channel"},"request_id":"test-request-id"},{"status":"Bad Request","code":"invalid_field","title":"Invalid field in request body","detail":"invalid expiry: 'expires_at' must be after 'starts_at'","source":{"pointer":"/expires_at"},"request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "GET channel - enrolled org routed to new channel",
+			input: request{http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", "", map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979711", "account_number": "540156", "type": "User", "internal": { "org_id": "1979711" } } }`))}},
+			want:  response{http.StatusOK, `{"url":"/beta"}`},
+		},
+		{
+			desc:  "GET module enrollments - filter by channel",
+			input: request{http.MethodGet, "/api/module-update-router/v1/admin/modules/insights-core/enrollments?channel=beta", "", associate},
+			want:  response{http.StatusOK, `[{"module_name":"insights-core","org_id":"1979711","channel":"beta","expires_at":"2999-01-01T00:00:00Z"}]`},
+		},
+		{
+			desc:  "GET module enrollments - limit 1, offset 1",
+			input: request{http.MethodGet, "/api/module-update-router/v1/admin/modules/insights-core/enrollments?limit=1&offset=1", "", associate},
+			want:  response{http.StatusOK, `[{"module_name":"insights-core","org_id":"1979711","channel":"beta","expires_at":"2999-01-01T00:00:00Z"}]`},
+		},
+		{
+			desc:  "GET module enrollments - negative offset",
+			input: request{http.MethodGet, "/api/module-update-router/v1/admin/modules/insights-core/enrollments?offset=-1", "", associate},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid parameter 'offset': must not be negative","request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "GET org enrollments",
+			input: request{http.MethodGet, "/api/module-update-router/v1/admin/orgs/1979711/enrollments", "", associate},
+			want:  response{http.StatusOK, `[{"module_name":"insights-core","org_id":"1979711","channel":"beta","expires_at":"2999-01-01T00:00:00Z"},{"module_name":"insights-core-next","org_id":"1979711","channel":"testing"}]`},
+		},
+		{
+			desc:  "GET org enrollments - filter by module",
+			input: request{http.MethodGet, "/api/module-update-router/v1/admin/orgs/1979711/enrollments?module=insights-core-next", "", associate},
+			want:  response{http.StatusOK, `[{"module_name":"insights-core-next","org_id":"1979711","channel":"testing"}]`},
+		},
+		{
+			desc:  "GET module enrollment",
+			input: request{http.MethodGet, "/api/module-update-router/v1/admin/modules/insights-core/enrollments/1979710", "", associate},
+			want:  response{http.StatusOK, `{"module_name":"insights-core","org_id":"1979710","channel":"testing"}`},
+		},
+		{
+			desc:  "GET module enrollment - invalid module name",
+			input: request{http.MethodGet, "/api/module-update-router/v1/admin/modules/-insights-core/enrollments/1979710", "", associate},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid module name: '-insights-core'","request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "DELETE module enrollment - invalid org ID",
+			input: request{http.MethodDelete, "/api/module-update-router/v1/admin/modules/insights-core/enrollments/org-1", "", associate},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid org ID: 'org-1'","request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "PATCH module enrollment",
+			input: request{http.MethodPatch, "/api/module-update-router/v1/admin/modules/insights-core/enrollments/1979710", `{"channel": "beta", "reason": "early access"}`, associate},
+			want:  response{http.StatusOK, `{"module_name":"insights-core","org_id":"1979710","channel":"beta"}`},
+		},
+		{
+			desc:  "GET channel - updated org routed to new channel",
+			input: request{http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", "", user},
+			want:  response{http.StatusOK, `{"url":"/beta"}`},
+		},
+		{
+			desc:  "PATCH module enrollment - missing channel",
+			input: request{http.MethodPatch, "/api/module-update-router/v1/admin/modules/insights-core/enrollments/1979710", `{"reason": "early access"}`, associate},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","code":"invalid_field","title":"Invalid field in request body","detail":"missing required field: 'channel'","source":{"pointer":"/channel"},"request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "PATCH module enrollment - invalid channel",
+			input: request{http.MethodPatch, "/api/module-update-router/v1/admin/modules/insights-core/enrollments/1979710", `{"channel": "/beta"}`, associate},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","code":"invalid_field","title":"Invalid field in request body","detail":"invalid channel name: must contain only letters, digits, '.', '_' and '-'","source":{"pointer":"/channel"},"request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "PATCH module enrollment - not enrolled",
+			input: request{http.MethodPatch, "/api/module-update-router/v1/admin/modules/insights-core/enrollments/1979799", `{"channel": "beta"}`, associate},
+			want:  response{http.StatusNotFound, `{"errors":[{"status":"Not Found","code":"not_found","title":"Not found","detail":"org '1979799' is not enrolled for module 'insights-core'","request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "DELETE module enrollment",
+			input: request{http.MethodDelete, "/api/module-update-router/v1/admin/modules/insights-core/enrollments/1979711", "", associate},
+			want:  response{http.StatusNoContent, ""},
+		},
+		{
+			desc:  "DELETE module enrollment - not enrolled",
+			input: request{http.MethodDelete, "/api/module-update-router/v1/admin/modules/insights-core/enrollments/1979711", "", associate},
+			want:  response{http.StatusNotFound, `{"errors":[{"status":"Not Found","code":"not_found","title":"Not found","detail":"org '1979711' is not enrolled for module 'insights-core'","request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "GET module enrollment - not enrolled",
+			input: request{http.MethodGet, "/api/module-update-router/v1/admin/modules/insights-core/enrollments/1979711", "", associate},
+			want:  response{http.StatusNotFound, `{"errors":[{"status":"Not Found","code":"not_found","title":"Not found","detail":"org '1979711' is not enrolled for module 'insights-core'","request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "GET org enrollments - after delete",
+			input: request{http.MethodGet, "/api/module-update-router/v1/admin/orgs/1979711/enrollments", "", associate},
+			want:  response{http.StatusOK, `[{"module_name":"insights-core-next","org_id":"1979711","channel":"testing"}]`},
+		},
+		{
+			desc:  "PUT org enrollments - not allowed",
+			input: request{http.MethodPut, "/api/module-update-router/v1/admin/orgs/1979711/enrollments", "", associate},
+			want:  response{http.StatusMethodNotAllowed, `{"errors":[{"status":"Method Not Allowed","code":"method_not_allowed","title":"Method not allowed","detail":"method 'PUT' not allowed","request_id":"test-request-id"}]}`},
+		},
+	}
+
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.seedData(context.Background(), []byte(`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateResponses(t, srv)
+	defer func() {
+		if err := srv.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	for _, step := range steps {
+		t.Run(step.desc, func(t *testing.T) {
+			req := httptest.NewRequest(step.input.method, step.input.url, strings.NewReader(step.input.body))
+			req.Header.Set("X-Request-Id", testRequestID)
+			for k, v := range step.input.headers {
+				req.Header.Add(k, v)
+			}
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			got := response{rr.Code, rr.Body.String()}
+
+			if !cmp.Equal(got, step.want, cmp.AllowUnexported(response{})) {
+				t.Errorf("\ngot:  %+v\nwant: %+v", got, step.want)
+			}
+		})
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	associate := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "type": "Associate", "associate": { "email": "jdoe@redhat.com" } } }`))
+
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateResponses(t, srv)
+	defer func() {
+		if err := srv.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	requests := []struct {
+		method, url, body, requestID string
+		wantCode                     int
+	}{
+		{http.MethodPost, "/api/module-update-router/v1/admin/modules/insights-core/enrollments", `{"org_id": "1979710", "channel": "beta", "reason": "early access", "ticket": "RHINENG-1234"}`, "req-1", http.StatusCreated},
+		{http.MethodPost, "/api/module-update-router/v1/admin/modules/other/enrollments", `{"org_id": "1979711"}`, "req-2", http.StatusCreated},
+		{http.MethodPatch, "/api/module-update-router/v1/admin/modules/insights-core/enrollments/1979710", `{"channel": "stable", "reason": "promoted"}`, "req-3", http.StatusOK},
+		{http.MethodPatch, "/api/module-update-router/v1/admin/modules/insights-core/enrollments/1979710", `{"channel": "stable"}`, "req-4", http.StatusOK},
+		{http.MethodDelete, "/api/module-update-router/v1/admin/modules/insights-core/enrollments/1979710?reason=trial+ended", "", "req-5", http.StatusNoContent},
+	}
+	for _, r := range requests {
+		req := httptest.NewRequest(r.method, r.url, strings.NewReader(r.body))
+		req.Header.Add("X-Rh-Identity", associate)
+		req.Header.Add("X-Request-Id", r.requestID)
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+		if rr.Code != r.wantCode {
+			t.Fatalf("%v %v: %v != %v: %v", r.method, r.url, rr.Code, r.wantCode, rr.Body.String())
+		}
+	}
+
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		desc string
+		url  string
+		want []AuditEntry
+	}{
+		{
+			desc: "by org",
+			url:  "/api/module-update-router/v1/admin/audit?org_id=1979710",
+			want: []AuditEntry{
+				{Actor: "jdoe@redhat.com", Action: AuditActionDelete, ModuleName: "insights-core", OrgID: "1979710", OldChannel: str("stable"), Reason: str("trial ended"), RequestID: str("req-5")},
+				{Actor: "jdoe@redhat.com", Action: AuditActionUpdate, ModuleName: "insights-core", OrgID: "1979710", OldChannel: str("beta"), NewChannel: str("stable"), Reason: str("promoted"), RequestID: str("req-3")},
+				{Actor: "jdoe@redhat.com", Action: AuditActionCreate, ModuleName: "insights-core", OrgID: "1979710", NewChannel: str("beta"), Reason: str("early access"), Ticket: str("RHINENG-1234"), RequestID: str("req-1")},
+			},
+		},
+		{
+			desc: "by module",
+			url:  "/api/module-update-router/v1/admin/audit?module=other",
+			want: []AuditEntry{
+				{Actor: "jdoe@redhat.com", Action: AuditActionCreate, ModuleName: "other", OrgID: "1979711", NewChannel: str("testing"), RequestID: str("req-2")},
+			},
+		},
+		{
+			desc: "limit 1",
+			url:  "/api/module-update-router/v1/admin/audit?limit=1",
+			want: []AuditEntry{
+				{Actor: "jdoe@redhat.com", Action: AuditActionDelete, ModuleName: "insights-core", OrgID: "1979710", OldChannel: str("stable"), Reason: str("trial ended"), RequestID: str("req-5")},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			req.Header.Add("X-Rh-Identity", associate)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%v != %v: %v", rr.Code, http.StatusOK, rr.Body.String())
+			}
+
+			var got []AuditEntry
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(got, test.want, cmpopts.IgnoreFields(AuditEntry{}, "AuditID", "CreatedAt")) {
+				t.Errorf("%v", cmp.Diff(got, test.want, cmpopts.IgnoreFields(AuditEntry{}, "AuditID", "CreatedAt")))
+			}
+		})
+	}
+}
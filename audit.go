@@ -0,0 +1,77 @@
+package main
+
+import (
+	"time"
+
+	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
+)
+
+// Actions recorded in the enrollment_audit table.
+const (
+	AuditActionCreate = "create"
+	AuditActionUpdate = "update"
+	AuditActionDelete = "delete"
+	AuditActionExpire = "expire"
+)
+
+// systemActor is the actor recorded for changes made by the service itself,
+// such as the removal of expired enrollments.
+const systemActor = "system"
+
+// Change describes who made a change to an enrollment and why. It is recorded
+// alongside every mutation in the enrollment_audit table.
+type Change struct {
+	Actor     string
+	Reason    string
+	Ticket    string
+	RequestID string
+}
+
+// AuditEntry is a record in the enrollment_audit table.
+type AuditEntry struct {
+	AuditID    string    `db:"audit_id" json:"audit_id"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	Actor      string    `db:"actor" json:"actor"`
+	Action     string    `db:"action" json:"action"`
+	ModuleName string    `db:"module_name" json:"module_name"`
+	OrgID      string    `db:"org_id" json:"org_id"`
+	OldChannel *string   `db:"old_channel" json:"old_channel,omitempty"`
+	NewChannel *string   `db:"new_channel" json:"new_channel,omitempty"`
+	Reason     *string   `db:"reason" json:"reason,omitempty"`
+	Ticket     *string   `db:"ticket" json:"ticket,omitempty"`
+	RequestID  *string   `db:"request_id" json:"request_id,omitempty"`
+}
+
+// AuditFilter restricts the records returned by AuditLog. Zero-value fields do
+// not filter.
+type AuditFilter struct {
+	ModuleName string
+	OrgID      string
+}
+
+// actor returns a human-readable name for the principal of id, preferring the
+// associate or user email address.
+func actor(id identity.XRHID) string {
+	switch {
+	case id.Identity.Associate != nil && id.Identity.Associate.Email != "":
+		return id.Identity.Associate.Email
+	case id.Identity.User != nil && id.Identity.User.Email != "":
+		return id.Identity.User.Email
+	case id.Identity.User != nil && id.Identity.User.Username != "":
+		return id.Identity.User.Username
+	case id.Identity.ServiceAccount != nil && id.Identity.ServiceAccount.Username != "":
+		return id.Identity.ServiceAccount.Username
+	case id.Identity.X509 != nil && id.Identity.X509.SubjectDN != "":
+		return id.Identity.X509.SubjectDN
+	default:
+		return id.Identity.Type
+	}
+}
+
+// stringOrNil returns a pointer to s, or nil if s is empty.
+func stringOrNil(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -1,56 +1,251 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"embed"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
+	pgxmigrate "github.com/golang-migrate/migrate/v4/database/pgx/v5"
 	"github.com/golang-migrate/migrate/v4/database/sqlite"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/redhatinsights/module-update-router/internal/config"
 
+	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "modernc.org/sqlite"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //go:embed migrations
 var migrations embed.FS
 
+// sqlitePragmas are applied to every connection opened to a SQLite database.
+// WAL mode lets readers proceed while events are being written, and the busy
+// timeout makes writers wait for each other rather than fail immediately.
+var sqlitePragmas = []string{
+	"busy_timeout(5000)",
+	"foreign_keys(1)",
+	"journal_mode(WAL)",
+}
+
+// sqliteTimeFormat is the _time_format the SQLite driver writes times in. It is
+// one of the formats understood by SQLite's date and time functions.
+const sqliteTimeFormat = "sqlite"
+
+// sqliteTimeColumns are the columns that hold times in a SQLite database.
+// SQLite stores them as text, so they are compared as text, and a time must be
+// written in the same form as every other for those comparisons to hold. See
+// normalizeSQLiteTimes.
+var sqliteTimeColumns = []struct{ table, column string }{
+	{"enrollment_audit", "created_at"},
+	{"events", "ended_at"},
+	{"events", "started_at"},
+	{"orgs_modules", "expires_at"},
+	{"orgs_modules", "starts_at"},
+}
+
+// DefaultChannel is the channel returned for a module that has no default
+// channel configured.
+const DefaultChannel = "release"
+
+var (
+	// ErrEnrollmentExists is returned when creating an enrollment for an org
+	// that is already enrolled for the module.
+	ErrEnrollmentExists = errors.New("db: enrollment already exists")
+
+	// ErrEnrollmentNotFound is returned when an enrollment does not exist.
+	ErrEnrollmentNotFound = errors.New("db: enrollment not found")
+
+	// ErrSchemaDirty is returned when the most recent migration of the
+	// database failed part-way through.
+	ErrSchemaDirty = errors.New("db: schema is dirty")
+
+	// ErrSchemaTooNew is returned when the database has been migrated to a
+	// version newer than the latest migration known to this binary.
+	ErrSchemaTooNew = errors.New("db: schema is newer than the latest known migration")
+
+	// ErrSchemaOutdated is returned when the database has not been migrated
+	// to the latest migration known to this binary.
+	ErrSchemaOutdated = errors.New("db: schema is older than the latest known migration")
+)
+
 // DB wraps a sql.DB handle, providing an application-specific, higher-level API
 // around the standard sql.DB interface.
 type DB struct {
 	handle     *sqlx.DB
-	statements map[string]*sqlx.Stmt
 	driverName string
+
+	// statements caches prepared statements by query. It is shared by every
+	// goroutine using db, so it must only be accessed with statementsMu held.
+	statements   map[string]*sqlx.Stmt
+	statementsMu sync.Mutex
+
+	// queryTimeout bounds the time each method of db may spend in the
+	// database. A non-positive value leaves only the caller's context to
+	// bound it.
+	queryTimeout time.Duration
+
+	// dataSourceName is kept so that migrations can open their own
+	// connections; see newMigrate.
+	dataSourceName string
+
+	// routes is the current routing table, or nil if it has not been loaded
+	// yet. routesMu serializes loading the table so that an older snapshot
+	// never replaces a newer one; reading it requires no lock.
+	routes   atomic.Pointer[routingTable]
+	routesMu sync.Mutex
 }
 
-// Open opens a database specified by dataSourceName. The only supported driver
-// types are "sqlite".
+// Open opens a database specified by dataSourceName. The supported driver types
+// are "pgx" and "sqlite". SQLite connections are configured with sqlitePragmas,
+// unless dataSourceName sets the same pragma itself. Queries are bounded by
+// the configured query timeout, and traced if they are made within a span.
 func Open(driverName, dataSourceName string) (*DB, error) {
-	handle, err := sqlx.Open(driverName, dataSourceName)
+	var system attribute.KeyValue
+	switch driverName {
+	case "pgx":
+		system = semconv.DBSystemNamePostgreSQL
+	case "sqlite":
+		dsn, err := withSQLitePragmas(dataSourceName)
+		if err != nil {
+			return nil, err
+		}
+		dataSourceName = dsn
+		system = semconv.DBSystemNameSQLite
+	default:
+		return nil, fmt.Errorf("db: unsupported driver: %v", driverName)
+	}
+
+	sqlDB, err := otelsql.Open(driverName, dataSourceName,
+		otelsql.WithAttributes(system),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			SpanFilter:           tracedCall,
+		}))
 	if err != nil {
-		return nil, fmt.Errorf("db: sqlx.Open failed: %w", err)
+		return nil, fmt.Errorf("db: otelsql.Open failed: %w", err)
 	}
+	handle := sqlx.NewDb(sqlDB, driverName)
 
 	if err := handle.Ping(); err != nil {
 		return nil, fmt.Errorf("db: handle.Ping failed: %w", err)
 	}
 
 	return &DB{
-		handle:     handle,
-		statements: make(map[string]*sqlx.Stmt),
-		driverName: driverName,
+		handle:       handle,
+		driverName:   driverName,
+		statements:   make(map[string]*sqlx.Stmt),
+		queryTimeout: config.DefaultConfig.DBQueryTimeout,
+
+		dataSourceName: dataSourceName,
 	}, nil
 }
 
+// withSQLitePragmas adds a _pragma query parameter to dataSourceName for each of
+// sqlitePragmas that it does not already set. It also sets the _time_format
+// parameter to sqliteTimeFormat, replacing any other value, because the stored
+// times must all be written in one form.
+func withSQLitePragmas(dataSourceName string) (string, error) {
+	name, query, _ := strings.Cut(dataSourceName, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return "", fmt.Errorf("db: url.ParseQuery failed: %w", err)
+	}
+
+	set := make(map[string]bool)
+	for _, p := range params["_pragma"] {
+		pragma, _, _ := strings.Cut(p, "(")
+		set[strings.ToLower(strings.TrimSpace(pragma))] = true
+	}
+
+	added := url.Values{}
+	for _, p := range sqlitePragmas {
+		pragma, _, _ := strings.Cut(p, "(")
+		if !set[pragma] {
+			added.Add("_pragma", p)
+		}
+	}
+	if params.Get("_time_format") != sqliteTimeFormat {
+		var kept []string
+		for _, p := range strings.Split(query, "&") {
+			if p != "" && !strings.HasPrefix(p, "_time_format=") {
+				kept = append(kept, p)
+			}
+		}
+		query = strings.Join(kept, "&")
+		added.Set("_time_format", sqliteTimeFormat)
+	}
+	if len(added) == 0 {
+		return dataSourceName, nil
+	}
+
+	if query != "" {
+		query += "&"
+	}
+	return name + "?" + query + added.Encode(), nil
+}
+
+// normalizeSQLiteTimes rewrites every time stored in sqliteTimeColumns that is
+// not in the form written by the driver, such as those inserted by raw SQL in
+// RFC3339 format, or those written before the driver was given a _time_format.
+// Times are assumed to be in UTC, as they are everywhere else in the database.
+// Columns missing from the current schema are skipped. It does nothing unless
+// db is a SQLite database.
+func (db *DB) normalizeSQLiteTimes(ctx context.Context) error {
+	if db.driverName != "sqlite" {
+		return nil
+	}
+
+	for _, c := range sqliteTimeColumns {
+		var exists bool
+		if err := db.handle.GetContext(ctx, &exists, `SELECT COUNT(*) > 0 FROM pragma_table_info($1) WHERE name = $2;`, c.table, c.column); err != nil {
+			return fmt.Errorf("db: db.handle.GetContext failed: %w", err)
+		}
+		if !exists {
+			continue
+		}
+
+		// Times written by the driver before it was given a _time_format are
+		// formatted by time.Time.String, which SQLite cannot parse. Every other
+		// time is rewritten by SQLite, dropping trailing zeros in the fraction
+		// of a second, as the driver does.
+		stmts := []string{
+			fmt.Sprintf(`UPDATE %[1]v SET %[2]v = replace(%[2]v, ' +0000 UTC', '+00:00') WHERE %[2]v LIKE '%% +0000 UTC';`, c.table, c.column),
+			fmt.Sprintf(`UPDATE %[1]v SET %[2]v = rtrim(rtrim(strftime('%%Y-%%m-%%d %%H:%%M:%%f', %[2]v), '0'), '.') || '+00:00' WHERE %[2]v NOT GLOB '[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9] [0-9][0-9]:[0-9][0-9]:[0-9][0-9]*+00:00' AND julianday(%[2]v) IS NOT NULL;`, c.table, c.column),
+		}
+		for _, stmt := range stmts {
+			if _, err := db.handle.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("db: normalizing %v.%v failed: %w", c.table, c.column, err)
+			}
+		}
+	}
+	return nil
+}
+
 // Close closes all open prepared statements and returns the connection to the
 // connection pool.
 func (db *DB) Close() error {
+	db.statementsMu.Lock()
+	defer db.statementsMu.Unlock()
+
 	for _, stmt := range db.statements {
 		if err := stmt.Close(); err != nil {
 			fmt.Printf("Error closing stmt: %v", err)
@@ -59,61 +254,638 @@ func (db *DB) Close() error {
 	return db.handle.Close()
 }
 
-// Count returns the number of records found in the orgs_modules table with the
-// given module name and org ID.
-func (db *DB) Count(moduleName, orgID string) (int, error) {
-	stmt, err := db.preparedStatement(`SELECT COUNT(*) FROM orgs_modules WHERE module_name = $1 AND org_id = $2;`)
+// Routes returns the current routing table, loading it from the database on
+// first use. The table is reloaded whenever the routing state is changed
+// through db.
+func (db *DB) Routes(ctx context.Context) (*routingTable, error) {
+	if t := db.routes.Load(); t != nil {
+		return t, nil
+	}
+
+	db.routesMu.Lock()
+	defer db.routesMu.Unlock()
+	if t := db.routes.Load(); t != nil {
+		return t, nil
+	}
+	t, err := db.loadRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	db.routes.Store(t)
+	return t, nil
+}
+
+// refreshRoutes reloads the routing table from the database and swaps it in.
+func (db *DB) refreshRoutes(ctx context.Context) error {
+	db.routesMu.Lock()
+	defer db.routesMu.Unlock()
+
+	t, err := db.loadRoutes(ctx)
 	if err != nil {
-		return -1, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+		return err
 	}
+	db.routes.Store(t)
+	return nil
+}
+
+// routesChanged reloads the routing table after the routing state has been
+// changed, unless the table has not been loaded yet. If the table cannot be
+// reloaded, the error is logged and the previous table remains in use until the
+// next refresh.
+func (db *DB) routesChanged() {
+	// The change has already been committed, so the reload must not be
+	// cancelled along with the context of the request that made it.
+	ctx, cancel := db.withTimeout(context.Background())
+	defer cancel()
 
-	var count int
-	err = stmt.QueryRow(moduleName, orgID).Scan(&count)
+	db.routesMu.Lock()
+	defer db.routesMu.Unlock()
+
+	if db.routes.Load() == nil {
+		return
+	}
+	t, err := db.loadRoutes(ctx)
 	if err != nil {
-		return -1, fmt.Errorf("db: stmt.QueryRow failed: %w", err)
+		log.WithError(err).Error("cannot reload routing table")
+		return
 	}
-	return count, nil
+	db.routes.Store(t)
+}
+
+// loadRoutes builds a routingTable from the orgs_modules, rollouts and channels
+// tables, read in a single transaction.
+func (db *DB) loadRoutes(ctx context.Context) (*routingTable, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.handle.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("db: db.handle.BeginTxx failed: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.WithError(err).Error("rolling back transaction in loadRoutes")
+		}
+	}()
+
+	var enrollments []Enrollment
+	if err := tx.SelectContext(ctx, &enrollments, `SELECT module_name, org_id, channel, starts_at, expires_at FROM orgs_modules;`); err != nil {
+		return nil, fmt.Errorf("db: tx.SelectContext failed: %w", err)
+	}
+
+	var rollouts []Rollout
+	if err := tx.SelectContext(ctx, &rollouts, `SELECT module_name, channel, percentage, salt FROM rollouts;`); err != nil {
+		return nil, fmt.Errorf("db: tx.SelectContext failed: %w", err)
+	}
+
+	var channels []struct {
+		ModuleName  string `db:"module_name"`
+		ChannelName string `db:"channel_name"`
+	}
+	if err := tx.SelectContext(ctx, &channels, `SELECT module_name, channel_name FROM channels WHERE is_default;`); err != nil {
+		return nil, fmt.Errorf("db: tx.SelectContext failed: %w", err)
+	}
+	defaults := make(map[string]string, len(channels))
+	for _, c := range channels {
+		defaults[c.ModuleName] = c.ChannelName
+	}
+
+	return newRoutingTable(enrollments, rollouts, defaults), nil
 }
 
-// InsertOrgsModules creates a new record in the orgs_modules table with the
-// given module name and org ID, creating their respective table records if
-// necessary.
-func (db *DB) InsertOrgsModules(moduleName, orgID string) error {
-	stmt, err := db.preparedStatement(`INSERT INTO orgs_modules (module_name, org_id) VALUES ($1, $2);`)
+// Route returns the name of the channel orgID should use for moduleName at now.
+// It follows the same rules as Channel, but reads the routing table rather than
+// querying the database.
+func (db *DB) Route(ctx context.Context, moduleName, orgID string, now time.Time) (string, error) {
+	routes, err := db.Routes(ctx)
+	if err != nil {
+		return "", err
+	}
+	return routes.Channel(moduleName, orgID, now), nil
+}
+
+// SetRollout creates or replaces the rollout for rollout.ModuleName.
+func (db *DB) SetRollout(ctx context.Context, rollout Rollout) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	stmt, err := db.preparedStatement(ctx, `INSERT INTO rollouts (module_name, channel, percentage, salt) VALUES ($1, $2, $3, $4) ON CONFLICT (module_name) DO UPDATE SET channel = excluded.channel, percentage = excluded.percentage, salt = excluded.salt;`)
 	if err != nil {
 		return fmt.Errorf("db: db.preparedStatement failed: %w", err)
 	}
-	_, err = stmt.Exec(moduleName, orgID)
+	_, err = stmt.ExecContext(ctx, rollout.ModuleName, rollout.Channel, rollout.Percentage, rollout.Salt)
 	if err != nil {
-		return fmt.Errorf("db: stmt.Exec failed: %w", err)
+		return fmt.Errorf("db: stmt.ExecContext failed: %w", err)
 	}
+	db.routesChanged()
 
 	return nil
 }
 
-// InsertEvents creates a new record in the events table.
-func (db *DB) InsertEvents(phase string, startedAt time.Time, exit int, exception sql.NullString, endedAt time.Time, machineID string, coreVersion string, corePath string) error {
-	eventID, err := uuid.NewUUID()
+// InsertOrgsModules creates a new record in the orgs_modules table from the
+// given enrollment and records change in the enrollment_audit table. If the org
+// is already enrolled for the module, ErrEnrollmentExists is returned.
+func (db *DB) InsertOrgsModules(ctx context.Context, enrollment Enrollment, change Change) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.handle.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("db: db.handle.BeginTxx failed: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.WithError(err).Error("rolling back transaction in InsertOrgsModules")
+		}
+	}()
+
+	result, err := tx.ExecContext(ctx, `INSERT INTO orgs_modules (module_name, org_id, channel, starts_at, expires_at) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (module_name, org_id) DO NOTHING;`,
+		enrollment.ModuleName, enrollment.OrgID, enrollment.Channel, enrollment.StartsAt, enrollment.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("db: tx.ExecContext failed: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db: result.RowsAffected failed: %w", err)
+	}
+	if rowsAffected == 0 {
+		return ErrEnrollmentExists
+	}
+
+	if err := insertAudit(ctx, tx, AuditActionCreate, enrollment.ModuleName, enrollment.OrgID, "", enrollment.Channel, change); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("db: tx.Commit failed: %w", err)
+	}
+	db.routesChanged()
+	return nil
+}
+
+// DeleteOrgsModules deletes the record in the orgs_modules table with the given
+// module name and org ID and records change in the enrollment_audit table. If
+// no such record exists, ErrEnrollmentNotFound is returned.
+func (db *DB) DeleteOrgsModules(ctx context.Context, moduleName, orgID string, change Change) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.handle.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("db: db.handle.BeginTxx failed: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.WithError(err).Error("rolling back transaction in DeleteOrgsModules")
+		}
+	}()
+
+	var channel string
+	err = tx.QueryRowContext(ctx, `SELECT channel FROM orgs_modules WHERE module_name = $1 AND org_id = $2;`, moduleName, orgID).Scan(&channel)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrEnrollmentNotFound
+	case err != nil:
+		return fmt.Errorf("db: tx.QueryRowContext failed: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM orgs_modules WHERE module_name = $1 AND org_id = $2;`, moduleName, orgID); err != nil {
+		return fmt.Errorf("db: tx.ExecContext failed: %w", err)
+	}
+
+	if err := insertAudit(ctx, tx, AuditActionDelete, moduleName, orgID, channel, "", change); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("db: tx.Commit failed: %w", err)
+	}
+	db.routesChanged()
+	return nil
+}
+
+// UpdateOrgsModules moves the org with the given ID to channel in the
+// orgs_modules record of moduleName and records change in the enrollment_audit
+// table, along with the previous channel. The updated enrollment is returned.
+// If the org is already enrolled in channel, nothing is changed. If no such
+// record exists, ErrEnrollmentNotFound is returned.
+func (db *DB) UpdateOrgsModules(ctx context.Context, moduleName, orgID, channel string, change Change) (Enrollment, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.handle.BeginTxx(ctx, nil)
+	if err != nil {
+		return Enrollment{}, fmt.Errorf("db: db.handle.BeginTxx failed: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.WithError(err).Error("rolling back transaction in UpdateOrgsModules")
+		}
+	}()
+
+	var enrollment Enrollment
+	err = tx.QueryRowxContext(ctx, `SELECT module_name, org_id, channel, starts_at, expires_at FROM orgs_modules WHERE module_name = $1 AND org_id = $2;`, moduleName, orgID).StructScan(&enrollment)
+	switch {
+	case err == sql.ErrNoRows:
+		return Enrollment{}, ErrEnrollmentNotFound
+	case err != nil:
+		return Enrollment{}, fmt.Errorf("db: tx.QueryRowxContext failed: %w", err)
+	}
+	if enrollment.Channel == channel {
+		return enrollment, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE orgs_modules SET channel = $3 WHERE module_name = $1 AND org_id = $2;`, moduleName, orgID, channel); err != nil {
+		return Enrollment{}, fmt.Errorf("db: tx.ExecContext failed: %w", err)
+	}
+
+	if err := insertAudit(ctx, tx, AuditActionUpdate, moduleName, orgID, enrollment.Channel, channel, change); err != nil {
+		return Enrollment{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Enrollment{}, fmt.Errorf("db: tx.Commit failed: %w", err)
+	}
+	db.routesChanged()
+	enrollment.Channel = channel
+	return enrollment, nil
+}
+
+// EnrollmentFilter restricts the records returned by ListEnrollments. Zero-value
+// fields do not filter.
+type EnrollmentFilter struct {
+	ModuleName string
+	OrgID      string
+	Channel    string
+}
+
+// ListEnrollments returns records from the orgs_modules table matching filter,
+// ordered by module name and org ID. If limit is negative, all matching records
+// after offset are returned.
+func (db *DB) ListEnrollments(ctx context.Context, filter EnrollmentFilter, limit, offset int) ([]Enrollment, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var (
+		where []string
+		args  []interface{}
+	)
+	for _, f := range []struct{ column, value string }{
+		{"module_name", filter.ModuleName},
+		{"org_id", filter.OrgID},
+		{"channel", filter.Channel},
+	} {
+		if f.value == "" {
+			continue
+		}
+		args = append(args, f.value)
+		where = append(where, fmt.Sprintf("%v = $%v", f.column, len(args)))
+	}
+
+	query := `SELECT module_name, org_id, channel, starts_at, expires_at FROM orgs_modules`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY module_name, org_id`
+	clause, args := db.limitOffset(args, limit, offset)
+	query += clause + `;`
+
+	stmt, err := db.preparedStatement(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	enrollments := make([]Enrollment, 0)
+	if err := stmt.SelectContext(ctx, &enrollments, args...); err != nil {
+		return nil, fmt.Errorf("db: stmt.SelectContext failed: %w", err)
+	}
+	return enrollments, nil
+}
+
+// ExpiringEnrollments returns all records from the orgs_modules table that have
+// an expiry time set.
+func (db *DB) ExpiringEnrollments(ctx context.Context) ([]Enrollment, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	stmt, err := db.preparedStatement(ctx, `SELECT module_name, org_id, channel, starts_at, expires_at FROM orgs_modules WHERE expires_at IS NOT NULL;`)
+	if err != nil {
+		return nil, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	enrollments := make([]Enrollment, 0)
+	if err := stmt.SelectContext(ctx, &enrollments); err != nil {
+		return nil, fmt.Errorf("db: stmt.SelectContext failed: %w", err)
+	}
+	return enrollments, nil
+}
+
+// DeleteExpiredEnrollments deletes all records from the orgs_modules table that
+// have expired at the given time, recording each deletion in the
+// enrollment_audit table, and returns the deleted records.
+func (db *DB) DeleteExpiredEnrollments(ctx context.Context, now time.Time) ([]Enrollment, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.handle.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("db: db.handle.BeginTxx failed: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.WithError(err).Error("rolling back transaction in DeleteExpiredEnrollments")
+		}
+	}()
+
+	expired := make([]Enrollment, 0)
+	if err := tx.SelectContext(ctx, &expired, `SELECT module_name, org_id, channel, starts_at, expires_at FROM orgs_modules WHERE expires_at IS NOT NULL AND expires_at <= $1;`, now.UTC()); err != nil {
+		return nil, fmt.Errorf("db: tx.SelectContext failed: %w", err)
+	}
+	if len(expired) == 0 {
+		return expired, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM orgs_modules WHERE expires_at IS NOT NULL AND expires_at <= $1;`, now.UTC()); err != nil {
+		return nil, fmt.Errorf("db: tx.ExecContext failed: %w", err)
+	}
+	for _, e := range expired {
+		if err := insertAudit(ctx, tx, AuditActionExpire, e.ModuleName, e.OrgID, e.Channel, "", Change{Actor: systemActor, Reason: "enrollment expired"}); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("db: tx.Commit failed: %w", err)
+	}
+	db.routesChanged()
+	return expired, nil
+}
+
+// AuditLog returns records from the enrollment_audit table matching filter,
+// newest first. If limit is negative, all matching records after offset are
+// returned.
+func (db *DB) AuditLog(ctx context.Context, filter AuditFilter, limit, offset int) ([]AuditEntry, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var (
+		where []string
+		args  []interface{}
+	)
+	for _, f := range []struct{ column, value string }{
+		{"module_name", filter.ModuleName},
+		{"org_id", filter.OrgID},
+	} {
+		if f.value == "" {
+			continue
+		}
+		args = append(args, f.value)
+		where = append(where, fmt.Sprintf("%v = $%v", f.column, len(args)))
+	}
+
+	query := `SELECT audit_id, created_at, actor, action, module_name, org_id, old_channel, new_channel, reason, ticket, request_id FROM enrollment_audit`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY created_at DESC, audit_id`
+	clause, args := db.limitOffset(args, limit, offset)
+	query += clause + `;`
+
+	stmt, err := db.preparedStatement(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	entries := make([]AuditEntry, 0)
+	if err := stmt.SelectContext(ctx, &entries, args...); err != nil {
+		return nil, fmt.Errorf("db: stmt.SelectContext failed: %w", err)
+	}
+	return entries, nil
+}
+
+// insertAudit records a change to the enrollment of orgID in moduleName, from
+// oldChannel to newChannel, in the enrollment_audit table as part of tx. An
+// empty channel is recorded as NULL.
+func insertAudit(ctx context.Context, tx *sqlx.Tx, action, moduleName, orgID, oldChannel, newChannel string, change Change) error {
+	auditID, err := newUUID()
 	if err != nil {
 		return fmt.Errorf("db: uuid.NewUUID failed: %w", err)
 	}
 
-	stmt, err := db.preparedStatement(`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`)
+	_, err = tx.ExecContext(ctx, `INSERT INTO enrollment_audit (audit_id, created_at, actor, action, module_name, org_id, old_channel, new_channel, reason, ticket, request_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);`,
+		auditID.String(), time.Now().UTC(), change.Actor, action, moduleName, orgID,
+		stringOrNil(oldChannel), stringOrNil(newChannel), stringOrNil(change.Reason), stringOrNil(change.Ticket), stringOrNil(change.RequestID))
+	if err != nil {
+		return fmt.Errorf("db: tx.ExecContext failed: %w", err)
+	}
+	return nil
+}
+
+// InsertChannel creates a new record in the channels table for the given
+// module. If isDefault is true, the channel becomes the module's default
+// channel; a module can have at most one default channel.
+func (db *DB) InsertChannel(ctx context.Context, moduleName, channelName string, isDefault bool) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	stmt, err := db.preparedStatement(ctx, `INSERT INTO channels (module_name, channel_name, is_default) VALUES ($1, $2, $3);`)
 	if err != nil {
 		return fmt.Errorf("db: db.preparedStatement failed: %w", err)
 	}
+	_, err = stmt.ExecContext(ctx, moduleName, channelName, isDefault)
+	if err != nil {
+		return fmt.Errorf("db: stmt.ExecContext failed: %w", err)
+	}
+	db.routesChanged()
+
+	return nil
+}
+
+// newUUID generates the identifiers assigned to new records. It is a variable
+// so that tests can substitute a deterministic generator.
+var newUUID = uuid.NewUUID
+
+// InsertEventBatch creates a record in the events table for each of the given
+// events inside a single transaction. Either all events are written or none
+// are.
+func (db *DB) InsertEventBatch(ctx context.Context, events []event) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.handle.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("db: db.handle.BeginTxx failed: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.WithError(err).Error("rolling back transaction in InsertEventBatch")
+		}
+	}()
 
-	_, err = stmt.Exec(eventID.String(), phase, startedAt, exit, exception, endedAt, machineID, coreVersion, corePath)
+	stmt, err := tx.PreparexContext(ctx, `INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`)
 	if err != nil {
-		return fmt.Errorf("db: stmt.Exec failed: %w", err)
+		return fmt.Errorf("db: tx.PreparexContext failed: %w", err)
+	}
+	defer func() {
+		if err := stmt.Close(); err != nil {
+			log.WithError(err).Error("closing statement in InsertEventBatch")
+		}
+	}()
+
+	for _, e := range events {
+		if _, err := stmt.ExecContext(ctx, e.eventID, e.phase, e.startedAt, e.exit, e.exception, e.endedAt, e.machineID, e.coreVersion, e.corePath); err != nil {
+			return fmt.Errorf("db: stmt.ExecContext failed: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("db: tx.Commit failed: %w", err)
 	}
 
 	return nil
 }
 
-// GetEvents returns a slice of maps loaded with records from the events table.
-func (db *DB) GetEvents(limit int, offset int) ([]map[string]interface{}, error) {
-	type event struct {
+// GetEvents returns a slice of maps loaded with records from the events table
+// matching filter, ordered by start time. If limit is negative, all matching
+// records after offset are returned.
+func (db *DB) GetEvents(ctx context.Context, filter EventFilter, limit int, offset int) ([]map[string]interface{}, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	where, args := eventWhere(filter, nil)
+	query := `SELECT event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path FROM events` + where + ` ORDER BY started_at, event_id`
+	clause, args := db.limitOffset(args, limit, offset)
+
+	events, err := db.queryEvents(ctx, query+clause+`;`, args)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]map[string]interface{}, 0, len(events))
+	for _, e := range events {
+		records = append(records, e.record())
+	}
+	return records, nil
+}
+
+// GetEventPage returns a page of at most limit records from the events table
+// matching filter, ordered by start time and event ID, together with the number
+// of matching records and cursors to the adjacent pages. If cursor is nil, the
+// first page is returned. If limit is negative, all matching records beyond
+// cursor are returned.
+func (db *DB) GetEventPage(ctx context.Context, filter EventFilter, cursor *EventCursor, limit int) (EventPage, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	where, args := eventWhere(filter, nil)
+
+	stmt, err := db.preparedStatement(ctx, `SELECT COUNT(*) FROM events`+where+`;`)
+	if err != nil {
+		return EventPage{}, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+	var count int64
+	if err := stmt.QueryRowxContext(ctx, args...).Scan(&count); err != nil {
+		return EventPage{}, fmt.Errorf("db: stmt.QueryRowxContext failed: %w", err)
+	}
+
+	order := ` ORDER BY started_at, event_id`
+	if cursor != nil {
+		op := ">"
+		if cursor.Before {
+			op, order = "<", ` ORDER BY started_at DESC, event_id DESC`
+		}
+		args = append(args, cursor.StartedAt.UTC(), cursor.EventID)
+		condition := fmt.Sprintf(`(started_at %[1]v $%[2]v OR (started_at = $%[2]v AND event_id %[1]v $%[3]v))`, op, len(args)-1, len(args))
+		if where == "" {
+			where = ` WHERE ` + condition
+		} else {
+			where += ` AND ` + condition
+		}
+	}
+	query := `SELECT event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path FROM events` + where + order
+	if limit >= 0 {
+		args = append(args, limit+1)
+		query += fmt.Sprintf(` LIMIT $%v`, len(args))
+	}
+
+	events, err := db.queryEvents(ctx, query+`;`, args)
+	if err != nil {
+		return EventPage{}, err
+	}
+	return newEventPage(events, count, cursor, limit), nil
+}
+
+// AggregateEvents returns statistics of the records from the events table
+// matching filter, grouped by core version, phase and time bucket of width
+// bucket.
+func (db *DB) AggregateEvents(ctx context.Context, filter EventFilter, bucket time.Duration) ([]EventStats, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	// Medians cannot be computed portably in SQL, so the events are
+	// aggregated in Go.
+	where, args := eventWhere(filter, nil)
+	events, err := db.queryEvents(ctx, `SELECT phase, started_at, exit, ended_at, core_version FROM events`+where+`;`, args)
+	if err != nil {
+		return nil, err
+	}
+	return aggregateEvents(events, bucket), nil
+}
+
+// eventWhere returns a WHERE clause matching filter, and args extended with its
+// parameters. If filter matches every event, the clause is empty.
+func eventWhere(filter EventFilter, args []interface{}) (string, []interface{}) {
+	var where []string
+	condition := func(format string, value interface{}) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(format, len(args)))
+	}
+	for _, f := range []struct{ column, value string }{
+		{"machine_id", filter.MachineID},
+		{"phase", filter.Phase},
+		{"core_version", filter.CoreVersion},
+	} {
+		if f.value != "" {
+			condition(f.column+" = $%v", f.value)
+		}
+	}
+	if filter.Exit != nil {
+		condition("exit = $%v", *filter.Exit)
+	}
+	if filter.ExitNonZero {
+		where = append(where, "exit <> 0")
+	}
+	if filter.HasException != nil {
+		if *filter.HasException {
+			where = append(where, "exception IS NOT NULL")
+		} else {
+			where = append(where, "exception IS NULL")
+		}
+	}
+	for _, f := range []struct {
+		format string
+		value  time.Time
+	}{
+		{"started_at >= $%v", filter.StartedAfter},
+		{"started_at < $%v", filter.StartedBefore},
+		{"ended_at >= $%v", filter.EndedAfter},
+		{"ended_at < $%v", filter.EndedBefore},
+	} {
+		if !f.value.IsZero() {
+			condition(f.format, f.value.UTC())
+		}
+	}
+
+	if len(where) == 0 {
+		return "", args
+	}
+	return ` WHERE ` + strings.Join(where, " AND "), args
+}
+
+// queryEvents runs query, a SELECT of columns of the events table, and returns
+// the selected events. Columns that are not selected are left unset.
+func (db *DB) queryEvents(ctx context.Context, query string, args []interface{}) ([]event, error) {
+	type row struct {
 		EventID     string         `db:"event_id"`
 		Phase       string         `db:"phase"`
 		StartedAt   time.Time      `db:"started_at"`
@@ -124,52 +896,39 @@ func (db *DB) GetEvents(limit int, offset int) ([]map[string]interface{}, error)
 		CoreVersion string         `db:"core_version"`
 		CorePath    sql.NullString `db:"core_path"`
 	}
-	var stmt *sqlx.Stmt
-	if limit < 0 {
-		var err error
-		stmt, err = db.preparedStatement(`SELECT * FROM events ORDER BY started_at;`)
-		if err != nil {
-			return nil, fmt.Errorf("db: db.preparedStatement failed: %w", err)
-		}
-	} else {
-		var err error
-		stmt, err = db.preparedStatement(fmt.Sprintf(`SELECT * FROM events ORDER BY started_at LIMIT %v OFFSET %v;`, limit, offset))
-		if err != nil {
-			return nil, fmt.Errorf("db: db.preparedStatement failed: %w", err)
-		}
+
+	stmt, err := db.preparedStatement(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("db: db.preparedStatement failed: %w", err)
 	}
 
-	rows, err := stmt.Queryx()
+	rows, err := stmt.QueryxContext(ctx, args...)
 	if err != nil {
-		return nil, fmt.Errorf("db: stmt.Queryx failed: %w", err)
+		return nil, fmt.Errorf("db: stmt.QueryxContext failed: %w", err)
 	}
 	defer func() {
 		if err := rows.Close(); err != nil {
-			log.WithError(err).Error("closing rows in GetEvents")
+			log.WithError(err).Error("closing rows in queryEvents")
 		}
 	}()
 
-	events := make([]map[string]interface{}, 0)
+	events := make([]event, 0)
 	for rows.Next() {
-		var e event
-		if err := rows.StructScan(&e); err != nil {
+		var r row
+		if err := rows.StructScan(&r); err != nil {
 			return nil, fmt.Errorf("db: rows.StructScan failed: %w", err)
 		}
-		event := make(map[string]interface{})
-		event["event_id"] = e.EventID
-		event["phase"] = e.Phase
-		event["started_at"] = e.StartedAt
-		event["exit"] = e.Exit
-		if e.Exception.Valid {
-			event["exception"] = e.Exception.String
-		}
-		event["ended_at"] = e.EndedAt
-		event["machine_id"] = e.MachineID
-		event["core_version"] = e.CoreVersion
-		if e.CorePath.Valid {
-			event["core_path"] = e.CorePath.String
-		}
-		events = append(events, event)
+		events = append(events, event{
+			eventID:     r.EventID,
+			phase:       r.Phase,
+			startedAt:   r.StartedAt,
+			exit:        r.Exit,
+			exception:   r.Exception,
+			endedAt:     r.EndedAt,
+			machineID:   r.MachineID,
+			coreVersion: r.CoreVersion,
+			corePath:    r.CorePath,
+		})
 	}
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("db: rows.Err failed: %w", err)
@@ -179,15 +938,18 @@ func (db *DB) GetEvents(limit int, offset int) ([]map[string]interface{}, error)
 
 // DeleteEvents deletes all rows from the events table that have a started_at
 // date older than the given time and returns the number of rows deleted.
-func (db *DB) DeleteEvents(older time.Time) (int64, error) {
-	stmt, err := db.preparedStatement(`DELETE FROM events WHERE started_at < $1;`)
+func (db *DB) DeleteEvents(ctx context.Context, older time.Time) (int64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	stmt, err := db.preparedStatement(ctx, `DELETE FROM events WHERE started_at < $1;`)
 	if err != nil {
 		return -1, fmt.Errorf("db: db.preparedStatement failed: %w", err)
 	}
 
-	result, err := stmt.Exec(older.Format(time.RFC3339))
+	result, err := stmt.ExecContext(ctx, older.UTC())
 	if err != nil {
-		return -1, fmt.Errorf("db: stmt.Exec failed: %w", err)
+		return -1, fmt.Errorf("db: stmt.ExecContext failed: %w", err)
 	}
 
 	rowsAffected, err := result.RowsAffected()
@@ -198,14 +960,35 @@ func (db *DB) DeleteEvents(older time.Time) (int64, error) {
 	return rowsAffected, nil
 }
 
+// CountEvents returns the number of rows in the events table that have a
+// started_at date older than the given time; that is, the number of rows
+// DeleteEvents would delete.
+func (db *DB) CountEvents(ctx context.Context, older time.Time) (int64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	stmt, err := db.preparedStatement(ctx, `SELECT COUNT(*) FROM events WHERE started_at < $1;`)
+	if err != nil {
+		return -1, fmt.Errorf("db: db.preparedStatement failed: %w", err)
+	}
+
+	var count int64
+	if err := stmt.QueryRowContext(ctx, older.UTC()).Scan(&count); err != nil {
+		return -1, fmt.Errorf("db: stmt.QueryRowContext failed: %w", err)
+	}
+	return count, nil
+}
+
 // Migrate inspects the current active migration version and runs all necessary
 // steps to migrate all the way up. If reset is true, everything is deleted in
-// the database before applying migrations.
-func (db *DB) Migrate(reset bool) error {
-	m, err := newMigrate(db.handle.DB, db.driverName)
+// the database before applying migrations. Migrations are not bound by the
+// query timeout; if ctx is done, Migrate stops after the migration in progress.
+func (db *DB) Migrate(ctx context.Context, reset bool) error {
+	m, err := db.newMigrate()
 	if err != nil {
-		return fmt.Errorf("db: newMigrate failed: %w", err)
+		return fmt.Errorf("db: db.newMigrate failed: %w", err)
 	}
+	defer func() { db.closeMigrate(m) }()
 
 	if reset {
 		if err := m.Drop(); err != nil {
@@ -215,58 +998,410 @@ func (db *DB) Migrate(reset bool) error {
 		// exists. In the postgres driver, an unexported function, ensureVersionTable,
 		// is called inside WithInstance. So we just reinitialize m to a new
 		// Migrate instance.
-		m, err = newMigrate(db.handle.DB, db.driverName)
+		db.closeMigrate(m)
+		m, err = db.newMigrate()
 		if err != nil {
-			return fmt.Errorf("db: newMigrate failed: %w", err)
+			return fmt.Errorf("db: db.newMigrate failed: %w", err)
 		}
 	}
 
-	if err := m.Up(); err != nil {
-		if err == migrate.ErrNoChange {
-			return nil
-		}
+	stop := context.AfterFunc(ctx, func() { m.GracefulStop <- true })
+	defer stop()
+
+	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
 		return fmt.Errorf("db: m.Up failed: %w", err)
 	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("db: migrations stopped: %w", err)
+	}
+	if err := db.normalizeSQLiteTimes(ctx); err != nil {
+		return err
+	}
+	db.routesChanged()
 	return nil
 }
 
-// Seed executes the SQL contained in path in order to seed the database.
-func (db *DB) Seed(path string) error {
+// MigrateDown rolls back the n most recently applied migrations. If ctx is
+// done, MigrateDown stops after the migration in progress.
+func (db *DB) MigrateDown(ctx context.Context, n int) error {
+	if n < 1 {
+		return fmt.Errorf("db: invalid number of migrations: %v", n)
+	}
+
+	m, err := db.newMigrate()
+	if err != nil {
+		return fmt.Errorf("db: db.newMigrate failed: %w", err)
+	}
+	defer db.closeMigrate(m)
+
+	stop := context.AfterFunc(ctx, func() { m.GracefulStop <- true })
+	defer stop()
+
+	if err := m.Steps(-n); err != nil {
+		return fmt.Errorf("db: m.Steps failed: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("db: migrations stopped: %w", err)
+	}
+	db.routesChanged()
+	return nil
+}
+
+// SchemaVersion returns the version of the most recently applied migration,
+// and whether that migration failed part-way through, leaving the schema
+// dirty. A version of 0 means that no migration has been applied.
+func (db *DB) SchemaVersion(ctx context.Context) (uint, bool, error) {
+	m, err := db.newMigrate()
+	if err != nil {
+		return 0, false, fmt.Errorf("db: db.newMigrate failed: %w", err)
+	}
+	defer db.closeMigrate(m)
+
+	version, dirty, err := m.Version()
+	switch {
+	case err == migrate.ErrNilVersion:
+		return 0, false, nil
+	case err != nil:
+		return 0, false, fmt.Errorf("db: m.Version failed: %w", err)
+	}
+	return version, dirty, nil
+}
+
+// ForceSchemaVersion records version as the current schema version and clears
+// the dirty flag, without running any migration. It is used to recover once a
+// failed migration has been repaired by hand. A version of -1 records that no
+// migration has been applied.
+func (db *DB) ForceSchemaVersion(ctx context.Context, version int) error {
+	m, err := db.newMigrate()
+	if err != nil {
+		return fmt.Errorf("db: db.newMigrate failed: %w", err)
+	}
+	defer db.closeMigrate(m)
+
+	if err := m.Force(version); err != nil {
+		return fmt.Errorf("db: m.Force failed: %w", err)
+	}
+	return nil
+}
+
+// CheckSchema returns ErrSchemaDirty if the most recent migration of the
+// database failed, or ErrSchemaTooNew if the database has been migrated past
+// the latest migration embedded in this binary. Either way, the schema cannot
+// be trusted to match what the binary expects.
+func (db *DB) CheckSchema(ctx context.Context) error {
+	version, dirty, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("%w: migration %v failed", ErrSchemaDirty, version)
+	}
+
+	latest, err := latestSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > latest {
+		return fmt.Errorf("%w: database is at version %v, latest known migration is %v", ErrSchemaTooNew, version, latest)
+	}
+	return nil
+}
+
+// CheckSchemaReady returns ErrSchemaDirty if the most recent migration of the
+// database failed, or ErrSchemaOutdated if the database has not been migrated
+// up to the latest migration embedded in this binary. A database migrated past
+// it passes: migrations are kept backward compatible, so that replicas of the
+// previous release keep serving while a rolling update migrates the shared
+// database. Unlike CheckSchema, it reads the version straight from the
+// schema_migrations table, so it is cheap enough to run on every readiness
+// check.
+func (db *DB) CheckSchemaReady(ctx context.Context) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	var (
+		version int64
+		dirty   bool
+	)
+	err := db.handle.QueryRowxContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1;`).Scan(&version, &dirty)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("%w: no migration has been applied", ErrSchemaOutdated)
+	case err != nil:
+		return fmt.Errorf("db: db.handle.QueryRowxContext failed: %w", err)
+	}
+	if dirty {
+		return fmt.Errorf("%w: migration %v failed", ErrSchemaDirty, version)
+	}
+
+	latest, err := latestSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version < int64(latest) {
+		return fmt.Errorf("%w: database is at version %v, latest known migration is %v", ErrSchemaOutdated, version, latest)
+	}
+	return nil
+}
+
+// Ping verifies that the database can be reached.
+func (db *DB) Ping(ctx context.Context) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	if err := db.handle.PingContext(ctx); err != nil {
+		return fmt.Errorf("db: db.handle.PingContext failed: %w", err)
+	}
+	return nil
+}
+
+// latestSchemaVersion returns the version of the latest migration embedded in
+// the binary.
+func latestSchemaVersion() (uint, error) {
+	source, err := iofs.New(migrations, "migrations")
+	if err != nil {
+		return 0, fmt.Errorf("db: iofs.New failed: %w", err)
+	}
+	defer func() { _ = source.Close() }()
+
+	version, err := source.First()
+	if err != nil {
+		return 0, fmt.Errorf("db: source.First failed: %w", err)
+	}
+	for {
+		next, err := source.Next(version)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return version, nil
+		case err != nil:
+			return 0, fmt.Errorf("db: source.Next failed: %w", err)
+		}
+		version = next
+	}
+}
+
+// Seed seeds the database from the file at path. A YAML or JSON file is parsed
+// and validated as a declarative seed file and applied in a single
+// transaction. Any other file is executed as raw SQL, which is only supported
+// for backwards compatibility.
+func (db *DB) Seed(ctx context.Context, path string) error {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("db: os.ReadFile failed: %w", err)
 	}
-	return db.seedData(data)
+	return db.seed(ctx, path, data)
+}
+
+// seed seeds the database from data, the contents of the seed file at path.
+func (db *DB) seed(ctx context.Context, path string, data []byte) error {
+	if !isStructuredSeed(path) {
+		log.WithField("path", path).Warn("seeding from raw SQL is deprecated; use a YAML or JSON seed file")
+		return db.seedData(ctx, data)
+	}
+
+	seed, err := parseSeed(data)
+	if err != nil {
+		return err
+	}
+	return db.applySeed(ctx, seed)
 }
 
-func (db *DB) seedData(data []byte) error {
-	_, err := db.handle.Exec(string(data))
+// applySeed applies seed in a single transaction. The channels and rollout of
+// each module in seed replace any the module already has. Enrollments in seed
+// are created, or updated if they differ from an existing enrollment, and are
+// marked as seeded. Seeded enrollments that are no longer in seed are deleted.
+// Every change is recorded in the enrollment_audit table. Enrollments created
+// through the admin API are left untouched unless seed lists them.
+func (db *DB) applySeed(ctx context.Context, seed seedFile) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := db.handle.BeginTxx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("db: db.handle.Exec failed: %w", err)
+		return fmt.Errorf("db: db.handle.BeginTxx failed: %w", err)
 	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.WithError(err).Error("rolling back transaction in applySeed")
+		}
+	}()
+
+	for _, m := range seed.Modules {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM channels WHERE module_name = $1;`, m.Name); err != nil {
+			return fmt.Errorf("db: tx.ExecContext failed: %w", err)
+		}
+		for _, c := range m.Channels {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO channels (module_name, channel_name, is_default) VALUES ($1, $2, $3);`, m.Name, c.Name, c.Default); err != nil {
+				return fmt.Errorf("db: tx.ExecContext failed: %w", err)
+			}
+		}
+
+		if m.Rollout == nil {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM rollouts WHERE module_name = $1;`, m.Name); err != nil {
+				return fmt.Errorf("db: tx.ExecContext failed: %w", err)
+			}
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO rollouts (module_name, channel, percentage, salt) VALUES ($1, $2, $3, $4) ON CONFLICT (module_name) DO UPDATE SET channel = excluded.channel, percentage = excluded.percentage, salt = excluded.salt;`,
+			m.Name, m.Rollout.Channel, m.Rollout.Percentage, m.Rollout.Salt); err != nil {
+			return fmt.Errorf("db: tx.ExecContext failed: %w", err)
+		}
+	}
+
+	seeded := make(map[[2]string]bool)
+	for _, e := range seed.Enrollments {
+		change := Change{Actor: seedActor, Reason: e.Reason, Ticket: e.Ticket}
+		for _, enrollment := range e.enrollments() {
+			seeded[[2]string{enrollment.ModuleName, enrollment.OrgID}] = true
+
+			var existing Enrollment
+			err := tx.QueryRowxContext(ctx, `SELECT module_name, org_id, channel, starts_at, expires_at FROM orgs_modules WHERE module_name = $1 AND org_id = $2;`,
+				enrollment.ModuleName, enrollment.OrgID).StructScan(&existing)
+			switch {
+			case err == sql.ErrNoRows:
+				if _, err := tx.ExecContext(ctx, `INSERT INTO orgs_modules (module_name, org_id, channel, starts_at, expires_at, seeded) VALUES ($1, $2, $3, $4, $5, TRUE);`,
+					enrollment.ModuleName, enrollment.OrgID, enrollment.Channel, enrollment.StartsAt, enrollment.ExpiresAt); err != nil {
+					return fmt.Errorf("db: tx.ExecContext failed: %w", err)
+				}
+				if err := insertAudit(ctx, tx, AuditActionCreate, enrollment.ModuleName, enrollment.OrgID, "", enrollment.Channel, change); err != nil {
+					return err
+				}
+				continue
+			case err != nil:
+				return fmt.Errorf("db: tx.QueryRowxContext failed: %w", err)
+			}
+
+			if _, err := tx.ExecContext(ctx, `UPDATE orgs_modules SET channel = $3, starts_at = $4, expires_at = $5, seeded = TRUE WHERE module_name = $1 AND org_id = $2;`,
+				enrollment.ModuleName, enrollment.OrgID, enrollment.Channel, enrollment.StartsAt, enrollment.ExpiresAt); err != nil {
+				return fmt.Errorf("db: tx.ExecContext failed: %w", err)
+			}
+			if !existing.Equal(enrollment) {
+				if err := insertAudit(ctx, tx, AuditActionUpdate, enrollment.ModuleName, enrollment.OrgID, existing.Channel, enrollment.Channel, change); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	var previous []Enrollment
+	if err := tx.SelectContext(ctx, &previous, `SELECT module_name, org_id, channel, starts_at, expires_at FROM orgs_modules WHERE seeded;`); err != nil {
+		return fmt.Errorf("db: tx.SelectContext failed: %w", err)
+	}
+	for _, e := range previous {
+		if seeded[[2]string{e.ModuleName, e.OrgID}] {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM orgs_modules WHERE module_name = $1 AND org_id = $2;`, e.ModuleName, e.OrgID); err != nil {
+			return fmt.Errorf("db: tx.ExecContext failed: %w", err)
+		}
+		if err := insertAudit(ctx, tx, AuditActionDelete, e.ModuleName, e.OrgID, e.Channel, "", Change{Actor: seedActor, Reason: "removed from seed"}); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("db: tx.Commit failed: %w", err)
+	}
+	db.routesChanged()
+	return nil
+}
+
+func (db *DB) seedData(ctx context.Context, data []byte) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+
+	_, err := db.handle.ExecContext(ctx, string(data))
+	if err != nil {
+		return fmt.Errorf("db: db.handle.ExecContext failed: %w", err)
+	}
+	if err := db.normalizeSQLiteTimes(ctx); err != nil {
+		return err
+	}
+	db.routesChanged()
 	return nil
 }
 
 // preparedStatement creates a prepared statement for the given query, caches
 // it in a map and returns the prepared statement. If a statement already exists
 // for query, the cached statement is returned.
-func (db *DB) preparedStatement(query string) (*sqlx.Stmt, error) {
+func (db *DB) preparedStatement(ctx context.Context, query string) (*sqlx.Stmt, error) {
+	db.statementsMu.Lock()
+	defer db.statementsMu.Unlock()
+
 	stmt := db.statements[query]
 	if stmt != nil {
 		return stmt, nil
 	}
-	stmt, err := db.handle.Preparex(query)
+	stmt, err := db.handle.PreparexContext(ctx, query)
 	if err != nil {
-		return nil, fmt.Errorf("db: db.handle.Preparex failed: %w", err)
+		return nil, fmt.Errorf("db: db.handle.PreparexContext failed: %w", err)
 	}
 	db.statements[query] = stmt
 	return stmt, nil
 }
 
-func newMigrate(db *sql.DB, driverName string) (*migrate.Migrate, error) {
-	driver, err := sqlite.WithInstance(db, &sqlite.Config{})
-	if err != nil {
-		return nil, fmt.Errorf("db: sqlite.WithInstance failed: %w", err)
+// withTimeout returns a copy of ctx that is cancelled once db's query timeout
+// elapses, along with the function that releases it.
+func (db *DB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.queryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, db.queryTimeout)
+}
+
+// tracedCall is an otelsql.SpanFilter that only traces database calls made
+// within a span, such as those of a request, so that the routing refresher and
+// readiness checks do not start a trace of their own every few seconds.
+func tracedCall(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+	return trace.SpanContextFromContext(ctx).IsValid()
+}
+
+// limitOffset returns a LIMIT and OFFSET clause in the dialect of db, appending
+// its parameters to args. If limit is negative, the clause places no limit on
+// the number of records.
+func (db *DB) limitOffset(args []interface{}, limit, offset int) (string, []interface{}) {
+	switch {
+	case limit >= 0:
+		args = append(args, limit, offset)
+		return fmt.Sprintf(` LIMIT $%v OFFSET $%v`, len(args)-1, len(args)), args
+	case offset <= 0:
+		return "", args
+	case db.driverName == "sqlite":
+		// SQLite does not accept an OFFSET without a LIMIT.
+		args = append(args, offset)
+		return fmt.Sprintf(` LIMIT -1 OFFSET $%v`, len(args)), args
+	default:
+		args = append(args, offset)
+		return fmt.Sprintf(` OFFSET $%v`, len(args)), args
+	}
+}
+
+// newMigrate creates a Migrate instance for db. The pgx migration driver holds
+// on to a connection until it is closed, so for "pgx" the instance gets its own
+// connection pool. The in-memory SQLite database only exists within db.handle,
+// so for "sqlite" the instance shares it. Either way, the instance must be
+// released with closeMigrate.
+func (db *DB) newMigrate() (*migrate.Migrate, error) {
+	var (
+		driver database.Driver
+		err    error
+	)
+	switch db.driverName {
+	case "pgx":
+		handle, err := sql.Open(db.driverName, db.dataSourceName)
+		if err != nil {
+			return nil, fmt.Errorf("db: sql.Open failed: %w", err)
+		}
+		driver, err = pgxmigrate.WithInstance(handle, &pgxmigrate.Config{})
+		if err != nil {
+			_ = handle.Close()
+			return nil, fmt.Errorf("db: pgx.WithInstance failed: %w", err)
+		}
+	default:
+		driver, err = sqlite.WithInstance(db.handle.DB, &sqlite.Config{})
+		if err != nil {
+			return nil, fmt.Errorf("db: sqlite.WithInstance failed: %w", err)
+		}
 	}
 
 	source, err := iofs.New(migrations, "migrations")
@@ -274,10 +1409,22 @@ func newMigrate(db *sql.DB, driverName string) (*migrate.Migrate, error) {
 		return nil, err
 	}
 
-	m, err := migrate.NewWithInstance("iofs", source, driverName, driver)
+	m, err := migrate.NewWithInstance("iofs", source, db.driverName, driver)
 	if err != nil {
 		return nil, fmt.Errorf("db: migrate.NewithInstance failed: %w", err)
 	}
 
 	return m, nil
 }
+
+// closeMigrate releases the connections held by m, a Migrate instance created
+// by newMigrate. Closing a SQLite instance would close db.handle, so it is left
+// open.
+func (db *DB) closeMigrate(m *migrate.Migrate) {
+	if db.driverName == "sqlite" {
+		return
+	}
+	if srcErr, dbErr := m.Close(); srcErr != nil || dbErr != nil {
+		log.WithFields(log.Fields{"source_error": srcErr, "database_error": dbErr}).Error("closing migrate")
+	}
+}
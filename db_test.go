@@ -1,13 +1,17 @@
 package main
 
 import (
-	"database/sql"
-	"fmt"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/uuid"
 )
 
 func closeDB(d *DB, t *testing.T) {
@@ -16,104 +20,531 @@ func closeDB(d *DB, t *testing.T) {
     }
 }
 
-func TestDBCount(t *testing.T) {
-	tests := []struct {
-		desc  string
-		input struct{ query, moduleName, orgID string }
-		want  int
+// forEachBackend runs f as a subtest against an empty database on each
+// supported backend. The pgx subtest connects to the database named by the
+// TEST_DATABASE_URL environment variable and is skipped if it is unset.
+func forEachBackend(t *testing.T, f func(t *testing.T, db *DB)) {
+	backends := []struct {
+		driverName     string
+		dataSourceName string
 	}{
-		{
-			desc:  "",
-			input: struct{ query, moduleName, orgID string }{`INSERT INTO orgs_modules (org_id, module_name) VALUES ('modfoo', '2'), ('%s', '%s');`, "modfoo", "1"},
-			want:  1,
-		},
+		{"sqlite", "file::memory:?cache=shared"},
+		{"pgx", os.Getenv("TEST_DATABASE_URL")},
 	}
 
-	for _, test := range tests {
-		t.Run(test.desc, func(t *testing.T) {
-			db, err := Open("sqlite", "file::memory:?cache=shared")
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer closeDB(db, t)
-			if err := db.Migrate(false); err != nil {
-				t.Fatal(err)
-			}
-			if err := db.seedData([]byte(fmt.Sprintf(test.input.query, test.input.orgID, test.input.moduleName))); err != nil {
-				t.Fatal(err)
+	for _, backend := range backends {
+		t.Run(backend.driverName, func(t *testing.T) {
+			if backend.dataSourceName == "" {
+				t.Skip("TEST_DATABASE_URL not set")
 			}
 
-			got, err := db.Count(test.input.moduleName, test.input.orgID)
+			db, err := Open(backend.driverName, backend.dataSourceName)
 			if err != nil {
 				t.Fatal(err)
 			}
-			if got != test.want {
-				t.Errorf("%+v != %+v", got, test.want)
+			defer closeDB(db, t)
+
+			// The in-memory SQLite database starts out empty, but a
+			// PostgreSQL database may contain tables from a previous test.
+			if backend.driverName == "pgx" {
+				m, err := db.newMigrate()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := m.Drop(); err != nil {
+					t.Fatal(err)
+				}
+				db.closeMigrate(m)
 			}
+
+			f(t, db)
 		})
 	}
 }
 
-func TestDBInsertEvents(t *testing.T) {
-	type record struct {
-		phase       string
-		startedAt   time.Time
-		exit        int
-		exception   sql.NullString
-		endedAt     time.Time
-		machineID   string
-		coreVersion string
-		corePath    string
+func TestDBContext(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		desc         string
+		ctx          context.Context
+		queryTimeout time.Duration
+		want         error
+	}{
+		{
+			desc: "no timeout",
+			ctx:  context.Background(),
+		},
+		{
+			desc: "cancelled context",
+			ctx:  cancelled,
+			want: context.Canceled,
+		},
+		{
+			desc:         "query timeout elapsed",
+			ctx:          context.Background(),
+			queryTimeout: time.Nanosecond,
+			want:         context.DeadlineExceeded,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, db *DB) {
+				if err := db.Migrate(context.Background(), false); err != nil {
+					t.Fatal(err)
+				}
+				db.queryTimeout = test.queryTimeout
+
+				_, err := db.GetEvents(test.ctx, EventFilter{}, -1, 0)
+				if !errors.Is(err, test.want) {
+					t.Errorf("%v != %v", err, test.want)
+				}
+				_, err = db.ListEnrollments(test.ctx, EnrollmentFilter{}, -1, 0)
+				if !errors.Is(err, test.want) {
+					t.Errorf("%v != %v", err, test.want)
+				}
+				err = db.InsertOrgsModules(test.ctx, Enrollment{ModuleName: "insights-core", OrgID: "1", Channel: "beta"}, Change{Actor: systemActor})
+				if !errors.Is(err, test.want) {
+					t.Errorf("%v != %v", err, test.want)
+				}
+			})
+		})
 	}
+}
 
+func TestDBLoadRoutes(t *testing.T) {
 	tests := []struct {
-		desc  string
-		input record
+		description string
+		input       struct {
+			seed              []string
+			moduleName, orgID string
+		}
+		want string
 	}{
 		{
-			desc: "basic event",
-			input: record{
-				phase:       "pre_update",
-				startedAt:   time.Now(),
-				exit:        1,
-				exception:   sql.NullString{String: "OSPermissionError", Valid: true},
-				endedAt:     time.Now().Add(164),
-				machineID:   "fd475f2c-544f-4dd7-b53f-209df3290504",
-				coreVersion: "3.0.156",
-				corePath:    "/etc/rpm/insights.egg",
+			description: "not enrolled, no default",
+			input: struct {
+				seed              []string
+				moduleName, orgID string
+			}{
+				seed:       []string{},
+				moduleName: "insights-core",
+				orgID:      "1",
+			},
+			want: "release",
+		},
+		{
+			description: "enrolled in testing",
+			input: struct {
+				seed              []string
+				moduleName, orgID string
+			}{
+				seed:       []string{`INSERT INTO orgs_modules (module_name, org_id) VALUES ('insights-core', '1');`},
+				moduleName: "insights-core",
+				orgID:      "1",
+			},
+			want: "testing",
+		},
+		{
+			description: "enrolled in named channel",
+			input: struct {
+				seed              []string
+				moduleName, orgID string
+			}{
+				seed: []string{
+					`INSERT INTO channels (module_name, channel_name, is_default) VALUES ('insights-core', 'stable', TRUE);`,
+					`INSERT INTO orgs_modules (module_name, org_id, channel) VALUES ('insights-core', '1', 'hotfix-1234');`,
+				},
+				moduleName: "insights-core",
+				orgID:      "1",
+			},
+			want: "hotfix-1234",
+		},
+		{
+			description: "not enrolled, module default",
+			input: struct {
+				seed              []string
+				moduleName, orgID string
+			}{
+				seed: []string{
+					`INSERT INTO channels (module_name, channel_name, is_default) VALUES ('insights-core', 'stable', TRUE);`,
+					`INSERT INTO orgs_modules (module_name, org_id, channel) VALUES ('insights-core', '1', 'canary');`,
+				},
+				moduleName: "insights-core",
+				orgID:      "2",
+			},
+			want: "stable",
+		},
+		{
+			description: "not enrolled, rollout 100 percent",
+			input: struct {
+				seed              []string
+				moduleName, orgID string
+			}{
+				seed: []string{
+					`INSERT INTO channels (module_name, channel_name, is_default) VALUES ('insights-core', 'stable', TRUE);`,
+					`INSERT INTO rollouts (module_name, channel, percentage) VALUES ('insights-core', 'canary', 100);`,
+				},
+				moduleName: "insights-core",
+				orgID:      "1",
+			},
+			want: "canary",
+		},
+		{
+			description: "not enrolled, rollout 0 percent",
+			input: struct {
+				seed              []string
+				moduleName, orgID string
+			}{
+				seed: []string{
+					`INSERT INTO channels (module_name, channel_name, is_default) VALUES ('insights-core', 'stable', TRUE);`,
+					`INSERT INTO rollouts (module_name, channel, percentage) VALUES ('insights-core', 'canary', 0);`,
+				},
+				moduleName: "insights-core",
+				orgID:      "1",
+			},
+			want: "stable",
+		},
+		{
+			description: "enrolled, rollout 100 percent",
+			input: struct {
+				seed              []string
+				moduleName, orgID string
+			}{
+				seed: []string{
+					`INSERT INTO orgs_modules (module_name, org_id, channel) VALUES ('insights-core', '1', 'beta');`,
+					`INSERT INTO rollouts (module_name, channel, percentage) VALUES ('insights-core', 'canary', 100);`,
+				},
+				moduleName: "insights-core",
+				orgID:      "1",
+			},
+			want: "beta",
+		},
+		{
+			description: "enrollment expired",
+			input: struct {
+				seed              []string
+				moduleName, orgID string
+			}{
+				seed:       []string{`INSERT INTO orgs_modules (module_name, org_id, channel, expires_at) VALUES ('insights-core', '1', 'beta', '2020-07-15T17:16:55Z');`},
+				moduleName: "insights-core",
+				orgID:      "1",
+			},
+			want: "release",
+		},
+		{
+			description: "enrollment not yet started",
+			input: struct {
+				seed              []string
+				moduleName, orgID string
+			}{
+				seed:       []string{`INSERT INTO orgs_modules (module_name, org_id, channel, starts_at) VALUES ('insights-core', '1', 'beta', '2999-07-15T17:16:55Z');`},
+				moduleName: "insights-core",
+				orgID:      "1",
 			},
+			want: "release",
 		},
 		{
-			desc: "null exception",
-			input: record{
-				phase:       "pre_update",
-				startedAt:   time.Now(),
-				exit:        0,
-				exception:   sql.NullString{String: "", Valid: false},
-				endedAt:     time.Now().Add(164),
-				machineID:   "fd475f2c-544f-4dd7-b53f-209df3290504",
-				coreVersion: "3.0.156",
-				corePath:    "/etc/rpm/insights.egg",
+			description: "enrollment within window",
+			input: struct {
+				seed              []string
+				moduleName, orgID string
+			}{
+				seed:       []string{`INSERT INTO orgs_modules (module_name, org_id, channel, starts_at, expires_at) VALUES ('insights-core', '1', 'beta', '2020-07-15T17:16:55Z', '2999-07-15T17:16:55Z');`},
+				moduleName: "insights-core",
+				orgID:      "1",
 			},
+			want: "beta",
+		},
+		{
+			description: "enrolled in other module",
+			input: struct {
+				seed              []string
+				moduleName, orgID string
+			}{
+				seed:       []string{`INSERT INTO orgs_modules (module_name, org_id, channel) VALUES ('other', '1', 'canary');`},
+				moduleName: "insights-core",
+				orgID:      "1",
+			},
+			want: "release",
 		},
 	}
 
 	for _, test := range tests {
-		t.Run(test.desc, func(t *testing.T) {
-			db, err := Open("sqlite", "file::memory:?cache=shared")
+		t.Run(test.description, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, db *DB) {
+				if err := db.Migrate(context.Background(), false); err != nil {
+					t.Fatal(err)
+				}
+				for _, q := range test.input.seed {
+					if err := db.seedData(context.Background(), []byte(q)); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				routes, err := db.Routes(context.Background())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := routes.Channel(test.input.moduleName, test.input.orgID, time.Now()); got != test.want {
+					t.Errorf("%+v != %+v", got, test.want)
+				}
+			})
+		})
+	}
+}
+
+func TestDBInsertChannel(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		if err := db.Migrate(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.InsertChannel(context.Background(), "insights-core", "stable", true); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.InsertChannel(context.Background(), "insights-core", "beta", false); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.InsertChannel(context.Background(), "insights-core", "canary", true); err == nil {
+			t.Error("inserted a second default channel")
+		}
+		if err := db.InsertOrgsModules(context.Background(), Enrollment{ModuleName: "insights-core", OrgID: "1", Channel: "beta"}, Change{Actor: "test"}); err != nil {
+			t.Fatal(err)
+		}
+
+		for orgID, want := range map[string]string{"1": "beta", "2": "stable"} {
+			got, err := db.Route(context.Background(), "insights-core", orgID, time.Now())
 			if err != nil {
 				t.Fatal(err)
 			}
-			defer closeDB(db, t)
-			if err := db.Migrate(false); err != nil {
+			if got != want {
+				t.Errorf("org %v: %+v != %+v", orgID, got, want)
+			}
+		}
+	})
+}
+
+func TestDBSetRollout(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		if err := db.Migrate(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+
+		routes, err := db.Routes(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := routes.rollouts["insights-core"]; ok {
+			t.Errorf("%+v != nil", got)
+		}
+
+		for _, want := range []Rollout{
+			{ModuleName: "insights-core", Channel: "testing", Percentage: 5, Salt: "2026-10"},
+			{ModuleName: "insights-core", Channel: "testing", Percentage: 25, Salt: "2026-10"},
+		} {
+			if err := db.SetRollout(context.Background(), want); err != nil {
+				t.Fatal(err)
+			}
+			routes, err := db.Routes(context.Background())
+			if err != nil {
 				t.Fatal(err)
 			}
+			if got := routes.rollouts["insights-core"]; !cmp.Equal(got, want) {
+				t.Errorf("%v", cmp.Diff(got, want))
+			}
+		}
+
+		if err := db.SetRollout(context.Background(), Rollout{ModuleName: "insights-core", Channel: "testing", Percentage: 101}); err == nil {
+			t.Error("set rollout above 100 percent")
+		}
+	})
+}
 
-			if err := db.InsertEvents(test.input.phase, test.input.startedAt, test.input.exit, test.input.exception, test.input.endedAt, test.input.machineID, test.input.coreVersion, test.input.corePath); err != nil {
-				t.Error(err)
+func TestDBDeleteExpiredEnrollments(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		if err := db.Migrate(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+
+		now := time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC)
+		past := now.Add(-time.Hour)
+		future := now.Add(time.Hour)
+		for _, e := range []Enrollment{
+			{ModuleName: "insights-core", OrgID: "1", Channel: "testing", ExpiresAt: &past},
+			{ModuleName: "insights-core", OrgID: "2", Channel: "testing", ExpiresAt: &future},
+			{ModuleName: "insights-core", OrgID: "3", Channel: "testing"},
+			{ModuleName: "insights-core", OrgID: "4", Channel: "testing", StartsAt: &past, ExpiresAt: &now},
+		} {
+			if err := db.InsertOrgsModules(context.Background(), e, Change{Actor: "test"}); err != nil {
+				t.Fatal(err)
 			}
-		})
-	}
+		}
+		// Seeded times are written in RFC3339 format, and must be compared with
+		// those written by the driver as times, not as text.
+		if err := db.seedData(context.Background(), []byte(`INSERT INTO orgs_modules (module_name, org_id, channel, expires_at) VALUES
+			('insights-core', '5', 'testing', '2026-10-17T11:30:00Z'),
+			('insights-core', '6', 'testing', '2026-10-17T12:30:00Z'),
+			('insights-core', '7', 'testing', '2026-10-17T12:00:00.000Z');`)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Expiry is compared in SQL, so the cutoff must match regardless of
+		// the time zone it is given in.
+		got, err := db.DeleteExpiredEnrollments(context.Background(), now.In(time.FixedZone("EDT", -4*60*60)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotOrgs []string
+		for _, e := range got {
+			gotOrgs = append(gotOrgs, e.OrgID)
+		}
+		if want := []string{"1", "4", "5", "7"}; !cmp.Equal(gotOrgs, want, cmpopts.SortSlices(func(a, b string) bool { return a < b })) {
+			t.Errorf("%v", cmp.Diff(gotOrgs, want))
+		}
+
+		remaining, err := db.ExpiringEnrollments(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var remainingOrgs []string
+		for _, e := range remaining {
+			remainingOrgs = append(remainingOrgs, e.OrgID)
+		}
+		if want := []string{"2", "6"}; !cmp.Equal(remainingOrgs, want, cmpopts.SortSlices(func(a, b string) bool { return a < b })) {
+			t.Errorf("%v", cmp.Diff(remainingOrgs, want))
+		}
+		for _, e := range remaining {
+			if e.OrgID == "2" && !e.ExpiresAt.Equal(future) {
+				t.Errorf("%v != %v", e.ExpiresAt, future)
+			}
+		}
+	})
+}
+
+func TestDBEnrollments(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		if err := db.Migrate(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, e := range []Enrollment{
+			{ModuleName: "insights-core", OrgID: "2", Channel: "testing"},
+			{ModuleName: "insights-core", OrgID: "1", Channel: "beta"},
+			{ModuleName: "other", OrgID: "1", Channel: "testing"},
+		} {
+			if err := db.InsertOrgsModules(context.Background(), e, Change{Actor: "test"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.InsertOrgsModules(context.Background(), Enrollment{ModuleName: "insights-core", OrgID: "1", Channel: "testing"}, Change{Actor: "test"}); !errors.Is(err, ErrEnrollmentExists) {
+			t.Errorf("%v != %v", err, ErrEnrollmentExists)
+		}
+
+		tests := []struct {
+			description string
+			input       struct {
+				filter        EnrollmentFilter
+				limit, offset int
+			}
+			want []string
+		}{
+			{
+				description: "all",
+				input: struct {
+					filter        EnrollmentFilter
+					limit, offset int
+				}{EnrollmentFilter{}, -1, 0},
+				want: []string{"insights-core/1", "insights-core/2", "other/1"},
+			},
+			{
+				description: "by module",
+				input: struct {
+					filter        EnrollmentFilter
+					limit, offset int
+				}{EnrollmentFilter{ModuleName: "insights-core"}, -1, 0},
+				want: []string{"insights-core/1", "insights-core/2"},
+			},
+			{
+				description: "by org and channel",
+				input: struct {
+					filter        EnrollmentFilter
+					limit, offset int
+				}{EnrollmentFilter{OrgID: "1", Channel: "testing"}, -1, 0},
+				want: []string{"other/1"},
+			},
+			{
+				description: "limit 1, offset 1",
+				input: struct {
+					filter        EnrollmentFilter
+					limit, offset int
+				}{EnrollmentFilter{}, 1, 1},
+				want: []string{"insights-core/2"},
+			},
+			{
+				description: "no limit, offset 2",
+				input: struct {
+					filter        EnrollmentFilter
+					limit, offset int
+				}{EnrollmentFilter{}, -1, 2},
+				want: []string{"other/1"},
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.description, func(t *testing.T) {
+				enrollments, err := db.ListEnrollments(context.Background(), test.input.filter, test.input.limit, test.input.offset)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := make([]string, 0, len(enrollments))
+				for _, e := range enrollments {
+					got = append(got, e.ModuleName+"/"+e.OrgID)
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("%v", cmp.Diff(got, test.want))
+				}
+			})
+		}
+
+		if err := db.DeleteOrgsModules(context.Background(), "insights-core", "1", Change{Actor: "test"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DeleteOrgsModules(context.Background(), "insights-core", "1", Change{Actor: "test"}); !errors.Is(err, ErrEnrollmentNotFound) {
+			t.Errorf("%v != %v", err, ErrEnrollmentNotFound)
+		}
+	})
+}
+
+func TestMigrateChannels(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		m, err := db.newMigrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.closeMigrate(m)
+		if err := m.Migrate(20220822164042); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.seedData(context.Background(), []byte(`INSERT INTO orgs_modules (module_name, org_id) VALUES ('insights-core', '1');`)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Migrate(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+
+		for orgID, want := range map[string]string{"1": "testing", "2": "release"} {
+			got, err := db.Route(context.Background(), "insights-core", orgID, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("org %v: %+v != %+v", orgID, got, want)
+			}
+		}
+	})
 }
 
 func TestDBGetEvents(t *testing.T) {
@@ -133,7 +564,7 @@ func TestDBGetEvents(t *testing.T) {
 				limit  int
 				offset int
 			}{
-				query:  `INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("af3b8e13-6b65-45d8-8310-a45e0821bd62", "pre_update", "2020-07-15T17:16:55+00:00", 1, "OSError", "2020-07-15T17:17:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", "/etc/insights-client/rpm.egg");`,
+				query:  `INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ('af3b8e13-6b65-45d8-8310-a45e0821bd62', 'pre_update', '2020-07-15T17:16:55+00:00', 1, 'OSError', '2020-07-15T17:17:37+00:00', 'a9ab0a44-1241-43ae-9c02-1850acf0c36c', '3.0.156', '/etc/insights-client/rpm.egg');`,
 				limit:  1,
 				offset: 0,
 			},
@@ -158,7 +589,7 @@ func TestDBGetEvents(t *testing.T) {
 				limit  int
 				offset int
 			}{
-				query:  `INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("af3b8e13-6b65-45d8-8310-a45e0821bd62", "pre_update", "2020-07-15T17:16:55+00:00", 1, NULL, "2020-07-15T17:17:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", "/etc/insights-client/rpm.egg");`,
+				query:  `INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ('af3b8e13-6b65-45d8-8310-a45e0821bd62', 'pre_update', '2020-07-15T17:16:55+00:00', 1, NULL, '2020-07-15T17:17:37+00:00', 'a9ab0a44-1241-43ae-9c02-1850acf0c36c', '3.0.156', '/etc/insights-client/rpm.egg');`,
 				limit:  0,
 				offset: 0,
 			},
@@ -171,7 +602,7 @@ func TestDBGetEvents(t *testing.T) {
 				limit  int
 				offset int
 			}{
-				query:  `INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("af3b8e13-6b65-45d8-8310-a45e0821bd62", "pre_update", "2020-07-15T17:16:55+00:00", 1, NULL, "2020-07-15T17:17:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", "/etc/insights-client/rpm.egg");`,
+				query:  `INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ('af3b8e13-6b65-45d8-8310-a45e0821bd62', 'pre_update', '2020-07-15T17:16:55+00:00', 1, NULL, '2020-07-15T17:17:37+00:00', 'a9ab0a44-1241-43ae-9c02-1850acf0c36c', '3.0.156', '/etc/insights-client/rpm.egg');`,
 				limit:  -1,
 				offset: 0,
 			},
@@ -195,7 +626,7 @@ func TestDBGetEvents(t *testing.T) {
 				limit  int
 				offset int
 			}{
-				query:  `INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("af3b8e13-6b65-45d8-8310-a45e0821bd62", "pre_update", "2020-07-15T17:16:55+00:00", 1, NULL, "2020-07-15T17:17:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", NULL);`,
+				query:  `INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ('af3b8e13-6b65-45d8-8310-a45e0821bd62', 'pre_update', '2020-07-15T17:16:55+00:00', 1, NULL, '2020-07-15T17:17:37+00:00', 'a9ab0a44-1241-43ae-9c02-1850acf0c36c', '3.0.156', NULL);`,
 				limit:  1,
 				offset: 0,
 			},
@@ -215,25 +646,22 @@ func TestDBGetEvents(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.desc, func(t *testing.T) {
-			db, err := Open("sqlite", "file::memory:?cache=shared")
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer closeDB(db, t)
-			if err := db.Migrate(false); err != nil {
-				t.Fatal(err)
-			}
-			if err := db.seedData([]byte(test.input.query)); err != nil {
-				t.Fatal(err)
-			}
+			forEachBackend(t, func(t *testing.T, db *DB) {
+				if err := db.Migrate(context.Background(), false); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.seedData(context.Background(), []byte(test.input.query)); err != nil {
+					t.Fatal(err)
+				}
 
-			got, err := db.GetEvents(test.input.limit, test.input.offset)
-			if err != nil {
-				t.Fatal(err)
-			}
-			if !cmp.Equal(got, test.want) {
-				t.Errorf("%v", cmp.Diff(got, test.want))
-			}
+				got, err := db.GetEvents(context.Background(), EventFilter{}, test.input.limit, test.input.offset)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(got, test.want) {
+					t.Errorf("%v", cmp.Diff(got, test.want))
+				}
+			})
 		})
 	}
 }
@@ -242,22 +670,21 @@ func TestDeleteEvents(t *testing.T) {
 	tests := []struct {
 		description string
 		input       struct {
-			seed []string
-			date time.Time
+			started []time.Time
+			date    time.Time
 		}
-		want      int64
-		wantError error
+		want int64
 	}{
 		{
 			description: "3 events, 3 older",
 			input: struct {
-				seed []string
-				date time.Time
+				started []time.Time
+				date    time.Time
 			}{
-				seed: []string{
-					`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("a775eb95-baa0-48ef-80a5-438adfefca85", "pre_update", "2020-07-15T17:16:55+00:00", 1, NULL, "2020-07-15T17:17:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", NULL);`,
-					`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("6d7d9b1b-60bf-4523-b5df-db6c9a2e3e4b", "pre_update", "2020-07-15T17:18:55+00:00", 1, NULL, "2020-07-15T17:19:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", NULL);`,
-					`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("7f4cfe4b-415a-478e-98d7-ec232a8cf181", "pre_update", "2020-07-15T17:20:55+00:00", 1, NULL, "2020-07-15T17:21:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", NULL);`,
+				started: []time.Time{
+					time.Date(2020, time.July, 15, 17, 16, 55, 0, time.UTC),
+					time.Date(2020, time.July, 15, 17, 18, 55, 0, time.UTC),
+					time.Date(2020, time.July, 15, 17, 20, 55, 0, time.UTC),
 				},
 				date: time.Date(2020, time.July, 15, 17, 21, 00, 00, time.UTC),
 			},
@@ -266,13 +693,13 @@ func TestDeleteEvents(t *testing.T) {
 		{
 			description: "3 events, 1 older",
 			input: struct {
-				seed []string
-				date time.Time
+				started []time.Time
+				date    time.Time
 			}{
-				seed: []string{
-					`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("a775eb95-baa0-48ef-80a5-438adfefca85", "pre_update", "2020-07-15T17:16:55+00:00", 1, NULL, "2020-07-15T17:17:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", NULL);`,
-					`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("6d7d9b1b-60bf-4523-b5df-db6c9a2e3e4b", "pre_update", "2020-07-15T17:18:55+00:00", 1, NULL, "2020-07-15T17:19:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", NULL);`,
-					`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("7f4cfe4b-415a-478e-98d7-ec232a8cf181", "pre_update", "2020-07-15T17:20:55+00:00", 1, NULL, "2020-07-15T17:21:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", NULL);`,
+				started: []time.Time{
+					time.Date(2020, time.July, 15, 17, 16, 55, 0, time.UTC),
+					time.Date(2020, time.July, 15, 17, 18, 55, 0, time.UTC),
+					time.Date(2020, time.July, 15, 17, 20, 55, 0, time.UTC),
 				},
 				date: time.Date(2020, time.July, 15, 17, 17, 00, 00, time.UTC),
 			},
@@ -281,50 +708,340 @@ func TestDeleteEvents(t *testing.T) {
 		{
 			description: "3 events, 0 older",
 			input: struct {
-				seed []string
-				date time.Time
+				started []time.Time
+				date    time.Time
 			}{
-				seed: []string{
-					`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("a775eb95-baa0-48ef-80a5-438adfefca85", "pre_update", "2020-07-15T17:16:55+00:00", 1, NULL, "2020-07-15T17:17:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", NULL);`,
-					`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("6d7d9b1b-60bf-4523-b5df-db6c9a2e3e4b", "pre_update", "2020-07-15T17:18:55+00:00", 1, NULL, "2020-07-15T17:19:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", NULL);`,
-					`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES ("7f4cfe4b-415a-478e-98d7-ec232a8cf181", "pre_update", "2020-07-15T17:20:55+00:00", 1, NULL, "2020-07-15T17:21:37+00:00", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", NULL);`,
+				started: []time.Time{
+					time.Date(2020, time.July, 15, 17, 16, 55, 0, time.UTC),
+					time.Date(2020, time.July, 15, 17, 18, 55, 0, time.UTC),
+					time.Date(2020, time.July, 15, 17, 20, 55, 0, time.UTC),
 				},
 				date: time.Date(2020, time.July, 15, 17, 15, 00, 00, time.UTC),
 			},
 			want: 0,
 		},
+		{
+			description: "event later on the day of the cutoff",
+			input: struct {
+				started []time.Time
+				date    time.Time
+			}{
+				started: []time.Time{
+					time.Date(2026, time.July, 18, 23, 0, 0, 0, time.UTC),
+					time.Date(2026, time.July, 19, 23, 0, 0, 0, time.UTC),
+				},
+				date: time.Date(2026, time.July, 19, 1, 0, 0, 0, time.UTC),
+			},
+			want: 1,
+		},
+		{
+			description: "cutoff in another time zone",
+			input: struct {
+				started []time.Time
+				date    time.Time
+			}{
+				started: []time.Time{
+					time.Date(2026, time.July, 19, 3, 0, 0, 0, time.UTC),
+					time.Date(2026, time.July, 19, 5, 0, 0, 0, time.UTC),
+				},
+				date: time.Date(2026, time.July, 19, 0, 0, 0, 0, time.FixedZone("EDT", -4*60*60)),
+			},
+			want: 1,
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.description, func(t *testing.T) {
-			db, err := Open("sqlite", "file::memory:?cache=shared")
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer closeDB(db, t)
-			if err := db.Migrate(false); err != nil {
-				t.Fatal(err)
-			}
-			for _, q := range test.input.seed {
-				if err := db.seedData([]byte(q)); err != nil {
+			forEachBackend(t, func(t *testing.T, db *DB) {
+				if err := db.Migrate(context.Background(), false); err != nil {
+					t.Fatal(err)
+				}
+				events := make([]event, 0, len(test.input.started))
+				for i, started := range test.input.started {
+					events = append(events, event{
+						eventID:     uuid.NewSHA1(uuid.Nil, []byte(strconv.Itoa(i))).String(),
+						phase:       "pre_update",
+						startedAt:   started,
+						exit:        1,
+						endedAt:     started.Add(time.Minute),
+						machineID:   "a9ab0a44-1241-43ae-9c02-1850acf0c36c",
+						coreVersion: "3.0.156",
+					})
+				}
+				if err := db.InsertEventBatch(context.Background(), events); err != nil {
 					t.Fatal(err)
 				}
-			}
-
-			got, err := db.DeleteEvents(test.input.date)
 
-			if test.wantError != nil {
-				if !cmp.Equal(err, test.wantError, cmpopts.EquateErrors()) {
-					t.Errorf("%#v != %#v", err, test.wantError)
+				count, err := db.CountEvents(context.Background(), test.input.date)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != test.want {
+					t.Errorf("counted %v, want %v", count, test.want)
 				}
-			} else {
+
+				got, err := db.DeleteEvents(context.Background(), test.input.date)
 				if err != nil {
 					t.Fatal(err)
 				}
-				if !cmp.Equal(got, test.want) {
-					t.Errorf("%#v != %#v", got, test.want)
+				if got != test.want {
+					t.Errorf("deleted %v, want %v", got, test.want)
 				}
+			})
+		})
+	}
+}
+
+func TestDeleteEventsSeeded(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		if err := db.Migrate(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+		started := time.Date(2026, time.July, 19, 5, 0, 0, 0, time.UTC)
+		if err := db.InsertEventBatch(context.Background(), []event{{
+			eventID:     uuid.NewSHA1(uuid.Nil, []byte("0")).String(),
+			phase:       "pre_update",
+			startedAt:   started,
+			exit:        1,
+			endedAt:     started.Add(time.Minute),
+			machineID:   "a9ab0a44-1241-43ae-9c02-1850acf0c36c",
+			coreVersion: "3.0.156",
+		}}); err != nil {
+			t.Fatal(err)
+		}
+		// Seeded times are written in RFC3339 format, and must be compared with
+		// the cutoff as times, not as text.
+		if err := db.seedData(context.Background(), []byte(`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path) VALUES
+			('af3b8e13-6b65-45d8-8310-a45e0821bd62', 'pre_update', '2026-07-19T01:00:00Z', 1, NULL, '2026-07-19T01:01:00Z', 'a9ab0a44-1241-43ae-9c02-1850acf0c36c', '3.0.156', NULL),
+			('b2c9d5a1-7e4f-4c1b-9a3d-5f6e7d8c9b0a', 'pre_update', '2026-07-19T04:00:00Z', 1, NULL, '2026-07-19T04:01:00Z', 'a9ab0a44-1241-43ae-9c02-1850acf0c36c', '3.0.156', NULL);`)); err != nil {
+			t.Fatal(err)
+		}
+
+		older := time.Date(2026, time.July, 19, 3, 0, 0, 0, time.UTC)
+		count, err := db.CountEvents(context.Background(), older)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("counted %v, want %v", count, 1)
+		}
+
+		got, err := db.DeleteEvents(context.Background(), older)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 1 {
+			t.Errorf("deleted %v, want %v", got, 1)
+		}
+	})
+}
+
+func TestWithSQLitePragmas(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        string
+	}{
+		{
+			description: "in-memory",
+			input:       "file::memory:?cache=shared",
+			want:        "file::memory:?cache=shared&_pragma=busy_timeout%285000%29&_pragma=foreign_keys%281%29&_pragma=journal_mode%28WAL%29&_time_format=sqlite",
+		},
+		{
+			description: "file",
+			input:       "file:/var/lib/module-update-router/db.sqlite",
+			want:        "file:/var/lib/module-update-router/db.sqlite?_pragma=busy_timeout%285000%29&_pragma=foreign_keys%281%29&_pragma=journal_mode%28WAL%29&_time_format=sqlite",
+		},
+		{
+			description: "pragma overridden",
+			input:       "file:db.sqlite?_pragma=journal_mode(DELETE)&_pragma=busy_timeout(100)",
+			want:        "file:db.sqlite?_pragma=journal_mode(DELETE)&_pragma=busy_timeout(100)&_pragma=foreign_keys%281%29&_time_format=sqlite",
+		},
+		{
+			description: "time format replaced",
+			input:       "file:db.sqlite?_time_format=datetime&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)",
+			want:        "file:db.sqlite?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_time_format=sqlite",
+		},
+		{
+			description: "time format set",
+			input:       "file:db.sqlite?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_time_format=sqlite",
+			want:        "file:db.sqlite?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_time_format=sqlite",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := withSQLitePragmas(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("%v != %v", got, test.want)
 			}
 		})
 	}
 }
+
+func TestOpenSQLiteFile(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "db.sqlite")
+
+	db, err := Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InsertOrgsModules(context.Background(), Enrollment{ModuleName: "insights-core", OrgID: "1", Channel: "beta"}, Change{Actor: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	closeDB(db, t)
+
+	db, err = Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB(db, t)
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	for pragma, want := range map[string]string{
+		"busy_timeout": "5000",
+		"foreign_keys": "1",
+		"journal_mode": "wal",
+	} {
+		var got string
+		if err := db.handle.QueryRow("PRAGMA " + pragma + ";").Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%v: %v != %v", pragma, got, want)
+		}
+	}
+
+	got, err := db.Route(context.Background(), "insights-core", "1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "beta" {
+		t.Errorf("%v != %v", got, "beta")
+	}
+}
+
+func TestDBApplySeed(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		if err := db.Migrate(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+
+		seed := seedFile{
+			Modules: []seedModule{
+				{
+					Name:     "insights-core",
+					Channels: []seedChannel{{Name: "stable", Default: true}, {Name: "testing"}, {Name: "beta"}},
+					Rollout:  &seedRollout{Channel: "beta", Percentage: 100},
+				},
+			},
+			Enrollments: []seedEnrollment{
+				{Module: "insights-core", Orgs: []string{"1", "2"}},
+			},
+		}
+		for i := 0; i < 2; i++ {
+			if err := db.applySeed(context.Background(), seed); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for orgID, want := range map[string]string{"1": "testing", "2": "testing", "3": "beta"} {
+			got, err := db.Route(context.Background(), "insights-core", orgID, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("org %v: %+v != %+v", orgID, got, want)
+			}
+		}
+
+		seed.Modules[0].Rollout = nil
+		seed.Enrollments[0].Channel = "beta"
+		seed.Enrollments[0].Reason = "beta program"
+		if err := db.applySeed(context.Background(), seed); err != nil {
+			t.Fatal(err)
+		}
+		for orgID, want := range map[string]string{"1": "beta", "2": "beta", "3": "stable"} {
+			got, err := db.Route(context.Background(), "insights-core", orgID, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("org %v: %+v != %+v", orgID, got, want)
+			}
+		}
+
+		entries, err := db.AuditLog(context.Background(), AuditFilter{OrgID: "1"}, -1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actions []string
+		for _, e := range entries {
+			if e.Actor != seedActor {
+				t.Errorf("%v != %v", e.Actor, seedActor)
+			}
+			actions = append(actions, e.Action)
+		}
+		if want := []string{AuditActionUpdate, AuditActionCreate}; !cmp.Equal(actions, want) {
+			t.Errorf("%v != %v", actions, want)
+		}
+	})
+}
+
+func TestDBRoutes(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		if err := db.Migrate(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+
+		before, err := db.Routes(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		change := Change{Actor: "test"}
+		if err := db.InsertChannel(context.Background(), "insights-core", "stable", true); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.InsertOrgsModules(context.Background(), Enrollment{ModuleName: "insights-core", OrgID: "1", Channel: "beta"}, change); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetRollout(context.Background(), Rollout{ModuleName: "insights-core", Channel: "canary", Percentage: 100}); err != nil {
+			t.Fatal(err)
+		}
+
+		after, err := db.Routes(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		for orgID, want := range map[string]string{"1": "release", "2": "release"} {
+			if got := before.Channel("insights-core", orgID, now); got != want {
+				t.Errorf("before, org %v: %v != %v", orgID, got, want)
+			}
+		}
+		for orgID, want := range map[string]string{"1": "beta", "2": "canary"} {
+			if got := after.Channel("insights-core", orgID, now); got != want {
+				t.Errorf("after, org %v: %v != %v", orgID, got, want)
+			}
+		}
+
+		if err := db.DeleteOrgsModules(context.Background(), "insights-core", "1", change); err != nil {
+			t.Fatal(err)
+		}
+		routes, err := db.Routes(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := routes.Channel("insights-core", "1", now); got != "canary" {
+			t.Errorf("deleted: %v != %v", got, "canary")
+		}
+	})
+}
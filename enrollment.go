@@ -0,0 +1,46 @@
+package main
+
+import "time"
+
+// Enrollment is a record in the orgs_modules table, routing an org to a channel
+// of a module. StartsAt and ExpiresAt optionally bound the time during which the
+// enrollment is in effect.
+type Enrollment struct {
+	ModuleName string     `db:"module_name" json:"module_name"`
+	OrgID      string     `db:"org_id" json:"org_id"`
+	Channel    string     `db:"channel" json:"channel"`
+	StartsAt   *time.Time `db:"starts_at" json:"starts_at,omitempty"`
+	ExpiresAt  *time.Time `db:"expires_at" json:"expires_at,omitempty"`
+}
+
+// Active reports whether e is in effect at t. An enrollment is active from
+// StartsAt (inclusive) until ExpiresAt (exclusive); a nil bound is open.
+func (e Enrollment) Active(t time.Time) bool {
+	if e.StartsAt != nil && t.Before(*e.StartsAt) {
+		return false
+	}
+	return !e.Expired(t)
+}
+
+// Expired reports whether e has expired at t.
+func (e Enrollment) Expired(t time.Time) bool {
+	return e.ExpiresAt != nil && !t.Before(*e.ExpiresAt)
+}
+
+// Equal reports whether e and o route the same org to the same channel of the
+// same module over the same period of time.
+func (e Enrollment) Equal(o Enrollment) bool {
+	return e.ModuleName == o.ModuleName &&
+		e.OrgID == o.OrgID &&
+		e.Channel == o.Channel &&
+		equalTimes(e.StartsAt, o.StartsAt) &&
+		equalTimes(e.ExpiresAt, o.ExpiresAt)
+}
+
+// equalTimes reports whether a and b are both nil or are the same instant.
+func equalTimes(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnrollmentActive(t *testing.T) {
+	now := time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC)
+	before := now.Add(-time.Hour)
+	after := now.Add(time.Hour)
+
+	tests := []struct {
+		description string
+		input       Enrollment
+		want        bool
+	}{
+		{
+			description: "unbounded",
+			input:       Enrollment{},
+			want:        true,
+		},
+		{
+			description: "started",
+			input:       Enrollment{StartsAt: &before},
+			want:        true,
+		},
+		{
+			description: "starts now",
+			input:       Enrollment{StartsAt: &now},
+			want:        true,
+		},
+		{
+			description: "not started",
+			input:       Enrollment{StartsAt: &after},
+			want:        false,
+		},
+		{
+			description: "expires later",
+			input:       Enrollment{ExpiresAt: &after},
+			want:        true,
+		},
+		{
+			description: "expires now",
+			input:       Enrollment{ExpiresAt: &now},
+			want:        false,
+		},
+		{
+			description: "within window",
+			input:       Enrollment{StartsAt: &before, ExpiresAt: &after},
+			want:        true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := test.input.Active(now); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+		})
+	}
+}
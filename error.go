@@ -8,36 +8,142 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// formatError converts a basic HTTP status code and message into a JSON API
-// error object, serializes it to JSON and writes it to w.
-func formatJSONError(w http.ResponseWriter, code int, msg string) {
-	r := map[string]interface{}{
-		"errors": []map[string]interface{}{
-			{
-				"status": http.StatusText(code),
-				"title":  msg,
-			},
-		},
+// errorCode identifies the kind of an API error, so that clients can handle it
+// without parsing messages.
+type errorCode string
+
+// The error codes returned by the API. They are published, along with their
+// titles, in the ErrorCode schema of openapi.json; keep both in sync.
+const (
+	codeInvalidParameter errorCode = "invalid_parameter"
+	codeMissingParameter errorCode = "missing_parameter"
+	codeInvalidBody      errorCode = "invalid_body"
+	codeInvalidField     errorCode = "invalid_field"
+	codeInvalidIdentity  errorCode = "invalid_identity"
+	codeUnauthorized     errorCode = "unauthorized"
+	codeNotFound         errorCode = "not_found"
+	codeMethodNotAllowed errorCode = "method_not_allowed"
+	codeConflict         errorCode = "conflict"
+	codeQueueFull        errorCode = "queue_full"
+	codeInternal         errorCode = "internal_error"
+)
+
+// errorTitles holds the human-readable summary of each error code.
+var errorTitles = map[errorCode]string{
+	codeInvalidParameter: "Invalid parameter",
+	codeMissingParameter: "Missing required parameter",
+	codeInvalidBody:      "Invalid request body",
+	codeInvalidField:     "Invalid field in request body",
+	codeInvalidIdentity:  "Invalid identity",
+	codeUnauthorized:     "Unauthorized",
+	codeNotFound:         "Not found",
+	codeMethodNotAllowed: "Method not allowed",
+	codeConflict:         "Conflict",
+	codeQueueFull:        "Event queue is full",
+	codeInternal:         "Internal server error",
+}
+
+// apiError is a JSON API error object. Code and Title describe the kind of
+// error; Detail describes this occurrence of it. RequestID is the ID of the
+// request that failed, also returned in the X-Request-Id header.
+type apiError struct {
+	Status    string       `json:"status"`
+	Code      errorCode    `json:"code"`
+	Title     string       `json:"title"`
+	Detail    string       `json:"detail,omitempty"`
+	Source    *errorSource `json:"source,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+
+	// cause is the error behind an internal error. It is logged, but never
+	// sent to the client.
+	cause error
+}
+
+// errorSource locates the cause of an apiError in the request body.
+type errorSource struct {
+	Pointer string `json:"pointer"`
+}
+
+// errorResponse is the JSON body of every error response.
+type errorResponse struct {
+	Errors []apiError `json:"errors"`
+}
+
+// newAPIError creates an apiError of the given kind, responded with the given
+// HTTP status code. The request ID is read from the X-Request-Id header set on
+// w by the requestID middleware, if any.
+func newAPIError(w http.ResponseWriter, status int, code errorCode, detail string) apiError {
+	return apiError{
+		Status:    http.StatusText(status),
+		Code:      code,
+		Title:     errorTitles[code],
+		Detail:    detail,
+		RequestID: w.Header().Get("X-Request-Id"),
 	}
+}
 
-	data, err := json.Marshal(&r)
+// writeError writes an error response with a single error of the given kind,
+// with the given HTTP status code. Server errors are also logged.
+func writeError(w http.ResponseWriter, status int, code errorCode, detail string) {
+	writeErrors(w, status, []apiError{newAPIError(w, status, code, detail)})
+}
+
+// writeInternalError writes a 500 Internal Server Error response for err. The
+// response only carries a generic detail, so that database and driver errors
+// are not exposed to clients; err itself is logged.
+func writeInternalError(w http.ResponseWriter, err error) {
+	obj := newAPIError(w, http.StatusInternalServerError, codeInternal, "internal error")
+	obj.cause = err
+	writeErrors(w, http.StatusInternalServerError, []apiError{obj})
+}
+
+// fieldError describes a validation failure of a single field in a request
+// body.
+type fieldError struct {
+	field string
+	msg   string
+}
+
+// writeFieldErrors writes a 400 Bad Request response with an invalid_field
+// error for each of errs, pointing at the offending field.
+func writeFieldErrors(w http.ResponseWriter, errs []fieldError) {
+	objs := make([]apiError, 0, len(errs))
+	for _, e := range errs {
+		obj := newAPIError(w, http.StatusBadRequest, codeInvalidField, e.msg)
+		obj.Source = &errorSource{Pointer: "/" + e.field}
+		objs = append(objs, obj)
+	}
+	writeErrors(w, http.StatusBadRequest, objs)
+}
+
+// writeErrors serializes errs as an errorResponse and writes it to w with the
+// given HTTP status code.
+func writeErrors(w http.ResponseWriter, status int, errs []apiError) {
+	if status >= 500 {
+		for _, e := range errs {
+			entry := log.WithFields(log.Fields{
+				"code":       e.Code,
+				"request_id": e.RequestID,
+			})
+			if e.cause != nil {
+				entry = entry.WithError(e.cause)
+			}
+			entry.Error(e.Detail)
+		}
+	}
+
+	data, err := json.Marshal(errorResponse{Errors: errs})
 	if err != nil {
 		log.Error(err)
-		writeError(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		status = http.StatusInternalServerError
+		data = []byte(fmt.Sprintf(`{"errors":[{"status":%q,"code":%q,"title":%q}]}`,
+			http.StatusText(status), codeInternal, errorTitles[codeInternal]))
 	}
 
-	log.Error(r)
-	writeError(w, string(data), code)
-}
-
-// writeError replies to the request with the specified error message and HTTP
-// code.
-func writeError(w http.ResponseWriter, error string, code int) {
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(code)
-	if _, err := fmt.Fprint(w, error); err != nil {
-		log.Error(err)
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		log.Errorf("cannot write HTTP response: %v", err)
 	}
 }
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		description string
+		requestID   string
+		status      int
+		code        errorCode
+		detail      string
+		want        string
+	}{
+		{
+			description: "with request ID",
+			requestID:   testRequestID,
+			status:      http.StatusNotFound,
+			code:        codeNotFound,
+			detail:      "no such enrollment",
+			want:        `{"errors":[{"status":"Not Found","code":"not_found","title":"Not found","detail":"no such enrollment","request_id":"test-request-id"}]}`,
+		},
+		{
+			description: "without request ID or detail",
+			status:      http.StatusServiceUnavailable,
+			code:        codeQueueFull,
+			want:        `{"errors":[{"status":"Service Unavailable","code":"queue_full","title":"Event queue is full"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			if test.requestID != "" {
+				rr.Header().Set("X-Request-Id", test.requestID)
+			}
+			writeError(rr, test.status, test.code, test.detail)
+
+			if rr.Code != test.status {
+				t.Errorf("%v != %v", rr.Code, test.status)
+			}
+			if got := rr.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("%v != %v", got, "application/json")
+			}
+			if got := rr.Body.String(); got != test.want {
+				t.Errorf("\ngot:  %v\nwant: %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestErrorCatalogue(t *testing.T) {
+	var spec struct {
+		Components struct {
+			Schemas struct {
+				ErrorCode struct {
+					Enum []errorCode `json:"enum"`
+				}
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	published := spec.Components.Schemas.ErrorCode.Enum
+	for _, code := range published {
+		if errorTitles[code] == "" {
+			t.Errorf("published error code %v has no title", code)
+		}
+	}
+	if len(published) != len(errorTitles) {
+		t.Errorf("%v error codes published, want %v", len(published), len(errorTitles))
+	}
+}
+
+func TestWriteInternalError(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	rr := httptest.NewRecorder()
+	rr.Header().Set("X-Request-Id", testRequestID)
+	writeInternalError(rr, errors.New(`db: stmt.QueryRowContext failed: pq: relation "orgs_modules" does not exist`))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("%v != %v", rr.Code, http.StatusInternalServerError)
+	}
+	want := `{"errors":[{"status":"Internal Server Error","code":"internal_error","title":"Internal server error","detail":"internal error","request_id":"test-request-id"}]}`
+	if got := rr.Body.String(); got != want {
+		t.Errorf("\ngot:  %v\nwant: %v", got, want)
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("error not logged")
+	}
+	if err, _ := entry.Data[log.ErrorKey].(error); err == nil || !strings.Contains(err.Error(), "orgs_modules") {
+		t.Errorf("logged %v, want the cause", entry.Data)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// eventRequest is the JSON body of a POST /event request. Required fields are
+// pointers or strings so that missing values can be told apart from zero
+// values during validation.
+type eventRequest struct {
+	Phase       string  `json:"phase"`
+	StartedAt   string  `json:"started_at"`
+	Exit        *int    `json:"exit"`
+	Exception   *string `json:"exception"`
+	EndedAt     string  `json:"ended_at"`
+	MachineID   string  `json:"machine_id"`
+	CoreVersion string  `json:"core_version"`
+	CorePath    *string `json:"core_path"`
+}
+
+// Maximum lengths, in characters, of the string fields of an event, as
+// declared by the columns of the events table.
+const (
+	maxPhaseLength       = 256
+	maxExceptionLength   = 1024
+	maxMachineIDLength   = 36
+	maxCoreVersionLength = 256
+	maxCorePathLength    = 256
+)
+
+// eventResponse is the JSON body of a successful POST /event response.
+type eventResponse struct {
+	EventID string `json:"event_id"`
+}
+
+// eventListResponse is the JSON body of a GET /event response in envelope
+// form. Links are null if there is no such page.
+type eventListResponse struct {
+	Data []map[string]interface{} `json:"data"`
+	Meta struct {
+		Count int64 `json:"count"`
+	} `json:"meta"`
+	Links struct {
+		Next *string `json:"next"`
+		Prev *string `json:"prev"`
+	} `json:"links"`
+}
+
+// event is a validated eventRequest, ready to be written to the events table.
+type event struct {
+	eventID     string
+	phase       string
+	startedAt   time.Time
+	exit        int
+	exception   sql.NullString
+	endedAt     time.Time
+	machineID   string
+	coreVersion string
+	corePath    sql.NullString
+
+	// orgID and requestID are not stored in the events table; they are only
+	// included in the message published for the event.
+	orgID     string
+	requestID string
+
+	// spanContext identifies the span of the request that created the
+	// event. Its trace context is propagated in the headers of the
+	// published message, and the span is linked from those that write and
+	// publish the event.
+	spanContext trace.SpanContext
+}
+
+// eventMessage is the JSON representation of an event published to the
+// metrics topic.
+type eventMessage struct {
+	EventID     string    `json:"event_id"`
+	Phase       string    `json:"phase"`
+	StartedAt   time.Time `json:"started_at"`
+	Exit        int       `json:"exit"`
+	Exception   *string   `json:"exception,omitempty"`
+	EndedAt     time.Time `json:"ended_at"`
+	MachineID   string    `json:"machine_id"`
+	CoreVersion string    `json:"core_version"`
+	CorePath    *string   `json:"core_path,omitempty"`
+	OrgID       string    `json:"org_id"`
+	RequestID   string    `json:"request_id"`
+}
+
+// message converts e into a Message keyed on its machine ID, so that all
+// events from the same host land on the same partition. Its headers carry the
+// trace context of the request that created e.
+func (e event) message() (Message, error) {
+	m := eventMessage{
+		EventID:     e.eventID,
+		Phase:       e.phase,
+		StartedAt:   e.startedAt,
+		Exit:        e.exit,
+		EndedAt:     e.endedAt,
+		MachineID:   e.machineID,
+		CoreVersion: e.coreVersion,
+		OrgID:       e.orgID,
+		RequestID:   e.requestID,
+	}
+	if e.exception.Valid {
+		m.Exception = &e.exception.String
+	}
+	if e.corePath.Valid {
+		m.CorePath = &e.corePath.String
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return Message{}, fmt.Errorf("event: json.Marshal failed: %w", err)
+	}
+	headers := propagation.MapCarrier{}
+	propagator.Inject(trace.ContextWithSpanContext(context.Background(), e.spanContext), headers)
+	return Message{Key: []byte(e.machineID), Value: data, Headers: headers}, nil
+}
+
+// EventFilter restricts the records returned by GetEvents. Zero-value fields do
+// not filter. Time ranges include their start and exclude their end.
+type EventFilter struct {
+	MachineID   string
+	Phase       string
+	CoreVersion string
+
+	// Exit matches events with the given exit code. If ExitNonZero is set,
+	// only events with a non-zero exit code match.
+	Exit        *int
+	ExitNonZero bool
+
+	// HasException matches events with an exception if true, and events
+	// without one if false.
+	HasException *bool
+
+	StartedAfter  time.Time
+	StartedBefore time.Time
+	EndedAfter    time.Time
+	EndedBefore   time.Time
+}
+
+// parseEventFilter reads an EventFilter from the query parameters of a GET
+// /event request. The exit parameter is either an exit code or "nonzero".
+func parseEventFilter(params url.Values) (EventFilter, error) {
+	f := EventFilter{
+		MachineID:   params.Get("machine_id"),
+		Phase:       params.Get("phase"),
+		CoreVersion: params.Get("core_version"),
+	}
+
+	switch p := params.Get("exit"); p {
+	case "":
+	case "nonzero":
+		f.ExitNonZero = true
+	default:
+		exit, err := strconv.Atoi(p)
+		if err != nil {
+			return EventFilter{}, fmt.Errorf("invalid parameter 'exit': must be an integer or 'nonzero'")
+		}
+		f.Exit = &exit
+	}
+
+	if p := params.Get("has_exception"); p != "" {
+		hasException, err := strconv.ParseBool(p)
+		if err != nil {
+			return EventFilter{}, fmt.Errorf("invalid parameter 'has_exception': must be 'true' or 'false'")
+		}
+		f.HasException = &hasException
+	}
+
+	for _, t := range []struct {
+		param string
+		value *time.Time
+	}{
+		{"started_after", &f.StartedAfter},
+		{"started_before", &f.StartedBefore},
+		{"ended_after", &f.EndedAfter},
+		{"ended_before", &f.EndedBefore},
+	} {
+		p := params.Get(t.param)
+		if p == "" {
+			continue
+		}
+		v, err := time.Parse(time.RFC3339, p)
+		if err != nil {
+			return EventFilter{}, fmt.Errorf("invalid parameter '%v': must be RFC 3339 formatted", t.param)
+		}
+		*t.value = v.UTC()
+	}
+
+	return f, nil
+}
+
+// matches reports whether e passes f.
+func (f EventFilter) matches(e event) bool {
+	switch {
+	case f.MachineID != "" && e.machineID != f.MachineID,
+		f.Phase != "" && e.phase != f.Phase,
+		f.CoreVersion != "" && e.coreVersion != f.CoreVersion,
+		f.Exit != nil && e.exit != *f.Exit,
+		f.ExitNonZero && e.exit == 0,
+		f.HasException != nil && e.exception.Valid != *f.HasException,
+		!f.StartedAfter.IsZero() && e.startedAt.Before(f.StartedAfter),
+		!f.StartedBefore.IsZero() && !e.startedAt.Before(f.StartedBefore),
+		!f.EndedAfter.IsZero() && e.endedAt.Before(f.EndedAfter),
+		!f.EndedBefore.IsZero() && !e.endedAt.Before(f.EndedBefore):
+		return false
+	default:
+		return true
+	}
+}
+
+// record returns e as it is listed by GET /event. Optional fields are omitted
+// if they are not set.
+func (e event) record() map[string]interface{} {
+	r := map[string]interface{}{
+		"event_id":     e.eventID,
+		"phase":        e.phase,
+		"started_at":   e.startedAt,
+		"exit":         e.exit,
+		"ended_at":     e.endedAt,
+		"machine_id":   e.machineID,
+		"core_version": e.coreVersion,
+	}
+	if e.exception.Valid {
+		r["exception"] = e.exception.String
+	}
+	if e.corePath.Valid {
+		r["core_path"] = e.corePath.String
+	}
+	return r
+}
+
+// EventCursor marks the position of an event in the order of GetEventPage: by
+// start time, then by event ID. A page requested with a cursor holds the events
+// after that position, or before it if Before is set.
+type EventCursor struct {
+	StartedAt time.Time `json:"started_at"`
+	EventID   string    `json:"event_id"`
+	Before    bool      `json:"before,omitempty"`
+}
+
+// String encodes c as an opaque, URL-safe token.
+func (c EventCursor) String() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseEventCursor decodes a token created by EventCursor.String.
+func parseEventCursor(token string) (EventCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return EventCursor{}, fmt.Errorf("invalid parameter 'cursor': %w", err)
+	}
+	var c EventCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return EventCursor{}, fmt.Errorf("invalid parameter 'cursor': %w", err)
+	}
+	if c.StartedAt.IsZero() || c.EventID == "" {
+		return EventCursor{}, fmt.Errorf("invalid parameter 'cursor': incomplete cursor")
+	}
+	return c, nil
+}
+
+// follows reports whether e comes after the position of c.
+func (e event) follows(c EventCursor) bool {
+	if !e.startedAt.Equal(c.StartedAt) {
+		return e.startedAt.After(c.StartedAt)
+	}
+	return e.eventID > c.EventID
+}
+
+// cursor returns a cursor at the position of e.
+func (e event) cursor(before bool) *EventCursor {
+	return &EventCursor{StartedAt: e.startedAt.UTC(), EventID: e.eventID, Before: before}
+}
+
+// EventPage is a page of events returned by GetEventPage.
+type EventPage struct {
+	Events []map[string]interface{}
+
+	// Count is the number of events matching the filter, on all pages.
+	Count int64
+
+	// Next and Prev locate the adjacent pages. They are nil if there is no
+	// such page.
+	Next *EventCursor
+	Prev *EventCursor
+}
+
+// newEventPage builds a page of at most limit events from events, which holds
+// the events beyond cursor in the direction of paging, up to limit+1 of them.
+// If cursor.Before is set, events are in descending order. If limit is
+// negative, all events are kept.
+func newEventPage(events []event, count int64, cursor *EventCursor, limit int) EventPage {
+	before := cursor != nil && cursor.Before
+	more := limit >= 0 && len(events) > limit
+	if more {
+		events = events[:limit]
+	}
+	if before {
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+	}
+
+	page := EventPage{Events: make([]map[string]interface{}, 0, len(events)), Count: count}
+	for _, e := range events {
+		page.Events = append(page.Events, e.record())
+	}
+	if len(events) == 0 {
+		return page
+	}
+	if (before && more) || (!before && cursor != nil) {
+		page.Prev = events[0].cursor(true)
+	}
+	if (!before && more) || before {
+		page.Next = events[len(events)-1].cursor(false)
+	}
+	return page
+}
+
+// validate checks that all required fields of req are present and well
+// formed, and that no field is too long to be stored. It returns the parsed
+// event, or every problem found.
+func (req eventRequest) validate() (event, []fieldError) {
+	var (
+		e    event
+		errs []fieldError
+	)
+
+	required := func(field, value string) {
+		if value == "" {
+			errs = append(errs, fieldError{field, "missing required field: '" + field + "'"})
+		}
+	}
+	maxLength := func(field string, value *string, max int) {
+		if value != nil && utf8.RuneCountInString(*value) > max {
+			errs = append(errs, fieldError{field, fmt.Sprintf("invalid field '%s': must be at most %d characters long", field, max)})
+		}
+	}
+	timestamp := func(field, value string) time.Time {
+		if value == "" {
+			required(field, value)
+			return time.Time{}
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			errs = append(errs, fieldError{field, "invalid timestamp in field '" + field + "': must be RFC 3339 formatted"})
+		}
+		return t.UTC()
+	}
+
+	required("phase", req.Phase)
+	maxLength("phase", &req.Phase, maxPhaseLength)
+	e.phase = req.Phase
+	e.startedAt = timestamp("started_at", req.StartedAt)
+	if req.Exit == nil {
+		errs = append(errs, fieldError{"exit", "missing required field: 'exit'"})
+	} else {
+		e.exit = *req.Exit
+	}
+	maxLength("exception", req.Exception, maxExceptionLength)
+	e.exception = NewNullString(req.Exception)
+	e.endedAt = timestamp("ended_at", req.EndedAt)
+	required("machine_id", req.MachineID)
+	maxLength("machine_id", &req.MachineID, maxMachineIDLength)
+	e.machineID = req.MachineID
+	required("core_version", req.CoreVersion)
+	maxLength("core_version", &req.CoreVersion, maxCoreVersionLength)
+	e.coreVersion = req.CoreVersion
+	maxLength("core_path", req.CorePath, maxCorePathLength)
+	e.corePath = NewNullString(req.CorePath)
+
+	return e, errs
+}
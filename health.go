@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readyTimeout bounds the time taken by all the checks of a /ready request.
+const readyTimeout = 5 * time.Second
+
+// readinessCheck is a named check run by /ready. check returns an error if the
+// server should not be sent requests.
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// checkResult is the outcome of a readinessCheck.
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readyResponse is the JSON body of a /ready response. Status is "ok" if every
+// check passed, and "fail" otherwise.
+type readyResponse struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+// addReadinessCheck adds a check run by /ready. It must be called before s
+// serves requests.
+func (s *Server) addReadinessCheck(name string, check func(ctx context.Context) error) {
+	s.readiness = append(s.readiness, readinessCheck{name: name, check: check})
+}
+
+// handleReady creates an http.HandlerFunc that handles the readiness check
+// endpoint /ready. Every check is run and reported; the response is 503 Service
+// Unavailable if any of them failed.
+func (s *Server) handleReady() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		resp := readyResponse{Status: "ok", Checks: make([]checkResult, 0, len(s.readiness))}
+		for _, c := range s.readiness {
+			result := checkResult{Name: c.name, Status: "ok"}
+			if err := c.check(ctx); err != nil {
+				result.Status = "fail"
+				result.Error = err.Error()
+				resp.Status = "fail"
+			}
+			resp.Checks = append(resp.Checks, result)
+		}
+
+		code := http.StatusOK
+		if resp.Status != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, resp)
+	}
+}
+
+// checkShutdown fails once s is shutting down.
+func (s *Server) checkShutdown(ctx context.Context) error {
+	if s.draining.Load() {
+		return errors.New("server is shutting down")
+	}
+	return nil
+}
+
+// checkSeed fails until a seed file has been loaded successfully. Once one
+// has, failures to reload it do not fail the check, as the loaded seed remains
+// in effect.
+func (s *Server) checkSeed(ctx context.Context) error {
+	status := s.seed.Status()
+	if status.LoadedAt != nil {
+		return nil
+	}
+	if status.Error != "" {
+		return fmt.Errorf("seed file has not been loaded: %v", status.Error)
+	}
+	return errors.New("seed file has not been loaded")
+}
+
+// workerGroup runs named background workers and keeps track of which of them
+// are still running.
+type workerGroup struct {
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	stopped map[string]bool
+}
+
+// Go runs f in a new goroutine as the worker called name.
+func (g *workerGroup) Go(name string, f func()) {
+	g.mu.Lock()
+	if g.stopped == nil {
+		g.stopped = make(map[string]bool)
+	}
+	g.stopped[name] = false
+	g.mu.Unlock()
+
+	g.wg.Go(func() {
+		defer func() {
+			g.mu.Lock()
+			g.stopped[name] = true
+			g.mu.Unlock()
+		}()
+		f()
+	})
+}
+
+// Wait waits for all workers to return.
+func (g *workerGroup) Wait() {
+	g.wg.Wait()
+}
+
+// check fails if any worker has returned.
+func (g *workerGroup) check(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var stopped []string
+	for name, ok := range g.stopped {
+		if ok {
+			stopped = append(stopped, name)
+		}
+	}
+	if len(stopped) > 0 {
+		sort.Strings(stopped)
+		return fmt.Errorf("workers stopped: %v", strings.Join(stopped, ", "))
+	}
+	return nil
+}
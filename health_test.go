@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandleReady(t *testing.T) {
+	tests := []struct {
+		desc     string
+		setup    func(t *testing.T, srv *Server)
+		wantCode int
+		wantBody string
+	}{
+		{
+			desc:     "no checks configured",
+			setup:    func(t *testing.T, srv *Server) {},
+			wantCode: http.StatusOK,
+			wantBody: `{"status":"ok","checks":[{"name":"shutdown","status":"ok"}]}`,
+		},
+		{
+			desc: "all checks pass",
+			setup: func(t *testing.T, srv *Server) {
+				srv.addReadinessCheck("database", func(ctx context.Context) error { return nil })
+			},
+			wantCode: http.StatusOK,
+			wantBody: `{"status":"ok","checks":[{"name":"shutdown","status":"ok"},{"name":"database","status":"ok"}]}`,
+		},
+		{
+			desc: "failing check",
+			setup: func(t *testing.T, srv *Server) {
+				srv.addReadinessCheck("database", func(ctx context.Context) error { return errors.New("connection refused") })
+				srv.addReadinessCheck("schema", func(ctx context.Context) error { return nil })
+			},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: `{"status":"fail","checks":[{"name":"shutdown","status":"ok"},{"name":"database","status":"fail","error":"connection refused"},{"name":"schema","status":"ok"}]}`,
+		},
+		{
+			desc: "shutting down",
+			setup: func(t *testing.T, srv *Server) {
+				srv.draining.Store(true)
+			},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: `{"status":"fail","checks":[{"name":"shutdown","status":"fail","error":"server is shutting down"}]}`,
+		},
+		{
+			desc: "seed not loaded",
+			setup: func(t *testing.T, srv *Server) {
+				srv.seed = newSeedLoader(nil, filepath.Join(t.TempDir(), "seed.yaml"))
+				srv.addReadinessCheck("seed", srv.checkSeed)
+			},
+			wantCode: http.StatusServiceUnavailable,
+			wantBody: `{"status":"fail","checks":[{"name":"shutdown","status":"ok"},{"name":"seed","status":"fail","error":"seed file has not been loaded"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, NewMemoryStore(), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := srv.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}()
+			test.setup(t, srv)
+
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/ready", nil))
+			if rr.Code != test.wantCode {
+				t.Errorf("%v != %v", rr.Code, test.wantCode)
+			}
+			if rr.Body.String() != test.wantBody {
+				t.Errorf("\ngot:  %v\nwant: %v", rr.Body.String(), test.wantBody)
+			}
+		})
+	}
+}
+
+func TestCheckSeed(t *testing.T) {
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB(db, t)
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "seed.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := &Server{seed: newSeedLoader(db, path)}
+
+	if err := srv.seed.load(context.Background(), true); err == nil {
+		t.Fatal("loaded a missing seed file")
+	}
+	if err := srv.checkSeed(context.Background()); err == nil {
+		t.Error("check passed before a seed was loaded")
+	}
+
+	write(`modules: []`)
+	if err := srv.seed.load(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.checkSeed(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	// A broken reload leaves the previous seed in effect.
+	write(`modules: [`)
+	if err := srv.seed.load(context.Background(), false); err == nil {
+		t.Fatal("loaded a broken seed file")
+	}
+	if err := srv.checkSeed(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWorkerGroupCheck(t *testing.T) {
+	var g workerGroup
+	stop := make(chan struct{})
+	g.Go("running", func() { <-stop })
+	g.Go("exited", func() {})
+
+	// Wait for the exited worker to be recorded.
+	for {
+		if err := g.check(context.Background()); err != nil {
+			if want := "workers stopped: exited"; err.Error() != want {
+				t.Errorf("%v != %v", err, want)
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	g.Wait()
+	if err := g.check(context.Background()); err == nil || err.Error() != "workers stopped: exited, running" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
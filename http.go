@@ -2,10 +2,21 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
+// maxBodySize is the maximum number of bytes accepted in a request body.
+const maxBodySize = 1 << 20
+
 // responseRecorder records status code and body from an http.ResponseWriter.
 type responseRecorder struct {
 	http.ResponseWriter
@@ -41,3 +52,47 @@ func (r *responseRecorder) Write(buf []byte) (int, error) {
 func (r *responseRecorder) String() string {
 	return fmt.Sprintf("%v %v", r.Code, r.Body.String())
 }
+
+// retryAfter formats d as a Retry-After header value, rounding up to the next
+// whole second.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
+
+// parseLimitOffset parses the "limit" and "offset" query parameters. A missing
+// limit is returned as -1, meaning no limit; a missing offset is returned as 0.
+// A negative limit also means no limit, but a negative offset is an error.
+func parseLimitOffset(params url.Values) (limit, offset int, err error) {
+	limit, offset = -1, 0
+	if p := params.Get("limit"); p != "" {
+		limit, err = strconv.Atoi(p)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid parameter 'limit': %w", err)
+		}
+	}
+	if p := params.Get("offset"); p != "" {
+		offset, err = strconv.Atoi(p)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid parameter 'offset': %w", err)
+		}
+		if offset < 0 {
+			return 0, 0, errors.New("invalid parameter 'offset': must not be negative")
+		}
+	}
+	return limit, offset, nil
+}
+
+// writeJSON serializes v to JSON and writes it to w with the given HTTP status
+// code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(data); err != nil {
+		log.Errorf("cannot write HTTP response: %v", err)
+	}
+}
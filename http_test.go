@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseLimitOffset(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		wantLimit   int
+		wantOffset  int
+		wantErr     bool
+	}{
+		{
+			description: "defaults",
+			input:       "",
+			wantLimit:   -1,
+			wantOffset:  0,
+		},
+		{
+			description: "limit and offset",
+			input:       "limit=5&offset=10",
+			wantLimit:   5,
+			wantOffset:  10,
+		},
+		{
+			description: "negative limit",
+			input:       "limit=-1",
+			wantLimit:   -1,
+			wantOffset:  0,
+		},
+		{
+			description: "negative offset",
+			input:       "offset=-1",
+			wantErr:     true,
+		},
+		{
+			description: "invalid limit",
+			input:       "limit=x",
+			wantErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			params, err := url.ParseQuery(test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			limit, offset, err := parseLimitOffset(params)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parsed %q without error", test.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if limit != test.wantLimit || offset != test.wantOffset {
+				t.Errorf("%v, %v != %v, %v", limit, offset, test.wantLimit, test.wantOffset)
+			}
+		})
+	}
+}
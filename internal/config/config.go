@@ -3,6 +3,11 @@ package config
 import (
 	"flag"
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	clowder "github.com/redhatinsights/app-common-go/pkg/api/v1"
 	"github.com/sgreben/flagvar"
@@ -10,33 +15,101 @@ import (
 
 // Config stores values that are used to configure the application.
 type Config struct {
-	Addr         string
-	APIVersion   string
-	AppName      string
-	EventBuffer  int
-	LogFormat    flagvar.Enum
-	LogLevel     string
-	MAddr        string
-	MetricsTopic string
-	PathPrefix   string
-	Reset        bool
-	SeedPath     flagvar.File
+	Addr                    string
+	APIVersion              string
+	AppName                 string
+	DatabaseURL             string
+	DBDriver                flagvar.Enum
+	DBHost                  string
+	DBName                  string
+	DBPass                  string
+	DBPath                  string
+	DBPort                  int
+	DBQueryTimeout          time.Duration
+	DBSSLMode               string
+	DBUser                  string
+	EnrollmentSweepInterval time.Duration
+	EnrollmentWarnDays      int
+	EventBuffer             int
+	EventBatchSize          int
+	EventFlushInterval      time.Duration
+	EventPruneInterval      time.Duration
+	EventRetention          time.Duration
+	EventWorkers            int
+	HTTPIdleTimeout         time.Duration
+	HTTPReadHeaderTimeout   time.Duration
+	HTTPReadTimeout         time.Duration
+	HTTPWriteTimeout        time.Duration
+	KafkaBrokers            string
+	KafkaCAPath             string
+	KafkaSASLMechanism      string
+	KafkaSASLPassword       string
+	KafkaSASLUsername       string
+	KafkaSecurityProtocol   string
+	LogFormat               flagvar.Enum
+	LogLevel                string
+	MAddr                   string
+	MetricsTopic            string
+	PathPrefix              string
+	Reset                   bool
+	RoutingRefreshInterval  time.Duration
+	SeedPath                flagvar.File
+	SeedReloadInterval      time.Duration
+	ShutdownDelay           time.Duration
+	ShutdownTimeout         time.Duration
+	TraceEndpoint           string
+	TraceExporter           flagvar.Enum
+	TraceSampleRatio        float64
 }
 
 // DefaultConfig is the default configuration variable, providing access to
 // configuration values globally.
 var DefaultConfig Config = Config{
-	Addr:         ":8080",
-	APIVersion:   "v1",
-	AppName:      "module-update-router",
-	EventBuffer:  1000,
-	LogFormat:    flagvar.Enum{Choices: []string{"text", "json"}, Value: "text"},
-	LogLevel:     "info",
-	MAddr:        ":2112",
-	MetricsTopic: "client-metrics",
-	PathPrefix:   "/api",
-	Reset:        false,
-	SeedPath:     flagvar.File{},
+	Addr:                    ":8080",
+	APIVersion:              "v1",
+	AppName:                 "module-update-router",
+	DatabaseURL:             "",
+	DBDriver:                flagvar.Enum{Choices: []string{"pgx", "sqlite"}, Value: "sqlite"},
+	DBHost:                  "localhost",
+	DBName:                  "postgres",
+	DBPass:                  "",
+	DBPath:                  "",
+	DBPort:                  5432,
+	DBQueryTimeout:          10 * time.Second,
+	DBSSLMode:               "prefer",
+	DBUser:                  "postgres",
+	EnrollmentSweepInterval: time.Hour,
+	EnrollmentWarnDays:      7,
+	EventBuffer:             1000,
+	EventBatchSize:          100,
+	EventFlushInterval:      time.Second,
+	EventPruneInterval:      time.Hour,
+	EventRetention:          90 * 24 * time.Hour,
+	EventWorkers:            1,
+	HTTPIdleTimeout:         2 * time.Minute,
+	HTTPReadHeaderTimeout:   5 * time.Second,
+	HTTPReadTimeout:         30 * time.Second,
+	HTTPWriteTimeout:        time.Minute,
+	KafkaBrokers:            "",
+	KafkaCAPath:             "",
+	KafkaSASLMechanism:      "",
+	KafkaSASLPassword:       "",
+	KafkaSASLUsername:       "",
+	KafkaSecurityProtocol:   "",
+	LogFormat:               flagvar.Enum{Choices: []string{"text", "json"}, Value: "text"},
+	LogLevel:                "info",
+	MAddr:                   ":2112",
+	MetricsTopic:            "client-metrics",
+	PathPrefix:              "/api",
+	Reset:                   false,
+	RoutingRefreshInterval:  30 * time.Second,
+	SeedPath:                flagvar.File{},
+	SeedReloadInterval:      time.Minute,
+	ShutdownDelay:           5 * time.Second,
+	ShutdownTimeout:         25 * time.Second,
+	TraceEndpoint:           "",
+	TraceExporter:           flagvar.Enum{Choices: []string{"none", "otlp", "stdout"}, Value: "none"},
+	TraceSampleRatio:        1,
 }
 
 // init can be used to set default values for DefaultConfig that require more
@@ -45,7 +118,127 @@ func init() {
 	if clowder.IsClowderEnabled() {
 		DefaultConfig.Addr = fmt.Sprintf(":%v", *clowder.LoadedConfig.PublicPort)
 		DefaultConfig.MAddr = fmt.Sprintf(":%v", clowder.LoadedConfig.MetricsPort)
+
+		if db := clowder.LoadedConfig.Database; db != nil {
+			DefaultConfig.DBDriver.Value = "pgx"
+			DefaultConfig.DBHost = db.Hostname
+			DefaultConfig.DBName = db.Name
+			DefaultConfig.DBPass = db.Password
+			DefaultConfig.DBPort = db.Port
+			DefaultConfig.DBSSLMode = db.SslMode
+			DefaultConfig.DBUser = db.Username
+		}
+
+		if clowder.LoadedConfig.Kafka != nil && len(clowder.LoadedConfig.Kafka.Brokers) > 0 {
+			DefaultConfig.KafkaBrokers = strings.Join(clowder.KafkaServers, ",")
+
+			broker := clowder.LoadedConfig.Kafka.Brokers[0]
+			if broker.Cacert != nil {
+				if path, err := clowder.LoadedConfig.KafkaCa(broker); err == nil {
+					DefaultConfig.KafkaCAPath = path
+				}
+			}
+			if broker.SecurityProtocol != nil {
+				DefaultConfig.KafkaSecurityProtocol = *broker.SecurityProtocol
+			}
+			if broker.Sasl != nil {
+				if broker.Sasl.SaslMechanism != nil {
+					DefaultConfig.KafkaSASLMechanism = *broker.Sasl.SaslMechanism
+				}
+				if broker.Sasl.Username != nil {
+					DefaultConfig.KafkaSASLUsername = *broker.Sasl.Username
+				}
+				if broker.Sasl.Password != nil {
+					DefaultConfig.KafkaSASLPassword = *broker.Sasl.Password
+				}
+				if DefaultConfig.KafkaSecurityProtocol == "" && broker.Sasl.SecurityProtocol != nil {
+					DefaultConfig.KafkaSecurityProtocol = *broker.Sasl.SecurityProtocol
+				}
+			}
+		}
+	}
+}
+
+// KafkaTopic returns the name of the Kafka topic that was provisioned for the
+// requested topic name. When running under Clowder, the actual topic name may
+// differ from the one requested in the ClowdApp; otherwise requested is
+// returned unchanged.
+func KafkaTopic(requested string) string {
+	if topic, ok := clowder.KafkaTopics[requested]; ok {
+		return topic.Name
+	}
+	return requested
+}
+
+// DataSourceName returns the data source name used to open the database with
+// the configured driver. If DatabaseURL is set, it is returned unchanged.
+// Otherwise a PostgreSQL URL is built from the DB* fields for the "pgx" driver.
+// For "sqlite", the database file at DBPath is used, or an in-memory database
+// if DBPath is empty.
+func (c Config) DataSourceName() string {
+	if c.DatabaseURL != "" {
+		return c.DatabaseURL
+	}
+
+	switch c.DBDriver.Value {
+	case "pgx":
+		u := url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(c.DBUser, c.DBPass),
+			Host:   net.JoinHostPort(c.DBHost, strconv.Itoa(c.DBPort)),
+			Path:   c.DBName,
+		}
+		if c.DBSSLMode != "" {
+			u.RawQuery = url.Values{"sslmode": []string{c.DBSSLMode}}.Encode()
+		}
+		return u.String()
+	default:
+		if c.DBPath != "" {
+			return "file:" + c.DBPath
+		}
+		return "file::memory:?cache=shared"
+	}
+}
+
+// redacted replaces secret values in the output of Config.String.
+const redacted = "REDACTED"
+
+// String returns the fields of c, formatted as by the %+v verb, with the
+// passwords and any credentials in DatabaseURL redacted so that c can be
+// logged.
+func (c Config) String() string {
+	if c.DBPass != "" {
+		c.DBPass = redacted
+	}
+	if c.KafkaSASLPassword != "" {
+		c.KafkaSASLPassword = redacted
+	}
+	c.DatabaseURL = redactURL(c.DatabaseURL)
+
+	// config has the fields of Config, but not its String method.
+	type config Config
+	return fmt.Sprintf("%+v", config(c))
+}
+
+// redactURL returns s with the password in its user info and its password
+// query parameter redacted. Strings that are not URLs, such as PostgreSQL
+// keyword/value connection strings, are redacted as a whole.
+func redactURL(s string) string {
+	if s == "" {
+		return ""
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	if query := u.Query(); query.Has("password") {
+		query.Set("password", redacted)
+		u.RawQuery = query.Encode()
 	}
+	return u.String()
 }
 
 // FlagSet creates a new FlagSet, defined with flags for each struct field in
@@ -55,15 +248,49 @@ func FlagSet(name string, errorHandling flag.ErrorHandling) *flag.FlagSet {
 
 	fs.Var(&DefaultConfig.LogFormat, "log-format", fmt.Sprintf("set logging format (%v)", DefaultConfig.LogFormat.Help()))
 	fs.StringVar(&DefaultConfig.LogLevel, "log-level", DefaultConfig.LogLevel, "logging level")
-	fs.Var(&DefaultConfig.SeedPath, "seed-path", "path to the SQL seed file")
+	fs.Var(&DefaultConfig.SeedPath, "seed-path", "path to the YAML, JSON or SQL seed file")
+	fs.DurationVar(&DefaultConfig.SeedReloadInterval, "seed-reload-interval", DefaultConfig.SeedReloadInterval, "interval between checks of the seed file for changes; 0 reloads only on SIGHUP")
 	fs.BoolVar(&DefaultConfig.Reset, "reset", DefaultConfig.Reset, "drop all tables before running migrations")
 	fs.StringVar(&DefaultConfig.Addr, "addr", DefaultConfig.Addr, "app listen address")
 	fs.StringVar(&DefaultConfig.APIVersion, "api-version", DefaultConfig.APIVersion, "version to use in the URL path")
 	fs.StringVar(&DefaultConfig.AppName, "app-name", DefaultConfig.AppName, "name component for the API prefix")
+	fs.Var(&DefaultConfig.DBDriver, "db-driver", fmt.Sprintf("database driver (%v)", DefaultConfig.DBDriver.Help()))
+	fs.StringVar(&DefaultConfig.DatabaseURL, "database-url", DefaultConfig.DatabaseURL, "database connection string; overrides the other database flags if set")
+	fs.StringVar(&DefaultConfig.DBHost, "db-host", DefaultConfig.DBHost, "database server host")
+	fs.IntVar(&DefaultConfig.DBPort, "db-port", DefaultConfig.DBPort, "database server port")
+	fs.StringVar(&DefaultConfig.DBName, "db-name", DefaultConfig.DBName, "database name")
+	fs.StringVar(&DefaultConfig.DBUser, "db-user", DefaultConfig.DBUser, "database user")
+	fs.StringVar(&DefaultConfig.DBPass, "db-pass", DefaultConfig.DBPass, "database password")
+	fs.StringVar(&DefaultConfig.DBPath, "db-path", DefaultConfig.DBPath, "path to the SQLite database file; an in-memory database is used if empty")
+	fs.DurationVar(&DefaultConfig.DBQueryTimeout, "db-query-timeout", DefaultConfig.DBQueryTimeout, "maximum time a database operation may take; 0 disables the timeout")
+	fs.StringVar(&DefaultConfig.DBSSLMode, "db-ssl-mode", DefaultConfig.DBSSLMode, "PostgreSQL SSL mode")
+	fs.DurationVar(&DefaultConfig.EnrollmentSweepInterval, "enrollment-sweep-interval", DefaultConfig.EnrollmentSweepInterval, "interval between deletions of expired enrollments; 0 disables them")
+	fs.IntVar(&DefaultConfig.EnrollmentWarnDays, "enrollment-warn-days", DefaultConfig.EnrollmentWarnDays, "report enrollments expiring within this many days")
 	fs.IntVar(&DefaultConfig.EventBuffer, "event-buffer", DefaultConfig.EventBuffer, "the size of the event channel buffer")
+	fs.IntVar(&DefaultConfig.EventBatchSize, "event-batch-size", DefaultConfig.EventBatchSize, "maximum number of events written in a single transaction")
+	fs.DurationVar(&DefaultConfig.EventFlushInterval, "event-flush-interval", DefaultConfig.EventFlushInterval, "maximum time an event waits in a partial batch before being written")
+	fs.DurationVar(&DefaultConfig.EventRetention, "event-retention", DefaultConfig.EventRetention, "age after which events are deleted; 0 keeps events forever")
+	fs.DurationVar(&DefaultConfig.EventPruneInterval, "event-prune-interval", DefaultConfig.EventPruneInterval, "interval between deletions of events older than the retention period")
+	fs.IntVar(&DefaultConfig.EventWorkers, "event-workers", DefaultConfig.EventWorkers, "number of goroutines writing events to the database")
+	fs.DurationVar(&DefaultConfig.HTTPReadHeaderTimeout, "http-read-header-timeout", DefaultConfig.HTTPReadHeaderTimeout, "maximum time to read the headers of a request")
+	fs.DurationVar(&DefaultConfig.HTTPReadTimeout, "http-read-timeout", DefaultConfig.HTTPReadTimeout, "maximum time to read a request, including its body")
+	fs.DurationVar(&DefaultConfig.HTTPWriteTimeout, "http-write-timeout", DefaultConfig.HTTPWriteTimeout, "maximum time to handle a request and write its response")
+	fs.DurationVar(&DefaultConfig.HTTPIdleTimeout, "http-idle-timeout", DefaultConfig.HTTPIdleTimeout, "maximum time an idle keep-alive connection is kept open")
+	fs.DurationVar(&DefaultConfig.ShutdownDelay, "shutdown-delay", DefaultConfig.ShutdownDelay, "time between failing readiness checks and closing the listeners on shutdown")
+	fs.DurationVar(&DefaultConfig.ShutdownTimeout, "shutdown-timeout", DefaultConfig.ShutdownTimeout, "maximum time to drain requests, queued events and background workers on shutdown, including the shutdown delay")
 	fs.StringVar(&DefaultConfig.MAddr, "maddr", DefaultConfig.MAddr, "metrics listen address")
 	fs.StringVar(&DefaultConfig.MetricsTopic, "metrics-topic", DefaultConfig.MetricsTopic, "topic on which to place metrics data")
+	fs.StringVar(&DefaultConfig.KafkaBrokers, "kafka-brokers", DefaultConfig.KafkaBrokers, "comma-separated list of Kafka broker addresses; events are not published if empty")
+	fs.StringVar(&DefaultConfig.KafkaCAPath, "kafka-ca-path", DefaultConfig.KafkaCAPath, "path to a PEM encoded CA certificate for Kafka brokers")
+	fs.StringVar(&DefaultConfig.KafkaSASLMechanism, "kafka-sasl-mechanism", DefaultConfig.KafkaSASLMechanism, "Kafka SASL mechanism (PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512)")
+	fs.StringVar(&DefaultConfig.KafkaSASLUsername, "kafka-sasl-username", DefaultConfig.KafkaSASLUsername, "Kafka SASL username")
+	fs.StringVar(&DefaultConfig.KafkaSASLPassword, "kafka-sasl-password", DefaultConfig.KafkaSASLPassword, "Kafka SASL password")
+	fs.StringVar(&DefaultConfig.KafkaSecurityProtocol, "kafka-security-protocol", DefaultConfig.KafkaSecurityProtocol, "Kafka security protocol (PLAINTEXT, SSL, SASL_PLAINTEXT or SASL_SSL)")
+	fs.DurationVar(&DefaultConfig.RoutingRefreshInterval, "routing-refresh-interval", DefaultConfig.RoutingRefreshInterval, "interval between reloads of the routing table from the database")
 	fs.StringVar(&DefaultConfig.PathPrefix, "path-prefix", DefaultConfig.PathPrefix, "API path prefix")
+	fs.Var(&DefaultConfig.TraceExporter, "trace-exporter", fmt.Sprintf("exporter of OpenTelemetry trace spans (%v); none disables tracing", DefaultConfig.TraceExporter.Help()))
+	fs.StringVar(&DefaultConfig.TraceEndpoint, "trace-endpoint", DefaultConfig.TraceEndpoint, "URL of the OTLP/HTTP traces endpoint, such as http://localhost:4318/v1/traces; the OTEL_EXPORTER_OTLP_* variables apply if empty")
+	fs.Float64Var(&DefaultConfig.TraceSampleRatio, "trace-sample-ratio", DefaultConfig.TraceSampleRatio, "fraction of traces started by the application that are sampled; propagated traces follow the caller's decision")
 
 	return fs
 }
@@ -2,18 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
-	"net/http"
+	"fmt"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/peterbourgon/ff/v3"
 	"github.com/peterbourgon/ff/v3/ffcli"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redhatinsights/module-update-router/internal/config"
 	log "github.com/sirupsen/logrus"
 )
@@ -21,50 +22,116 @@ import (
 func main() {
 	var db *DB
 
+	name := filepath.Base(os.Args[0])
 	root := ffcli.Command{
-		FlagSet: config.FlagSet(filepath.Base(os.Args[0]), flag.ExitOnError),
+		ShortUsage: name + " [flags] [<subcommand>]",
+		FlagSet:    config.FlagSet(name, flag.ExitOnError),
 		Options: []ff.Option{
 			ff.WithEnvVarNoPrefix(),
 		},
+		Subcommands: []*ffcli.Command{
+			newMigrateCommand(),
+		},
 		Exec: func(ctx context.Context, args []string) error {
-			switch config.DefaultConfig.LogFormat.Value {
-			case "json":
-				log.SetFormatter(&log.JSONFormatter{})
-			default:
-				log.SetFormatter(&log.TextFormatter{})
-			}
-
-			lvl, err := log.ParseLevel(config.DefaultConfig.LogLevel)
+			setupLogging()
+
+			shutdownTracing, err := setupTracing(ctx, TracingConfig{
+				Exporter:    config.DefaultConfig.TraceExporter.Value,
+				Endpoint:    config.DefaultConfig.TraceEndpoint,
+				SampleRatio: config.DefaultConfig.TraceSampleRatio,
+				ServiceName: config.DefaultConfig.AppName,
+			})
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
-			log.SetLevel(lvl)
-			log.SetReportCaller(true)
-
-			log.Debugf("%+v", config.DefaultConfig)
+			// Deferred first, so that it runs last and flushes the spans
+			// of everything shut down before it.
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), config.DefaultConfig.ShutdownTimeout)
+				defer cancel()
+				if err := shutdownTracing(ctx); err != nil {
+					log.WithError(err).Error("cannot flush trace spans")
+				}
+			}()
 
-			db, err = Open("sqlite", "file::memory:?cache=shared")
+			db, err = Open(config.DefaultConfig.DBDriver.Value, config.DefaultConfig.DataSourceName())
 			if err != nil {
 				log.Fatal(err)
 			}
+			// db is closed here only if the server is never started;
+			// once it is, srv.Close closes db.
+			closeDB := true
 			defer func() {
+				if !closeDB {
+					return
+				}
 				if err := db.Close(); err != nil {
 					log.Error(err)
 				}
 			}()
 
+			// Refuse to run against a schema that a failed or newer
+			// migration has left in a state this binary does not know.
+			if !config.DefaultConfig.Reset {
+				if err := db.CheckSchema(ctx); err != nil {
+					return fmt.Errorf("refusing to start: %w; see '%v migrate -h'", err, name)
+				}
+			}
+
 			log.Debug("running migrations")
-			if err := db.Migrate(config.DefaultConfig.Reset); err != nil {
+			if err := db.Migrate(ctx, config.DefaultConfig.Reset); err != nil {
 				return err
 			}
 			log.Debug("migrations complete")
 
+			// Background workers run until workersCtx is cancelled on
+			// shutdown, and are then waited for. Until then, /ready
+			// fails if any of them has stopped.
+			var workers workerGroup
+			workersCtx, stopWorkers := context.WithCancel(ctx)
+			defer stopWorkers()
+
+			var seed *seedLoader
 			if config.DefaultConfig.SeedPath.Value != "" {
 				log.Debug("seeding database")
-				if err := db.Seed(config.DefaultConfig.SeedPath.Value); err != nil {
+				seed = newSeedLoader(db, config.DefaultConfig.SeedPath.Value)
+				if err := seed.load(ctx, true); err != nil {
 					return err
 				}
 				log.Debug("seed complete")
+
+				if seed.reloadable() {
+					reload := make(chan os.Signal, 1)
+					signal.Notify(reload, syscall.SIGHUP)
+					workers.Go("seed-loader", func() {
+						seed.watch(workersCtx, config.DefaultConfig.SeedReloadInterval, reload)
+					})
+				} else {
+					log.WithField("path", config.DefaultConfig.SeedPath.Value).Warn("raw SQL seed files are not reloaded; use a YAML or JSON seed file to reload it without restarting")
+				}
+			}
+
+			if _, err := db.Routes(ctx); err != nil {
+				return err
+			}
+			if config.DefaultConfig.RoutingRefreshInterval > 0 {
+				workers.Go("routing-refresher", func() {
+					refreshRoutes(workersCtx, db, config.DefaultConfig.RoutingRefreshInterval)
+				})
+			}
+			if config.DefaultConfig.EnrollmentSweepInterval > 0 {
+				workers.Go("enrollment-sweeper", func() {
+					sweepEnrollments(workersCtx, db,
+						config.DefaultConfig.EnrollmentSweepInterval,
+						time.Duration(config.DefaultConfig.EnrollmentWarnDays)*24*time.Hour)
+				})
+			}
+			if config.DefaultConfig.EventRetention > 0 && config.DefaultConfig.EventPruneInterval > 0 {
+				workers.Go("event-pruner", func() {
+					pruneEvents(workersCtx, db,
+						config.DefaultConfig.EventPruneInterval,
+						config.DefaultConfig.EventRetention)
+				})
 			}
 
 			apiroots := strings.Split(config.DefaultConfig.PathPrefix, ",")
@@ -72,22 +139,44 @@ func main() {
 				apiroots[i] = path.Join(root, config.DefaultConfig.AppName, config.DefaultConfig.APIVersion)
 			}
 
-			srv, err := NewServer(config.DefaultConfig.Addr, apiroots, db)
+			var publisher Publisher
+			if config.DefaultConfig.KafkaBrokers != "" {
+				publisher, err = NewKafkaPublisher(KafkaConfig{
+					Brokers:          strings.Split(config.DefaultConfig.KafkaBrokers, ","),
+					Topic:            config.KafkaTopic(config.DefaultConfig.MetricsTopic),
+					CAPath:           config.DefaultConfig.KafkaCAPath,
+					SASLMechanism:    config.DefaultConfig.KafkaSASLMechanism,
+					SASLUsername:     config.DefaultConfig.KafkaSASLUsername,
+					SASLPassword:     config.DefaultConfig.KafkaSASLPassword,
+					SecurityProtocol: config.DefaultConfig.KafkaSecurityProtocol,
+				})
+				if err != nil {
+					return err
+				}
+			} else {
+				log.Info("no Kafka brokers configured; events will not be published")
+			}
+
+			srv, err := NewServer(config.DefaultConfig.Addr, apiroots, db, publisher, seed)
 			if err != nil {
 				log.Fatal(err)
 			}
+			closeDB = false
 			defer func() {
 				if err := srv.Close(); err != nil {
 					log.Error(err)
 				}
 			}()
+			srv.addReadinessCheck("database", db.Ping)
+			srv.addReadinessCheck("schema", db.CheckSchemaReady)
+			srv.addReadinessCheck("workers", workers.check)
 
 			go func() {
 				log.WithFields(log.Fields{
 					"routine": "metrics",
 					"addr":    config.DefaultConfig.MAddr,
 				}).Info("started http listener")
-				if err := http.ListenAndServe(config.DefaultConfig.MAddr, promhttp.Handler()); err != nil {
+				if err := srv.ListenAndServeMetrics(); err != nil {
 					log.Fatalf("error: failed to listen to addr (%v): %v", config.DefaultConfig.MAddr, err)
 				}
 			}()
@@ -97,13 +186,38 @@ func main() {
 					"routine": "app",
 					"addr":    config.DefaultConfig.Addr,
 				}).Info("started http listener")
-				log.Fatal(srv.ListenAndServe())
+				if err := srv.ListenAndServe(); err != nil {
+					log.Fatal(err)
+				}
 			}()
 
 			quit := make(chan os.Signal, 1)
 			signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
 			<-quit
 
+			// Drain in-flight requests and queued events before stopping
+			// the background workers, all within the shutdown timeout.
+			// The publisher and the store are closed by srv.Close.
+			log.WithField("timeout", config.DefaultConfig.ShutdownTimeout).Info("shutting down")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), config.DefaultConfig.ShutdownTimeout)
+			defer cancel()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				log.WithError(err).Error("cannot shut down gracefully")
+			}
+
+			stopWorkers()
+			stopped := make(chan struct{})
+			go func() {
+				workers.Wait()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+				log.Info("shutdown complete")
+			case <-shutdownCtx.Done():
+				log.Error("background workers did not stop before the shutdown timeout")
+			}
+
 			return nil
 		},
 	}
@@ -113,6 +227,28 @@ func main() {
 	}
 
 	if err := root.Run(context.Background()); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
 		log.Fatalf("error: cannot execute command: %v", err)
 	}
 }
+
+// setupLogging configures the logger from config.DefaultConfig.
+func setupLogging() {
+	switch config.DefaultConfig.LogFormat.Value {
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.SetFormatter(&log.TextFormatter{})
+	}
+
+	lvl, err := log.ParseLevel(config.DefaultConfig.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetLevel(lvl)
+	log.SetReportCaller(true)
+
+	log.Debugf("%+v", config.DefaultConfig)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrChannelExists is returned by MemoryStore.InsertChannel when the
+	// module already has the channel.
+	ErrChannelExists = errors.New("memstore: channel already exists")
+
+	// ErrDefaultChannelExists is returned by MemoryStore.InsertChannel when
+	// adding a second default channel to a module.
+	ErrDefaultChannelExists = errors.New("memstore: module already has a default channel")
+)
+
+// MemoryStore is a Store that keeps enrollments, channels, rollouts, the audit
+// log and events in memory. It routes orgs by the same rules as DB, so handlers
+// can be tested against realistic routing behaviour without a database. It is
+// safe for concurrent use. The zero value is not usable; create one with
+// NewMemoryStore.
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	// enrollments, rollouts and defaults are laid out as in routingTable so
+	// that routing can share its implementation.
+	enrollments map[string]map[string]Enrollment
+	rollouts    map[string]Rollout
+	defaults    map[string]string
+
+	// channels maps a module name to the set of its channels.
+	channels map[string]map[string]bool
+
+	audit  []AuditEntry
+	events []event
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		enrollments: make(map[string]map[string]Enrollment),
+		rollouts:    make(map[string]Rollout),
+		defaults:    make(map[string]string),
+		channels:    make(map[string]map[string]bool),
+	}
+}
+
+// Route returns the name of the channel orgID should use for moduleName at now,
+// following the same rules as DB.Route.
+func (s *MemoryStore) Route(ctx context.Context, moduleName, orgID string, now time.Time) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t := routingTable{enrollments: s.enrollments, rollouts: s.rollouts, defaults: s.defaults}
+	return t.Channel(moduleName, orgID, now), nil
+}
+
+// InsertChannel adds channelName to the channels of moduleName. If isDefault is
+// true, the channel becomes the module's default channel; a module can have at
+// most one default channel.
+func (s *MemoryStore) InsertChannel(ctx context.Context, moduleName, channelName string, isDefault bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.channels[moduleName][channelName] {
+		return ErrChannelExists
+	}
+	if _, ok := s.defaults[moduleName]; ok && isDefault {
+		return ErrDefaultChannelExists
+	}
+	if s.channels[moduleName] == nil {
+		s.channels[moduleName] = make(map[string]bool)
+	}
+	s.channels[moduleName][channelName] = true
+	if isDefault {
+		s.defaults[moduleName] = channelName
+	}
+	return nil
+}
+
+// SetRollout creates or replaces the rollout for rollout.ModuleName.
+func (s *MemoryStore) SetRollout(ctx context.Context, rollout Rollout) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rollouts[rollout.ModuleName] = rollout
+	return nil
+}
+
+// InsertOrgsModules creates enrollment and records change in the audit log. If
+// the org is already enrolled for the module, ErrEnrollmentExists is returned.
+func (s *MemoryStore) InsertOrgsModules(ctx context.Context, enrollment Enrollment, change Change) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.enrollments[enrollment.ModuleName][enrollment.OrgID]; ok {
+		return ErrEnrollmentExists
+	}
+	if err := s.appendAudit(AuditActionCreate, enrollment.ModuleName, enrollment.OrgID, "", enrollment.Channel, change); err != nil {
+		return err
+	}
+
+	if s.enrollments[enrollment.ModuleName] == nil {
+		s.enrollments[enrollment.ModuleName] = make(map[string]Enrollment)
+	}
+	enrollment.StartsAt = utc(enrollment.StartsAt)
+	enrollment.ExpiresAt = utc(enrollment.ExpiresAt)
+	s.enrollments[enrollment.ModuleName][enrollment.OrgID] = enrollment
+	return nil
+}
+
+// DeleteOrgsModules deletes the enrollment of orgID in moduleName and records
+// change in the audit log. If no such enrollment exists, ErrEnrollmentNotFound
+// is returned.
+func (s *MemoryStore) DeleteOrgsModules(ctx context.Context, moduleName, orgID string, change Change) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enrollment, ok := s.enrollments[moduleName][orgID]
+	if !ok {
+		return ErrEnrollmentNotFound
+	}
+	if err := s.appendAudit(AuditActionDelete, moduleName, orgID, enrollment.Channel, "", change); err != nil {
+		return err
+	}
+	delete(s.enrollments[moduleName], orgID)
+	return nil
+}
+
+// UpdateOrgsModules moves orgID to channel in its enrollment in moduleName and
+// records change in the audit log. The updated enrollment is returned. If no
+// such enrollment exists, ErrEnrollmentNotFound is returned.
+func (s *MemoryStore) UpdateOrgsModules(ctx context.Context, moduleName, orgID, channel string, change Change) (Enrollment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enrollment, ok := s.enrollments[moduleName][orgID]
+	if !ok {
+		return Enrollment{}, ErrEnrollmentNotFound
+	}
+	if enrollment.Channel == channel {
+		return enrollment, nil
+	}
+	if err := s.appendAudit(AuditActionUpdate, moduleName, orgID, enrollment.Channel, channel, change); err != nil {
+		return Enrollment{}, err
+	}
+	enrollment.Channel = channel
+	s.enrollments[moduleName][orgID] = enrollment
+	return enrollment, nil
+}
+
+// ListEnrollments returns the enrollments matching filter, ordered by module
+// name and org ID. If limit is negative, all matching enrollments after offset
+// are returned.
+func (s *MemoryStore) ListEnrollments(ctx context.Context, filter EnrollmentFilter, limit, offset int) ([]Enrollment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	enrollments := make([]Enrollment, 0)
+	for _, orgs := range s.enrollments {
+		for _, e := range orgs {
+			if (filter.ModuleName == "" || e.ModuleName == filter.ModuleName) &&
+				(filter.OrgID == "" || e.OrgID == filter.OrgID) &&
+				(filter.Channel == "" || e.Channel == filter.Channel) {
+				enrollments = append(enrollments, e)
+			}
+		}
+	}
+	sort.Slice(enrollments, func(i, j int) bool {
+		if enrollments[i].ModuleName != enrollments[j].ModuleName {
+			return enrollments[i].ModuleName < enrollments[j].ModuleName
+		}
+		return enrollments[i].OrgID < enrollments[j].OrgID
+	})
+	return page(enrollments, limit, offset), nil
+}
+
+// AuditLog returns the audit log entries matching filter, newest first. If
+// limit is negative, all matching entries after offset are returned.
+func (s *MemoryStore) AuditLog(ctx context.Context, filter AuditFilter, limit, offset int) ([]AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]AuditEntry, 0)
+	for _, e := range s.audit {
+		if (filter.ModuleName == "" || e.ModuleName == filter.ModuleName) &&
+			(filter.OrgID == "" || e.OrgID == filter.OrgID) {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if !entries[i].CreatedAt.Equal(entries[j].CreatedAt) {
+			return entries[i].CreatedAt.After(entries[j].CreatedAt)
+		}
+		return entries[i].AuditID < entries[j].AuditID
+	})
+	return page(entries, limit, offset), nil
+}
+
+// appendAudit records a change to the enrollment of orgID in moduleName, from
+// oldChannel to newChannel, in the audit log. s.mu must be held for writing.
+func (s *MemoryStore) appendAudit(action, moduleName, orgID, oldChannel, newChannel string, change Change) error {
+	auditID, err := newUUID()
+	if err != nil {
+		return fmt.Errorf("memstore: uuid.NewUUID failed: %w", err)
+	}
+	s.audit = append(s.audit, AuditEntry{
+		AuditID:    auditID.String(),
+		CreatedAt:  time.Now().UTC(),
+		Actor:      change.Actor,
+		Action:     action,
+		ModuleName: moduleName,
+		OrgID:      orgID,
+		OldChannel: stringOrNil(oldChannel),
+		NewChannel: stringOrNil(newChannel),
+		Reason:     stringOrNil(change.Reason),
+		Ticket:     stringOrNil(change.Ticket),
+		RequestID:  stringOrNil(change.RequestID),
+	})
+	return nil
+}
+
+// InsertEventBatch stores all of events, or none of them if any has the same
+// event ID as a stored event.
+func (s *MemoryStore) InsertEventBatch(ctx context.Context, events []event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make(map[string]bool, len(s.events)+len(events))
+	for _, e := range s.events {
+		ids[e.eventID] = true
+	}
+	for _, e := range events {
+		if ids[e.eventID] {
+			return fmt.Errorf("memstore: duplicate event ID: %v", e.eventID)
+		}
+		ids[e.eventID] = true
+	}
+
+	for _, e := range events {
+		e.startedAt = e.startedAt.UTC()
+		e.endedAt = e.endedAt.UTC()
+		s.events = append(s.events, e)
+	}
+	return nil
+}
+
+// GetEvents returns the stored events matching filter, ordered by their start
+// time. If limit is negative, all matching events after offset are returned.
+func (s *MemoryStore) GetEvents(ctx context.Context, filter EventFilter, limit int, offset int) ([]map[string]interface{}, error) {
+	events := make([]map[string]interface{}, 0)
+	for _, e := range page(s.filterEvents(filter), limit, offset) {
+		events = append(events, e.record())
+	}
+	return events, nil
+}
+
+// GetEventPage returns a page of at most limit stored events matching filter,
+// ordered by start time and event ID, starting beyond cursor. If cursor is nil,
+// the first page is returned. If limit is negative, all matching events beyond
+// cursor are returned.
+func (s *MemoryStore) GetEventPage(ctx context.Context, filter EventFilter, cursor *EventCursor, limit int) (EventPage, error) {
+	matched := s.filterEvents(filter)
+	count := int64(len(matched))
+
+	if cursor != nil {
+		i := sort.Search(len(matched), func(i int) bool {
+			return matched[i].follows(*cursor)
+		})
+		if cursor.Before {
+			// Skip the event at the cursor itself, if it is still stored.
+			if i > 0 && matched[i-1].eventID == cursor.EventID {
+				i--
+			}
+			matched = matched[:i]
+			for l, r := 0, len(matched)-1; l < r; l, r = l+1, r-1 {
+				matched[l], matched[r] = matched[r], matched[l]
+			}
+		} else {
+			matched = matched[i:]
+		}
+	}
+	if limit >= 0 {
+		matched = page(matched, limit+1, 0)
+	}
+	return newEventPage(matched, count, cursor, limit), nil
+}
+
+// AggregateEvents returns statistics of the stored events matching filter,
+// grouped by core version, phase and time bucket of width bucket.
+func (s *MemoryStore) AggregateEvents(ctx context.Context, filter EventFilter, bucket time.Duration) ([]EventStats, error) {
+	return aggregateEvents(s.filterEvents(filter), bucket), nil
+}
+
+// filterEvents returns the stored events matching filter, ordered by start time
+// and event ID.
+func (s *MemoryStore) filterEvents(filter EventFilter) []event {
+	s.mu.RLock()
+	matched := make([]event, 0, len(s.events))
+	for _, e := range s.events {
+		if filter.matches(e) {
+			matched = append(matched, e)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].startedAt.Equal(matched[j].startedAt) {
+			return matched[i].startedAt.Before(matched[j].startedAt)
+		}
+		return matched[i].eventID < matched[j].eventID
+	})
+	return matched
+}
+
+// DeleteEvents deletes stored events that started before older and returns the
+// number deleted.
+func (s *MemoryStore) DeleteEvents(ctx context.Context, older time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.events[:0]
+	for _, e := range s.events {
+		if !e.startedAt.Before(older) {
+			kept = append(kept, e)
+		}
+	}
+	deleted := int64(len(s.events) - len(kept))
+	s.events = kept
+	return deleted, nil
+}
+
+// CountEvents returns the number of stored events that started before older.
+func (s *MemoryStore) CountEvents(ctx context.Context, older time.Time) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var count int64
+	for _, e := range s.events {
+		if e.startedAt.Before(older) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Close does nothing; a MemoryStore holds no resources.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// page returns the elements of s after offset, up to limit of them. If limit is
+// negative, all elements after offset are returned.
+func page[T any](s []T, limit, offset int) []T {
+	if offset >= len(s) {
+		return s[:0]
+	}
+	if offset > 0 {
+		s = s[offset:]
+	}
+	if limit >= 0 && limit < len(s) {
+		s = s[:limit]
+	}
+	return s
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testStore is a Store whose channels and rollouts can be configured, as both
+// DB and MemoryStore can.
+type testStore interface {
+	Store
+	InsertChannel(ctx context.Context, moduleName, channelName string, isDefault bool) error
+	SetRollout(ctx context.Context, rollout Rollout) error
+}
+
+// forEachStore runs f as a subtest against an empty store of each
+// implementation, so that MemoryStore is held to the behaviour of DB.
+func forEachStore(t *testing.T, f func(t *testing.T, store testStore)) {
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		if err := db.Migrate(context.Background(), false); err != nil {
+			t.Fatal(err)
+		}
+		f(t, db)
+	})
+	t.Run("memory", func(t *testing.T) {
+		f(t, NewMemoryStore())
+	})
+}
+
+func TestStoreRoute(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	tests := []struct {
+		desc  string
+		input struct{ moduleName, orgID string }
+		want  string
+	}{
+		{
+			desc:  "active enrollment",
+			input: struct{ moduleName, orgID string }{"insights-core", "1"},
+			want:  "testing",
+		},
+		{
+			desc:  "expired enrollment - want module default",
+			input: struct{ moduleName, orgID string }{"insights-core", "2"},
+			want:  "stable",
+		},
+		{
+			desc:  "enrollment not yet started - want module default",
+			input: struct{ moduleName, orgID string }{"insights-core", "3"},
+			want:  "stable",
+		},
+		{
+			desc:  "not enrolled - want module default",
+			input: struct{ moduleName, orgID string }{"insights-core", "4"},
+			want:  "stable",
+		},
+		{
+			desc:  "full rollout",
+			input: struct{ moduleName, orgID string }{"insights-core-next", "4"},
+			want:  "beta",
+		},
+		{
+			desc:  "unknown module - want DefaultChannel",
+			input: struct{ moduleName, orgID string }{"insights-core-old", "1"},
+			want:  DefaultChannel,
+		},
+	}
+
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		if err := store.InsertChannel(ctx, "insights-core", "stable", true); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetRollout(ctx, Rollout{ModuleName: "insights-core-next", Channel: "beta", Percentage: 100}); err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range []Enrollment{
+			{ModuleName: "insights-core", OrgID: "1", Channel: "testing"},
+			{ModuleName: "insights-core", OrgID: "2", Channel: "testing", ExpiresAt: &past},
+			{ModuleName: "insights-core", OrgID: "3", Channel: "testing", StartsAt: &future},
+		} {
+			if err := store.InsertOrgsModules(ctx, e, Change{Actor: systemActor}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, test := range tests {
+			t.Run(test.desc, func(t *testing.T) {
+				got, err := store.Route(ctx, test.input.moduleName, test.input.orgID, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != test.want {
+					t.Errorf("%v != %v", got, test.want)
+				}
+			})
+		}
+	})
+}
+
+func TestStoreEnrollments(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		change := Change{Actor: "jdoe@redhat.com", Reason: "testing"}
+		for _, e := range []Enrollment{
+			{ModuleName: "insights-core", OrgID: "2", Channel: "beta"},
+			{ModuleName: "insights-core", OrgID: "1", Channel: "testing"},
+			{ModuleName: "insights-core-next", OrgID: "1", Channel: "testing"},
+		} {
+			if err := store.InsertOrgsModules(ctx, e, change); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := store.InsertOrgsModules(ctx, Enrollment{ModuleName: "insights-core", OrgID: "1", Channel: "beta"}, change)
+		if !errors.Is(err, ErrEnrollmentExists) {
+			t.Errorf("%v != %v", err, ErrEnrollmentExists)
+		}
+
+		got, err := store.ListEnrollments(ctx, EnrollmentFilter{ModuleName: "insights-core"}, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Enrollment{{ModuleName: "insights-core", OrgID: "2", Channel: "beta"}}
+		if !cmp.Equal(got, want) {
+			t.Errorf("%v", cmp.Diff(got, want))
+		}
+
+		got, err = store.ListEnrollments(ctx, EnrollmentFilter{Channel: "testing"}, -1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = []Enrollment{
+			{ModuleName: "insights-core", OrgID: "1", Channel: "testing"},
+			{ModuleName: "insights-core-next", OrgID: "1", Channel: "testing"},
+		}
+		if !cmp.Equal(got, want) {
+			t.Errorf("%v", cmp.Diff(got, want))
+		}
+
+		if err := store.DeleteOrgsModules(ctx, "insights-core", "1", change); err != nil {
+			t.Fatal(err)
+		}
+		err = store.DeleteOrgsModules(ctx, "insights-core", "1", change)
+		if !errors.Is(err, ErrEnrollmentNotFound) {
+			t.Errorf("%v != %v", err, ErrEnrollmentNotFound)
+		}
+
+		entries, err := store.AuditLog(ctx, AuditFilter{ModuleName: "insights-core", OrgID: "1"}, -1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var actions []string
+		for _, e := range entries {
+			actions = append(actions, e.Action)
+			if e.Actor != change.Actor {
+				t.Errorf("%v != %v", e.Actor, change.Actor)
+			}
+		}
+		if want := []string{AuditActionDelete, AuditActionCreate}; !cmp.Equal(actions, want) {
+			t.Errorf("%v", cmp.Diff(actions, want))
+		}
+	})
+}
+
+func TestStoreEvents(t *testing.T) {
+	events := []event{
+		{
+			eventID:     "89d9352c-0f53-49c0-9f7c-27a9ee3e2dff",
+			phase:       "pre_update",
+			startedAt:   time.Date(2020, 7, 21, 13, 1, 4, 0, time.UTC),
+			exit:        1,
+			exception:   sql.NullString{String: "OSError", Valid: true},
+			endedAt:     time.Date(2020, 7, 21, 13, 2, 31, 0, time.UTC),
+			machineID:   "21f3e7da-6e33-41dd-b25f-0eab2242ae27",
+			coreVersion: "3.0.156",
+		},
+		{
+			eventID:     "af3b8e13-6b65-45d8-8310-a45e0821bd62",
+			phase:       "pre_update",
+			startedAt:   time.Date(2020, 6, 19, 11, 18, 3, 0, time.UTC),
+			exit:        0,
+			endedAt:     time.Date(2020, 6, 19, 11, 19, 3, 0, time.UTC),
+			machineID:   "a9ab0a44-1241-43ae-9c02-1850acf0c36c",
+			coreVersion: "3.0.156",
+			corePath:    sql.NullString{String: "/etc/insights-client/rpm.egg", Valid: true},
+		},
+	}
+
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		if err := store.InsertEventBatch(ctx, events); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.InsertEventBatch(ctx, events[:1]); err == nil {
+			t.Error("inserted an event twice")
+		}
+
+		got, err := store.GetEvents(ctx, EventFilter{}, -1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []map[string]interface{}{events[1].record(), events[0].record()}
+		if !cmp.Equal(got, want) {
+			t.Errorf("%v", cmp.Diff(got, want))
+		}
+
+		got, err = store.GetEvents(ctx, EventFilter{}, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = []map[string]interface{}{events[0].record()}
+		if !cmp.Equal(got, want) {
+			t.Errorf("%v", cmp.Diff(got, want))
+		}
+
+		older := time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+		count, err := store.CountEvents(ctx, older)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("%v != %v", count, 1)
+		}
+		deleted, err := store.DeleteEvents(ctx, older)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != 1 {
+			t.Errorf("%v != %v", deleted, 1)
+		}
+		got, err = store.GetEvents(ctx, EventFilter{}, -1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = []map[string]interface{}{events[0].record()}
+		if !cmp.Equal(got, want) {
+			t.Errorf("%v", cmp.Diff(got, want))
+		}
+	})
+}
+
+func TestStoreEventFilter(t *testing.T) {
+	exitOne := 1
+	noException := false
+	events := []event{
+		{
+			eventID:     "89d9352c-0f53-49c0-9f7c-27a9ee3e2dff",
+			phase:       "pre_update",
+			startedAt:   time.Date(2020, 7, 21, 13, 1, 4, 0, time.UTC),
+			exit:        1,
+			exception:   sql.NullString{String: "OSError", Valid: true},
+			endedAt:     time.Date(2020, 7, 21, 13, 2, 31, 0, time.UTC),
+			machineID:   "21f3e7da-6e33-41dd-b25f-0eab2242ae27",
+			coreVersion: "3.0.156",
+		},
+		{
+			eventID:     "af3b8e13-6b65-45d8-8310-a45e0821bd62",
+			phase:       "pre_update",
+			startedAt:   time.Date(2020, 6, 19, 11, 18, 3, 0, time.UTC),
+			exit:        0,
+			endedAt:     time.Date(2020, 6, 19, 11, 19, 3, 0, time.UTC),
+			machineID:   "a9ab0a44-1241-43ae-9c02-1850acf0c36c",
+			coreVersion: "3.0.156",
+		},
+		{
+			eventID:     "c2a5a6a3-8d1b-4a4e-8f53-37c0c1c5bd2e",
+			phase:       "post_update",
+			startedAt:   time.Date(2020, 8, 3, 9, 0, 0, 0, time.UTC),
+			exit:        2,
+			endedAt:     time.Date(2020, 8, 3, 9, 0, 30, 0, time.UTC),
+			machineID:   "21f3e7da-6e33-41dd-b25f-0eab2242ae27",
+			coreVersion: "3.0.160",
+		},
+	}
+
+	tests := []struct {
+		desc  string
+		input EventFilter
+		want  []event
+	}{
+		{
+			desc:  "no filter",
+			input: EventFilter{},
+			want:  []event{events[1], events[0], events[2]},
+		},
+		{
+			desc:  "machine_id",
+			input: EventFilter{MachineID: "21f3e7da-6e33-41dd-b25f-0eab2242ae27"},
+			want:  []event{events[0], events[2]},
+		},
+		{
+			desc:  "phase",
+			input: EventFilter{Phase: "post_update"},
+			want:  []event{events[2]},
+		},
+		{
+			desc:  "core_version",
+			input: EventFilter{CoreVersion: "3.0.156"},
+			want:  []event{events[1], events[0]},
+		},
+		{
+			desc:  "exit",
+			input: EventFilter{Exit: &exitOne},
+			want:  []event{events[0]},
+		},
+		{
+			desc:  "exit nonzero",
+			input: EventFilter{ExitNonZero: true},
+			want:  []event{events[0], events[2]},
+		},
+		{
+			desc:  "no exception",
+			input: EventFilter{HasException: &noException},
+			want:  []event{events[1], events[2]},
+		},
+		{
+			desc:  "started_at range",
+			input: EventFilter{StartedAfter: events[0].startedAt, StartedBefore: events[2].startedAt},
+			want:  []event{events[0]},
+		},
+		{
+			desc:  "ended_at range",
+			input: EventFilter{EndedAfter: time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC), EndedBefore: time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)},
+			want:  []event{events[0], events[2]},
+		},
+		{
+			desc:  "combined",
+			input: EventFilter{MachineID: "21f3e7da-6e33-41dd-b25f-0eab2242ae27", ExitNonZero: true, CoreVersion: "3.0.160"},
+			want:  []event{events[2]},
+		},
+	}
+
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		if err := store.InsertEventBatch(ctx, events); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			t.Run(test.desc, func(t *testing.T) {
+				got, err := store.GetEvents(ctx, test.input, -1, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := make([]map[string]interface{}, 0, len(test.want))
+				for _, e := range test.want {
+					want = append(want, e.record())
+				}
+				if !cmp.Equal(got, want) {
+					t.Errorf("%v", cmp.Diff(got, want))
+				}
+			})
+		}
+
+		got, err := store.GetEvents(ctx, EventFilter{MachineID: "21f3e7da-6e33-41dd-b25f-0eab2242ae27"}, -1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []map[string]interface{}{events[2].record()}; !cmp.Equal(got, want) {
+			t.Errorf("%v", cmp.Diff(got, want))
+		}
+	})
+}
+
+func TestStoreEventPage(t *testing.T) {
+	start := time.Date(2020, 7, 21, 13, 1, 4, 0, time.UTC)
+	var events []event
+	for i, id := range []string{"e", "a", "d", "c", "b"} {
+		events = append(events, event{
+			eventID: id,
+			phase:   "pre_update",
+			// "e" and "b" start at the same time, and so are ordered
+			// by event ID.
+			startedAt:   start.Add(time.Duration(i%4) * time.Minute),
+			endedAt:     start.Add(time.Hour),
+			machineID:   "21f3e7da-6e33-41dd-b25f-0eab2242ae27",
+			coreVersion: "3.0.156",
+		})
+	}
+	ids := func(page EventPage) []string {
+		var ids []string
+		for _, e := range page.Events {
+			ids = append(ids, e["event_id"].(string))
+		}
+		return ids
+	}
+
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		if err := store.InsertEventBatch(ctx, events); err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			cursor *EventCursor
+			pages  [][]string
+		)
+		// Bound the walk, in case a broken cursor never reaches the end.
+		for len(pages) <= len(events) {
+			page, err := store.GetEventPage(ctx, EventFilter{}, cursor, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if page.Count != 5 {
+				t.Errorf("%v != %v", page.Count, 5)
+			}
+			if (cursor == nil) != (page.Prev == nil) {
+				t.Errorf("unexpected prev cursor %v", page.Prev)
+			}
+			pages = append(pages, ids(page))
+			if page.Next == nil {
+				break
+			}
+			cursor = page.Next
+		}
+		if want := [][]string{{"b", "e"}, {"a", "d"}, {"c"}}; !cmp.Equal(pages, want) {
+			t.Errorf("%v", cmp.Diff(pages, want))
+		}
+
+		page, err := store.GetEventPage(ctx, EventFilter{}, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page, err = store.GetEventPage(ctx, EventFilter{}, page.Prev, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"a", "d"}; !cmp.Equal(ids(page), want) {
+			t.Errorf("%v", cmp.Diff(ids(page), want))
+		}
+		if page.Prev == nil || page.Next == nil {
+			t.Errorf("missing cursors: prev %v, next %v", page.Prev, page.Next)
+		}
+		page, err = store.GetEventPage(ctx, EventFilter{}, page.Prev, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"b", "e"}; !cmp.Equal(ids(page), want) {
+			t.Errorf("%v", cmp.Diff(ids(page), want))
+		}
+		if page.Prev != nil {
+			t.Errorf("unexpected prev cursor %v", page.Prev)
+		}
+
+		page, err = store.GetEventPage(ctx, EventFilter{Phase: "post_update"}, nil, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Events) != 0 || page.Count != 0 || page.Next != nil || page.Prev != nil {
+			t.Errorf("unexpected page %+v", page)
+		}
+	})
+}
+
+func TestStoreAggregateEvents(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		if err := store.InsertEventBatch(ctx, statsEvents()); err != nil {
+			t.Fatal(err)
+		}
+
+		filter := EventFilter{ExitNonZero: true}
+		got, err := store.AggregateEvents(ctx, filter, 24*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var failed []event
+		for _, e := range statsEvents() {
+			if filter.matches(e) {
+				failed = append(failed, e)
+			}
+		}
+		want := aggregateEvents(failed, 24*time.Hour)
+		if !cmp.Equal(got, want) {
+			t.Errorf("%v", cmp.Diff(got, want))
+		}
+	})
+}
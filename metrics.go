@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	p "github.com/prometheus/client_golang/prometheus"
 	pa "github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -10,8 +12,116 @@ var (
 		Name: "module_update_router_requests",
 		Help: "Total number of GETs to router",
 	}, []string{"endpoint"})
+
+	eventQueueDepth = pa.NewGauge(p.GaugeOpts{
+		Name: "module_update_router_event_queue_depth",
+		Help: "Number of events waiting to be written to the database",
+	})
+
+	eventsWritten = pa.NewCounter(p.CounterOpts{
+		Name: "module_update_router_events_written",
+		Help: "Total number of events written to the database",
+	})
+
+	eventsDropped = pa.NewCounterVec(p.CounterOpts{
+		Name: "module_update_router_events_dropped",
+		Help: "Total number of events that were not written to the database",
+	}, []string{"reason"})
+
+	eventsPublished = pa.NewCounter(p.CounterOpts{
+		Name: "module_update_router_events_published",
+		Help: "Total number of events published to the metrics topic",
+	})
+
+	eventPublishErrors = pa.NewCounter(p.CounterOpts{
+		Name: "module_update_router_event_publish_errors",
+		Help: "Total number of events that could not be published to the metrics topic",
+	})
+
+	eventsPruned = pa.NewCounter(p.CounterOpts{
+		Name: "module_update_router_events_pruned",
+		Help: "Total number of events deleted for being older than the retention period",
+	})
+
+	enrollmentsExpired = pa.NewCounter(p.CounterOpts{
+		Name: "module_update_router_enrollments_expired",
+		Help: "Total number of expired enrollments deleted",
+	})
+
+	enrollmentsExpiring = pa.NewGaugeVec(p.GaugeOpts{
+		Name: "module_update_router_enrollments_expiring",
+		Help: "Number of enrollments that expire within the configured warning period",
+	}, []string{"module"})
+
+	seedLoads = pa.NewCounterVec(p.CounterOpts{
+		Name: "module_update_router_seed_loads",
+		Help: "Total number of attempts to load the seed file",
+	}, []string{"result"})
+
+	seedInfo = pa.NewGaugeVec(p.GaugeOpts{
+		Name: "module_update_router_seed_info",
+		Help: "Checksum of the loaded seed file; always 1",
+	}, []string{"checksum"})
+
+	seedLoadedTime = pa.NewGauge(p.GaugeOpts{
+		Name: "module_update_router_seed_loaded_timestamp_seconds",
+		Help: "Time at which the seed file was last loaded, in seconds since the epoch",
+	})
 )
 
 func incRequests(endpoint string) {
 	requests.With(p.Labels{"endpoint": endpoint}).Inc()
 }
+
+func setEventQueueDepth(depth int) {
+	eventQueueDepth.Set(float64(depth))
+}
+
+func addEventsWritten(count int) {
+	eventsWritten.Add(float64(count))
+}
+
+func incEventsDropped(reason string) {
+	addEventsDropped(reason, 1)
+}
+
+func addEventsDropped(reason string, count int) {
+	eventsDropped.With(p.Labels{"reason": reason}).Add(float64(count))
+}
+
+func addEventsPublished(count int) {
+	eventsPublished.Add(float64(count))
+}
+
+func incEventPublishErrors() {
+	addEventPublishErrors(1)
+}
+
+func addEventPublishErrors(count int) {
+	eventPublishErrors.Add(float64(count))
+}
+
+func addEventsPruned(count int64) {
+	eventsPruned.Add(float64(count))
+}
+
+func addEnrollmentsExpired(count int) {
+	enrollmentsExpired.Add(float64(count))
+}
+
+func setEnrollmentsExpiring(counts map[string]int) {
+	enrollmentsExpiring.Reset()
+	for module, count := range counts {
+		enrollmentsExpiring.With(p.Labels{"module": module}).Set(float64(count))
+	}
+}
+
+func incSeedLoads(result string) {
+	seedLoads.With(p.Labels{"result": result}).Inc()
+}
+
+func setSeedLoaded(checksum string, t time.Time) {
+	seedInfo.Reset()
+	seedInfo.With(p.Labels{"checksum": checksum}).Set(1)
+	seedLoadedTime.Set(float64(t.UnixNano()) / 1e9)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"github.com/redhatinsights/module-update-router/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// newMigrateCommand creates the "migrate" command, whose subcommands manage the
+// database schema. They connect to the database configured by the root
+// command's flags.
+func newMigrateCommand() *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "migrate",
+		ShortUsage: "migrate <subcommand> [<args>]",
+		ShortHelp:  "manage database schema migrations",
+		LongHelp: "Manage database schema migrations. If a migration fails part-way " +
+			"through, the schema is left dirty and the server refuses to start. Repair " +
+			"the schema by hand, then record the version it is at with 'migrate force'.",
+		FlagSet: flag.NewFlagSet("migrate", flag.ExitOnError),
+		Subcommands: []*ffcli.Command{
+			{
+				Name:       "up",
+				ShortUsage: "migrate up",
+				ShortHelp:  "apply all pending migrations",
+				Exec:       withMigrateDB(migrateUp),
+			},
+			{
+				Name:       "down",
+				ShortUsage: "migrate down <n>",
+				ShortHelp:  "roll back the n most recently applied migrations",
+				Exec:       withMigrateDB(migrateDown),
+			},
+			{
+				Name:       "version",
+				ShortUsage: "migrate version",
+				ShortHelp:  "print the current and latest known schema versions",
+				Exec:       withMigrateDB(migrateVersion),
+			},
+			{
+				Name:       "force",
+				ShortUsage: "migrate force <version>",
+				ShortHelp:  "set the schema version and clear the dirty flag without migrating",
+				Exec:       withMigrateDB(migrateForce),
+			},
+		},
+		Exec: func(ctx context.Context, args []string) error {
+			return flag.ErrHelp
+		},
+	}
+}
+
+// withMigrateDB creates an ffcli Exec function that opens the configured
+// database and calls f with it, writing output to os.Stdout.
+func withMigrateDB(f func(ctx context.Context, db *DB, w io.Writer, args []string) error) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		setupLogging()
+
+		db, err := Open(config.DefaultConfig.DBDriver.Value, config.DefaultConfig.DataSourceName())
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := db.Close(); err != nil {
+				log.Error(err)
+			}
+		}()
+
+		return f(ctx, db, os.Stdout, args)
+	}
+}
+
+// migrateUp applies all pending migrations to db.
+func migrateUp(ctx context.Context, db *DB, w io.Writer, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("migrate up: unexpected arguments: %v", args)
+	}
+
+	from, _, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if err := db.Migrate(ctx, false); err != nil {
+		return err
+	}
+	to, _, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if from == to {
+		_, err = fmt.Fprintf(w, "no change: schema is at version %v\n", to)
+		return err
+	}
+	_, err = fmt.Fprintf(w, "migrated from version %v to %v\n", from, to)
+	return err
+}
+
+// migrateDown rolls back the number of migrations given in args.
+func migrateDown(ctx context.Context, db *DB, w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("migrate down: expected the number of migrations to roll back")
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		return fmt.Errorf("migrate down: invalid number of migrations: '%v'", args[0])
+	}
+
+	from, _, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if err := db.MigrateDown(ctx, n); err != nil {
+		return err
+	}
+	to, _, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "migrated from version %v to %v\n", from, to)
+	return err
+}
+
+// migrateVersion prints the schema version of db, whether it is dirty and the
+// latest migration known to the binary.
+func migrateVersion(ctx context.Context, db *DB, w io.Writer, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("migrate version: unexpected arguments: %v", args)
+	}
+
+	version, dirty, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	latest, err := latestSchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "version: %v\ndirty: %v\nlatest: %v\n", version, dirty, latest)
+	return err
+}
+
+// migrateForce records the version given in args as the schema version of db
+// and clears its dirty flag.
+func migrateForce(ctx context.Context, db *DB, w io.Writer, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("migrate force: expected a version")
+	}
+	version, err := strconv.Atoi(args[0])
+	if err != nil || version < -1 {
+		return fmt.Errorf("migrate force: invalid version: '%v'", args[0])
+	}
+
+	if err := db.ForceSchemaVersion(ctx, version); err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "forced schema version to %v\n", version)
+	return err
+}
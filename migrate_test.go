@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+)
+
+func TestMigrateCommands(t *testing.T) {
+	latest, err := latestSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := iofs.New(migrations, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = source.Close() }()
+	previous, err := source.Prev(latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forEachBackend(t, func(t *testing.T, db *DB) {
+		tests := []struct {
+			desc    string
+			command func(ctx context.Context, db *DB, w io.Writer, args []string) error
+			args    []string
+			want    string
+			wantErr bool
+		}{
+			{
+				desc:    "version - empty database",
+				command: migrateVersion,
+				want:    fmt.Sprintf("version: 0\ndirty: false\nlatest: %v\n", latest),
+			},
+			{
+				desc:    "up",
+				command: migrateUp,
+				want:    fmt.Sprintf("migrated from version 0 to %v\n", latest),
+			},
+			{
+				desc:    "up - no change",
+				command: migrateUp,
+				want:    fmt.Sprintf("no change: schema is at version %v\n", latest),
+			},
+			{
+				desc:    "down - missing argument",
+				command: migrateDown,
+				wantErr: true,
+			},
+			{
+				desc:    "down - invalid argument",
+				command: migrateDown,
+				args:    []string{"0"},
+				wantErr: true,
+			},
+			{
+				desc:    "down 1",
+				command: migrateDown,
+				args:    []string{"1"},
+				want:    fmt.Sprintf("migrated from version %v to %v\n", latest, previous),
+			},
+			{
+				desc:    "force - invalid argument",
+				command: migrateForce,
+				args:    []string{"latest"},
+				wantErr: true,
+			},
+			{
+				desc:    "force",
+				command: migrateForce,
+				args:    []string{fmt.Sprint(latest)},
+				want:    fmt.Sprintf("forced schema version to %v\n", latest),
+			},
+			{
+				desc:    "version",
+				command: migrateVersion,
+				want:    fmt.Sprintf("version: %v\ndirty: false\nlatest: %v\n", latest, latest),
+			},
+		}
+
+		for _, test := range tests {
+			t.Run(test.desc, func(t *testing.T) {
+				var buf bytes.Buffer
+				err := test.command(context.Background(), db, &buf, test.args)
+				if (err != nil) != test.wantErr {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if got := buf.String(); got != test.want {
+					t.Errorf("%q != %q", got, test.want)
+				}
+			})
+		}
+	})
+}
+
+func TestDBCheckSchema(t *testing.T) {
+	latest, err := latestSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc  string
+		setup func(db *DB) error
+		want  error
+	}{
+		{
+			desc:  "empty database",
+			setup: func(db *DB) error { return nil },
+		},
+		{
+			desc:  "latest version",
+			setup: func(db *DB) error { return db.Migrate(context.Background(), false) },
+		},
+		{
+			desc: "dirty",
+			setup: func(db *DB) error {
+				if err := db.Migrate(context.Background(), false); err != nil {
+					return err
+				}
+				_, err := db.handle.Exec(`UPDATE schema_migrations SET dirty = TRUE;`)
+				return err
+			},
+			want: ErrSchemaDirty,
+		},
+		{
+			desc: "newer than latest",
+			setup: func(db *DB) error {
+				return db.ForceSchemaVersion(context.Background(), int(latest)+1)
+			},
+			want: ErrSchemaTooNew,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, db *DB) {
+				if err := test.setup(db); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.CheckSchema(context.Background()); !errors.Is(err, test.want) {
+					t.Errorf("%v != %v", err, test.want)
+				}
+			})
+		})
+	}
+}
+
+func TestDBCheckSchemaReady(t *testing.T) {
+	latest, err := latestSchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc  string
+		setup func(db *DB) error
+		want  error
+	}{
+		{
+			desc:  "latest version",
+			setup: func(db *DB) error { return db.Migrate(context.Background(), false) },
+		},
+		{
+			desc: "older than latest",
+			setup: func(db *DB) error {
+				if err := db.Migrate(context.Background(), false); err != nil {
+					return err
+				}
+				return db.MigrateDown(context.Background(), 1)
+			},
+			want: ErrSchemaOutdated,
+		},
+		{
+			desc: "dirty",
+			setup: func(db *DB) error {
+				if err := db.Migrate(context.Background(), false); err != nil {
+					return err
+				}
+				_, err := db.handle.Exec(`UPDATE schema_migrations SET dirty = TRUE;`)
+				return err
+			},
+			want: ErrSchemaDirty,
+		},
+		{
+			desc: "newer than latest",
+			setup: func(db *DB) error {
+				return db.ForceSchemaVersion(context.Background(), int(latest)+1)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, db *DB) {
+				if err := test.setup(db); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.CheckSchemaReady(context.Background()); !errors.Is(err, test.want) {
+					t.Errorf("%v != %v", err, test.want)
+				}
+			})
+		})
+	}
+
+	t.Run("empty database", func(t *testing.T) {
+		forEachBackend(t, func(t *testing.T, db *DB) {
+			if err := db.CheckSchemaReady(context.Background()); err == nil {
+				t.Error("unmigrated database passed the check")
+			}
+		})
+	})
+}
@@ -0,0 +1,5 @@
+DELETE FROM orgs_modules WHERE channel <> 'testing';
+
+ALTER TABLE orgs_modules DROP COLUMN channel;
+
+DROP TABLE IF EXISTS channels;
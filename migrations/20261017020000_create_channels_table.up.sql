@@ -0,0 +1,17 @@
+CREATE TABLE channels (
+    module_name VARCHAR(256),
+    channel_name VARCHAR(256),
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY(module_name, channel_name)
+);
+
+CREATE UNIQUE INDEX channels_default_idx ON channels (module_name) WHERE is_default;
+
+ALTER TABLE orgs_modules
+ADD COLUMN channel VARCHAR(256) NOT NULL DEFAULT 'testing';
+
+INSERT INTO channels (module_name, channel_name, is_default)
+SELECT DISTINCT module_name, 'release', TRUE FROM orgs_modules;
+
+INSERT INTO channels (module_name, channel_name, is_default)
+SELECT DISTINCT module_name, 'testing', FALSE FROM orgs_modules;
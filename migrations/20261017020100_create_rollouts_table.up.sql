@@ -0,0 +1,6 @@
+CREATE TABLE rollouts (
+    module_name VARCHAR(256) PRIMARY KEY,
+    channel VARCHAR(256) NOT NULL DEFAULT 'testing',
+    percentage INTEGER NOT NULL DEFAULT 0 CHECK (percentage BETWEEN 0 AND 100),
+    salt VARCHAR(256) NOT NULL DEFAULT ''
+);
@@ -0,0 +1,3 @@
+ALTER TABLE orgs_modules DROP COLUMN expires_at;
+
+ALTER TABLE orgs_modules DROP COLUMN starts_at;
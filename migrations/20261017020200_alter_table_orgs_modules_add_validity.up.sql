@@ -0,0 +1,5 @@
+ALTER TABLE orgs_modules
+ADD COLUMN starts_at TIMESTAMP;
+
+ALTER TABLE orgs_modules
+ADD COLUMN expires_at TIMESTAMP;
@@ -0,0 +1,17 @@
+CREATE TABLE enrollment_audit (
+    audit_id VARCHAR(36) PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    actor VARCHAR(256) NOT NULL,
+    action VARCHAR(32) NOT NULL,
+    module_name VARCHAR(256) NOT NULL,
+    org_id VARCHAR(256) NOT NULL,
+    old_channel VARCHAR(256),
+    new_channel VARCHAR(256),
+    reason VARCHAR(1024),
+    ticket VARCHAR(256),
+    request_id VARCHAR(256)
+);
+
+CREATE INDEX enrollment_audit_module_name_idx ON enrollment_audit (module_name, created_at);
+
+CREATE INDEX enrollment_audit_org_id_idx ON enrollment_audit (org_id, created_at);
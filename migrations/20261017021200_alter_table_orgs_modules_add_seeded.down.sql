@@ -0,0 +1 @@
+ALTER TABLE orgs_modules DROP COLUMN seeded;
@@ -0,0 +1,2 @@
+ALTER TABLE orgs_modules
+ADD COLUMN seeded BOOLEAN NOT NULL DEFAULT FALSE;
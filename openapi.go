@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+)
+
+// specValidator checks requests, and optionally responses, against the OpenAPI
+// spec served at openapi.json, so that the spec and the handlers cannot drift
+// apart.
+type specValidator struct {
+	router  routers.Router
+	options *openapi3filter.Options
+
+	// invalidResponse, if not nil, is called with every response that does
+	// not match the spec. Responses are only validated if it is set, which
+	// tests do; in production, the cost of buffering every response is not
+	// worth it.
+	invalidResponse func(r *http.Request, err error)
+}
+
+// newSpecValidator creates a specValidator for spec, serving its paths under
+// each of the given API roots instead of the servers listed in spec.
+func newSpecValidator(spec []byte, apiroots []string) (*specValidator, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(spec)
+	if err != nil {
+		return nil, fmt.Errorf("openapi: cannot load spec: %w", err)
+	}
+	doc.Servers = make(openapi3.Servers, 0, len(apiroots))
+	for _, apiroot := range apiroots {
+		doc.Servers = append(doc.Servers, &openapi3.Server{URL: apiroot})
+	}
+	router, err := legacy.NewRouter(doc)
+	if err != nil {
+		return nil, fmt.Errorf("openapi: invalid spec: %w", err)
+	}
+
+	return &specValidator{
+		router: router,
+		options: &openapi3filter.Options{
+			MultiError: true,
+			// The identity is checked by the auth middleware.
+			AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+			// Defaults are applied by the handlers; adding them to the
+			// request would leak them into links built from its query.
+			SkipSettingDefaults:   true,
+			IncludeResponseStatus: true,
+		},
+	}, nil
+}
+
+// validate is an http HandlerFunc middleware handler that rejects requests that
+// do not match the OpenAPI spec with a 400 Bad Request. Requests for paths or
+// methods missing from the spec are passed to next, which responds with the
+// appropriate error. If s.spec.invalidResponse is set, responses are checked
+// against the spec too, and so are successful responses to operations missing
+// from it.
+func (s *Server) validate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, pathParams, err := s.spec.router.FindRoute(r)
+		if err != nil {
+			if s.spec.invalidResponse == nil {
+				next(w, r)
+				return
+			}
+			rec := newResponseRecorder(w)
+			next(rec, r)
+			if rec.Code < http.StatusBadRequest {
+				s.spec.invalidResponse(r, fmt.Errorf("operation is missing from the spec: %w", err))
+			}
+			return
+		}
+
+		// Handlers decode request bodies as JSON, whatever their declared
+		// type.
+		if r.Header.Get("Content-Type") == "" && r.ContentLength != 0 {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    s.spec.options,
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			if errs := requestErrors(w, r, err); len(errs) > 0 {
+				writeErrors(w, http.StatusBadRequest, errs)
+				return
+			}
+		}
+
+		if s.spec.invalidResponse == nil {
+			next(w, r)
+			return
+		}
+		rec := newResponseRecorder(w)
+		next(rec, r)
+		if err := openapi3filter.ValidateResponse(r.Context(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 rec.Code,
+			Header:                 rec.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(rec.Body.Bytes())),
+			Options:                s.spec.options,
+		}); err != nil {
+			s.spec.invalidResponse(r, err)
+		}
+	}
+}
+
+// requestErrors converts an error returned by openapi3filter.ValidateRequest for
+// r into API errors. Empty values of optional query parameters are not
+// reported, since handlers treat them as missing.
+func requestErrors(w http.ResponseWriter, r *http.Request, err error) []apiError {
+	var errs []apiError
+	for _, err := range flattenErrors(err) {
+		var reqErr *openapi3filter.RequestError
+		if !errors.As(err, &reqErr) {
+			errs = append(errs, newAPIError(w, http.StatusBadRequest, codeInvalidParameter, err.Error()))
+			continue
+		}
+
+		switch {
+		case reqErr.Parameter != nil:
+			param := reqErr.Parameter
+			switch {
+			case param.In == openapi3.ParameterInQuery && !param.Required && r.URL.Query().Get(param.Name) == "":
+			case errors.Is(reqErr.Err, openapi3filter.ErrInvalidRequired),
+				errors.Is(reqErr.Err, openapi3filter.ErrInvalidEmptyValue):
+				errs = append(errs, newAPIError(w, http.StatusBadRequest, codeMissingParameter,
+					fmt.Sprintf("missing required parameter: '%s'", param.Name)))
+			default:
+				errs = append(errs, newAPIError(w, http.StatusBadRequest, codeInvalidParameter,
+					fmt.Sprintf("invalid parameter '%s': %s", param.Name, parameterErrorReason(param, reqErr.Err))))
+			}
+		case reqErr.RequestBody != nil:
+			var schemaErrs []*openapi3.SchemaError
+			for _, err := range flattenErrors(reqErr.Err) {
+				var schemaErr *openapi3.SchemaError
+				if errors.As(err, &schemaErr) {
+					schemaErrs = append(schemaErrs, schemaErr)
+				}
+			}
+			if len(schemaErrs) == 0 {
+				reason := reqErr.Reason
+				if reqErr.Err != nil {
+					reason = reqErr.Err.Error()
+				}
+				errs = append(errs, newAPIError(w, http.StatusBadRequest, codeInvalidBody,
+					fmt.Sprintf("cannot decode request body: %s", reason)))
+				continue
+			}
+			for _, schemaErr := range schemaErrs {
+				errs = append(errs, bodyFieldError(w, schemaErr))
+			}
+		default:
+			errs = append(errs, newAPIError(w, http.StatusBadRequest, codeInvalidParameter, reqErr.Error()))
+		}
+	}
+	return errs
+}
+
+// bodyFieldError converts a schema violation in a request body into an
+// invalid_field API error pointing at the offending field.
+func bodyFieldError(w http.ResponseWriter, err *openapi3.SchemaError) apiError {
+	field := strings.Join(err.JSONPointer(), "/")
+
+	var msg string
+	switch {
+	case err.SchemaField == "required", err.SchemaField == "minLength" && err.Schema.MinLength == 1:
+		msg = fmt.Sprintf("missing required field: '%s'", field)
+	case err.SchemaField == "maxLength" && err.Schema.MaxLength != nil:
+		msg = fmt.Sprintf("invalid field '%s': must be at most %d characters long", field, *err.Schema.MaxLength)
+	case err.SchemaField == "format" && err.Schema.Format == "date-time":
+		msg = fmt.Sprintf("invalid timestamp in field '%s': must be RFC 3339 formatted", field)
+	default:
+		msg = fmt.Sprintf("invalid field '%s': %s", field, err.Reason)
+	}
+
+	obj := newAPIError(w, http.StatusBadRequest, codeInvalidField, msg)
+	obj.Source = &errorSource{Pointer: "/" + field}
+	return obj
+}
+
+// parameterErrorReason describes why the value of param is invalid, without
+// repeating its name.
+func parameterErrorReason(param *openapi3.Parameter, err error) string {
+	var parseErr *openapi3filter.ParseError
+	if errors.As(err, &parseErr) && param.Schema != nil && param.Schema.Value.Type != nil {
+		switch t := param.Schema.Value.Type; {
+		case t.Is("boolean"):
+			return "must be 'true' or 'false'"
+		case t.Is("integer"):
+			return "must be an integer"
+		}
+	}
+	var schemaErr *openapi3.SchemaError
+	if !errors.As(err, &schemaErr) {
+		return err.Error()
+	}
+	switch {
+	case schemaErr.SchemaField == "format" && schemaErr.Schema.Format == "date-time":
+		return "must be RFC 3339 formatted"
+	case schemaErr.SchemaField == "minimum" && schemaErr.Schema.Min != nil && *schemaErr.Schema.Min == 0:
+		return "must not be negative"
+	}
+	return schemaErr.Reason
+}
+
+// flattenErrors returns the errors wrapped in err if it is an
+// openapi3.MultiError, recursively, or err itself otherwise.
+func flattenErrors(err error) []error {
+	multi, ok := err.(openapi3.MultiError)
+	if !ok {
+		return []error{err}
+	}
+	var errs []error
+	for _, err := range multi {
+		errs = append(errs, flattenErrors(err)...)
+	}
+	return errs
+}
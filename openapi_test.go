@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// validateResponses makes srv check every response under the API roots
+// against the OpenAPI spec, failing t if one does not match.
+func validateResponses(t *testing.T, srv *Server) {
+	t.Helper()
+	srv.spec.invalidResponse = func(r *http.Request, err error) {
+		t.Errorf("%v %v: response does not match openapi.json: %v", r.Method, r.URL, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	associate := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`))
+
+	tests := []struct {
+		description string
+		method      string
+		url         string
+		contentType string
+		body        string
+		wantCode    int
+		wantBody    string
+	}{
+		{
+			description: "missing required parameter",
+			method:      http.MethodGet,
+			url:         "/api/module-update-router/v1/channel",
+			wantCode:    http.StatusBadRequest,
+			wantBody:    `{"errors":[{"status":"Bad Request","code":"missing_parameter","title":"Missing required parameter","detail":"missing required parameter: 'module'","request_id":"test-request-id"}]}`,
+		},
+		{
+			description: "empty required parameter",
+			method:      http.MethodGet,
+			url:         "/api/module-update-router/v1/channel?module=",
+			wantCode:    http.StatusBadRequest,
+			wantBody:    `{"errors":[{"status":"Bad Request","code":"missing_parameter","title":"Missing required parameter","detail":"missing required parameter: 'module'","request_id":"test-request-id"}]}`,
+		},
+		{
+			description: "empty optional parameter",
+			method:      http.MethodGet,
+			url:         "/api/module-update-router/v1/event?started_after=",
+			wantCode:    http.StatusOK,
+			wantBody:    `[]`,
+		},
+		{
+			description: "invalid parameters",
+			method:      http.MethodGet,
+			url:         "/api/module-update-router/v1/event?limit=ten&envelope=yes",
+			wantCode:    http.StatusBadRequest,
+			wantBody:    `{"errors":[{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid parameter 'limit': must be an integer","request_id":"test-request-id"},{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid parameter 'envelope': must be 'true' or 'false'","request_id":"test-request-id"}]}`,
+		},
+		{
+			description: "invalid field type",
+			method:      http.MethodPost,
+			url:         "/api/module-update-router/v1/event",
+			body:        `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": "1", "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156"}`,
+			wantCode:    http.StatusBadRequest,
+			wantBody:    `{"errors":[{"status":"Bad Request","code":"invalid_field","title":"Invalid field in request body","detail":"invalid field 'exit': value must be an integer","source":{"pointer":"/exit"},"request_id":"test-request-id"}]}`,
+		},
+		{
+			description: "unsupported content type",
+			method:      http.MethodPost,
+			url:         "/api/module-update-router/v1/admin/modules/insights-core/enrollments",
+			contentType: "text/plain",
+			body:        `{"org_id": "1979710"}`,
+			wantCode:    http.StatusBadRequest,
+			wantBody:    `{"errors":[{"status":"Bad Request","code":"invalid_body","title":"Invalid request body","detail":"cannot decode request body: header Content-Type has unexpected value \"text/plain\"","request_id":"test-request-id"}]}`,
+		},
+		{
+			description: "invalid JSON",
+			method:      http.MethodPost,
+			url:         "/api/module-update-router/v1/admin/modules/insights-core/enrollments",
+			contentType: "application/json",
+			body:        `{"org_id": `,
+			wantCode:    http.StatusBadRequest,
+			wantBody:    `{"errors":[{"status":"Bad Request","code":"invalid_body","title":"Invalid request body","detail":"cannot decode request body: unexpected EOF","request_id":"test-request-id"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, NewMemoryStore(), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			validateResponses(t, srv)
+			defer func() {
+				if err := srv.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}()
+
+			req := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+			req.Header.Set("X-Request-Id", testRequestID)
+			req.Header.Set("X-Rh-Identity", associate)
+			if test.contentType != "" {
+				req.Header.Set("Content-Type", test.contentType)
+			}
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			if rr.Code != test.wantCode {
+				t.Errorf("%v != %v", rr.Code, test.wantCode)
+			}
+			if rr.Body.String() != test.wantBody {
+				t.Errorf("\ngot:  %v\nwant: %v", rr.Body.String(), test.wantBody)
+			}
+		})
+	}
+}
+
+func TestSpecCoverage(t *testing.T) {
+	associate := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`))
+
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, NewMemoryStore(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := srv.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	// Every operation in the spec must be served by a handler, even if the
+	// request is rejected.
+	for p, item := range doc.Paths.Map() {
+		for method := range item.Operations() {
+			url := strings.NewReplacer("{module}", "insights-core", "{org_id}", "1979710").Replace(p)
+			req := httptest.NewRequest(method, "/api/module-update-router/v1"+url, nil)
+			req.Header.Set("X-Rh-Identity", associate)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			if rr.Code == http.StatusMethodNotAllowed || strings.Contains(rr.Body.String(), "no such endpoint") {
+				t.Errorf("%v %v: not served: %v %v", method, p, rr.Code, rr.Body.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// Message is a single record published to a topic. Headers holds metadata
+// about the record, such as the W3C trace context it was created in.
+type Message struct {
+	Key     []byte
+	Value   []byte
+	Headers map[string]string
+}
+
+// Publisher publishes messages to a message broker topic.
+type Publisher interface {
+	// Publish writes messages to the topic, blocking until they have been
+	// acknowledged by the broker or ctx is done.
+	Publish(ctx context.Context, messages ...Message) error
+
+	// Close flushes any pending messages and releases resources held by the
+	// publisher.
+	Close() error
+}
+
+// KafkaConfig holds the connection settings used to create a kafkaPublisher.
+type KafkaConfig struct {
+	Brokers          []string
+	Topic            string
+	CAPath           string
+	SASLMechanism    string
+	SASLUsername     string
+	SASLPassword     string
+	SecurityProtocol string
+}
+
+// kafkaPublisher is a Publisher that writes messages to a Kafka topic.
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaPublisher creates a Publisher that writes messages to the topic and
+// brokers given in cfg. Messages with the same key are written to the same
+// partition.
+func NewKafkaPublisher(cfg KafkaConfig) (Publisher, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, fmt.Errorf("publisher: no brokers configured")
+	}
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("publisher: no topic configured")
+	}
+
+	transport := &kafka.Transport{}
+
+	switch strings.ToUpper(cfg.SecurityProtocol) {
+	case "", "PLAINTEXT", "SASL_PLAINTEXT":
+	case "SSL", "SASL_SSL":
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.CAPath != "" {
+			data, err := os.ReadFile(cfg.CAPath)
+			if err != nil {
+				return nil, fmt.Errorf("publisher: os.ReadFile failed: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("publisher: no certificates found in %v", cfg.CAPath)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLS = tlsConfig
+	default:
+		return nil, fmt.Errorf("publisher: unsupported security protocol: %v", cfg.SecurityProtocol)
+	}
+
+	if cfg.SASLUsername != "" {
+		var mechanism sasl.Mechanism
+		switch strings.ToUpper(cfg.SASLMechanism) {
+		case "PLAIN":
+			mechanism = plain.Mechanism{Username: cfg.SASLUsername, Password: cfg.SASLPassword}
+		case "", "SCRAM-SHA-512":
+			m, err := scram.Mechanism(scram.SHA512, cfg.SASLUsername, cfg.SASLPassword)
+			if err != nil {
+				return nil, fmt.Errorf("publisher: scram.Mechanism failed: %w", err)
+			}
+			mechanism = m
+		case "SCRAM-SHA-256":
+			m, err := scram.Mechanism(scram.SHA256, cfg.SASLUsername, cfg.SASLPassword)
+			if err != nil {
+				return nil, fmt.Errorf("publisher: scram.Mechanism failed: %w", err)
+			}
+			mechanism = m
+		default:
+			return nil, fmt.Errorf("publisher: unsupported SASL mechanism: %v", cfg.SASLMechanism)
+		}
+		transport.SASL = mechanism
+	}
+
+	return &kafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.Topic,
+			Balancer:     &kafka.Hash{},
+			BatchTimeout: 50 * time.Millisecond,
+			RequiredAcks: kafka.RequireOne,
+			Transport:    transport,
+		},
+	}, nil
+}
+
+// Publish writes messages to the configured Kafka topic.
+func (p *kafkaPublisher) Publish(ctx context.Context, messages ...Message) error {
+	msgs := make([]kafka.Message, 0, len(messages))
+	for _, m := range messages {
+		msg := kafka.Message{Key: m.Key, Value: m.Value}
+		for _, k := range slices.Sorted(maps.Keys(m.Headers)) {
+			msg.Headers = append(msg.Headers, kafka.Header{Key: k, Value: []byte(m.Headers[k])})
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := p.writer.WriteMessages(ctx, msgs...); err != nil {
+		return fmt.Errorf("publisher: writer.WriteMessages failed: %w", err)
+	}
+	return nil
+}
+
+// Close flushes pending messages and closes the connections to the brokers.
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
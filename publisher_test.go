@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// fakePublisher is an in-process Publisher that records published messages
+// instead of sending them to a broker.
+type fakePublisher struct {
+	mu       sync.Mutex
+	messages []Message
+	err      error
+	closed   bool
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, messages ...Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.messages = append(p.messages, messages...)
+	return nil
+}
+
+func (p *fakePublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+// Messages returns a copy of all messages published so far.
+func (p *fakePublisher) Messages() []Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Message(nil), p.messages...)
+}
+
+func TestNewKafkaPublisher(t *testing.T) {
+	tests := []struct {
+		description string
+		input       KafkaConfig
+		wantError   bool
+	}{
+		{
+			description: "plaintext",
+			input:       KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "client-metrics"},
+		},
+		{
+			description: "SASL_SSL with SCRAM",
+			input:       KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "client-metrics", SecurityProtocol: "SASL_SSL", SASLMechanism: "SCRAM-SHA-512", SASLUsername: "user", SASLPassword: "pass"},
+		},
+		{
+			description: "no brokers",
+			input:       KafkaConfig{Topic: "client-metrics"},
+			wantError:   true,
+		},
+		{
+			description: "no topic",
+			input:       KafkaConfig{Brokers: []string{"localhost:9092"}},
+			wantError:   true,
+		},
+		{
+			description: "unsupported security protocol",
+			input:       KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "client-metrics", SecurityProtocol: "KERBEROS"},
+			wantError:   true,
+		},
+		{
+			description: "unsupported SASL mechanism",
+			input:       KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "client-metrics", SASLMechanism: "GSSAPI", SASLUsername: "user"},
+			wantError:   true,
+		},
+		{
+			description: "missing CA file",
+			input:       KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "client-metrics", SecurityProtocol: "SSL", CAPath: "/nonexistent/ca.pem"},
+			wantError:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			p, err := NewKafkaPublisher(test.input)
+			if test.wantError {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Close(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestEventQueuePublish(t *testing.T) {
+	tests := []struct {
+		description string
+		input       error
+		written     bool
+		want        int
+	}{
+		{
+			description: "published",
+			input:       nil,
+			want:        1,
+		},
+		{
+			description: "publish error",
+			input:       errors.New("broker unavailable"),
+			want:        0,
+		},
+		{
+			description: "write error",
+			input:       nil,
+			written:     true,
+			want:        0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			db, err := Open("sqlite", "file::memory:?cache=shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeDB(db, t)
+			if err := db.Migrate(context.Background(), false); err != nil {
+				t.Fatal(err)
+			}
+
+			e := event{eventID: "af3b8e13-6b65-45d8-8310-a45e0821bd62", machineID: "a9ab0a44-1241-43ae-9c02-1850acf0c36c"}
+			if test.written {
+				// Writing the event again fails on its primary key.
+				if err := db.InsertEventBatch(context.Background(), []event{e}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p := &fakePublisher{err: test.input}
+			q := newEventQueue(db, p, 1, 1, 1, 0)
+			if !q.enqueue(e) {
+				t.Fatal("enqueue failed")
+			}
+			q.close()
+
+			if got := len(p.Messages()); got != test.want {
+				t.Errorf("%v != %v", got, test.want)
+			}
+
+			events, err := db.GetEvents(context.Background(), EventFilter{}, -1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 1 {
+				t.Errorf("wrote %v events, want 1", len(events))
+			}
+		})
+	}
+}
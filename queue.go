@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// publishTimeout is the maximum time spent publishing a single batch of events.
+const publishTimeout = 30 * time.Second
+
+// eventQueue is a bounded, in-memory buffer of events waiting to be written to
+// the database. Events are drained by a pool of writer goroutines that insert
+// them in batches and then publish them, if a publisher is configured.
+type eventQueue struct {
+	db            Store
+	publisher     Publisher
+	events        chan event
+	batchSize     int
+	flushInterval time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+
+	// drained ensures the queue is drained once, and that every call to
+	// close waits for it.
+	drained sync.Once
+}
+
+// newEventQueue creates an eventQueue that buffers up to size events and starts
+// workers writer goroutines, at least one. Each writer inserts up to batchSize
+// events at a time, flushing a partial batch after flushInterval has elapsed.
+// publisher may be nil, in which case events are only written to db.
+func newEventQueue(db Store, publisher Publisher, size, workers, batchSize int, flushInterval time.Duration) *eventQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	q := &eventQueue{
+		db:            db,
+		publisher:     publisher,
+		events:        make(chan event, size),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work(i)
+	}
+	return q
+}
+
+// enqueue adds e to the queue without blocking. It returns false if the queue
+// is full or has been closed, in which case e is dropped.
+func (q *eventQueue) enqueue(e event) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		incEventsDropped("closed")
+		return false
+	}
+
+	select {
+	case q.events <- e:
+		setEventQueueDepth(len(q.events))
+		return true
+	default:
+		incEventsDropped("queue_full")
+		return false
+	}
+}
+
+// close stops accepting new events, waits for the writers to drain the queue
+// and flushes anything left over so that no accepted event is lost. It is safe
+// to call more than once; every call returns once the queue is drained.
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+
+	q.drained.Do(q.drain)
+}
+
+// drain waits for the writers to exit and writes the events left in the
+// closed queue.
+func (q *eventQueue) drain() {
+	q.wg.Wait()
+
+	batch := make([]event, 0, q.batchSize)
+	for e := range q.events {
+		batch = append(batch, e)
+		if len(batch) == q.batchSize {
+			q.write(batch)
+			batch = batch[:0]
+		}
+	}
+	q.write(batch)
+}
+
+// work reads events from the queue, writing them in batches of up to
+// q.batchSize. A partial batch is written once q.flushInterval elapses. work
+// returns once the queue is closed and empty.
+func (q *eventQueue) work(id int) {
+	defer q.wg.Done()
+
+	logger := log.WithFields(log.Fields{
+		"routine": "event-writer",
+		"worker":  id,
+	})
+	logger.Debug("started event writer")
+
+	ticker := time.NewTicker(q.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]event, 0, q.batchSize)
+	for {
+		select {
+		case e, ok := <-q.events:
+			if !ok {
+				q.write(batch)
+				logger.Debug("stopped event writer")
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) == q.batchSize {
+				q.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			q.write(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// write inserts batch into the database and then publishes the events that
+// were written. If the batch cannot be inserted, its events are retried one at
+// a time, so that a single bad event does not cause the others to be lost;
+// events that still fail are logged and counted as dropped, and are not
+// published. Both are traced in a new span, linked to the spans of the
+// requests that created the events.
+func (q *eventQueue) write(batch []event) {
+	setEventQueueDepth(len(q.events))
+	if len(batch) == 0 {
+		return
+	}
+
+	links := make([]trace.Link, 0, len(batch))
+	for _, e := range batch {
+		if e.spanContext.IsValid() {
+			links = append(links, trace.Link{SpanContext: e.spanContext})
+		}
+	}
+	ctx, span := tracer().Start(context.Background(), "write events",
+		trace.WithLinks(links...),
+		trace.WithAttributes(attribute.Int("event.count", len(batch))))
+	defer span.End()
+
+	if err := q.db.InsertEventBatch(ctx, batch); err != nil {
+		log.WithError(err).WithField("count", len(batch)).Warn("cannot write events, retrying one at a time")
+		recordError(span, err)
+		batch = q.writeEach(ctx, batch)
+	} else {
+		addEventsWritten(len(batch))
+	}
+	if len(batch) == 0 {
+		return
+	}
+	q.publish(ctx, batch)
+}
+
+// writeEach inserts each event in batch on its own, logging and counting those
+// that fail as dropped. It returns the events that were written.
+func (q *eventQueue) writeEach(ctx context.Context, batch []event) []event {
+	written := make([]event, 0, len(batch))
+	for _, e := range batch {
+		if err := q.db.InsertEventBatch(ctx, []event{e}); err != nil {
+			log.WithError(err).WithField("event_id", e.eventID).Error("cannot write event")
+			incEventsDropped("write_error")
+			continue
+		}
+		addEventsWritten(1)
+		written = append(written, e)
+	}
+	return written
+}
+
+// publish sends batch to the publisher, in a span that is a child of the one in
+// ctx. Failures are logged and counted but otherwise ignored; the events table
+// remains the system of record.
+func (q *eventQueue) publish(ctx context.Context, batch []event) {
+	if q.publisher == nil {
+		return
+	}
+
+	messages := make([]Message, 0, len(batch))
+	for _, e := range batch {
+		m, err := e.message()
+		if err != nil {
+			log.WithError(err).WithField("event_id", e.eventID).Error("cannot encode event")
+			incEventPublishErrors()
+			continue
+		}
+		messages = append(messages, m)
+	}
+
+	ctx, span := tracer().Start(ctx, "publish events",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(semconv.MessagingBatchMessageCount(len(messages))))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	if err := q.publisher.Publish(ctx, messages...); err != nil {
+		log.WithError(err).WithField("count", len(messages)).Error("cannot publish events")
+		addEventPublishErrors(len(messages))
+		recordError(span, err)
+		return
+	}
+	addEventsPublished(len(messages))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// newIdleEventQueue creates an eventQueue without writer goroutines, so that
+// events stay queued until it is closed.
+func newIdleEventQueue(db Store, publisher Publisher, size, batchSize int, flushInterval time.Duration) *eventQueue {
+	return &eventQueue{
+		db:            db,
+		publisher:     publisher,
+		events:        make(chan event, size),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+}
+
+func TestEventQueue(t *testing.T) {
+	tests := []struct {
+		description string
+		input       struct {
+			size, workers, batchSize, count int
+		}
+		wantAccepted int
+	}{
+		{
+			description: "one worker, partial batch",
+			input: struct{ size, workers, batchSize, count int }{
+				size: 10, workers: 1, batchSize: 4, count: 5,
+			},
+			wantAccepted: 5,
+		},
+		{
+			description: "no workers, flushed on close",
+			input: struct{ size, workers, batchSize, count int }{
+				size: 3, workers: 0, batchSize: 2, count: 3,
+			},
+			wantAccepted: 3,
+		},
+		{
+			description: "no workers, buffer full",
+			input: struct{ size, workers, batchSize, count int }{
+				size: 2, workers: 0, batchSize: 10, count: 5,
+			},
+			wantAccepted: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			db, err := Open("sqlite", "file::memory:?cache=shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeDB(db, t)
+			if err := db.Migrate(context.Background(), false); err != nil {
+				t.Fatal(err)
+			}
+
+			var q *eventQueue
+			if test.input.workers > 0 {
+				q = newEventQueue(db, nil, test.input.size, test.input.workers, test.input.batchSize, time.Hour)
+			} else {
+				q = newIdleEventQueue(db, nil, test.input.size, test.input.batchSize, time.Hour)
+			}
+
+			var accepted int
+			for i := 0; i < test.input.count; i++ {
+				e := event{
+					eventID:     fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+					phase:       "pre_update",
+					startedAt:   time.Date(2020, time.July, 15, 17, 16, i, 0, time.UTC),
+					endedAt:     time.Date(2020, time.July, 15, 17, 17, i, 0, time.UTC),
+					machineID:   "a9ab0a44-1241-43ae-9c02-1850acf0c36c",
+					coreVersion: "3.0.156",
+				}
+				if q.enqueue(e) {
+					accepted++
+				}
+			}
+			q.close()
+
+			if accepted != test.wantAccepted {
+				t.Errorf("accepted %v != %v", accepted, test.wantAccepted)
+			}
+			if q.enqueue(event{}) {
+				t.Error("enqueue succeeded after close")
+			}
+
+			got, err := db.GetEvents(context.Background(), EventFilter{}, -1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != test.wantAccepted {
+				t.Errorf("wrote %v events, want %v", len(got), test.wantAccepted)
+			}
+		})
+	}
+}
+
+func TestEventQueueWorkers(t *testing.T) {
+	for _, workers := range []int{0, -1} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			db, err := Open("sqlite", "file::memory:?cache=shared")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeDB(db, t)
+			if err := db.Migrate(context.Background(), false); err != nil {
+				t.Fatal(err)
+			}
+
+			q := newEventQueue(db, nil, 1, workers, 1, time.Hour)
+			defer q.close()
+			if !q.enqueue(event{eventID: "af3b8e13-6b65-45d8-8310-a45e0821bd62", machineID: "a9ab0a44-1241-43ae-9c02-1850acf0c36c"}) {
+				t.Fatal("enqueue failed")
+			}
+
+			// The event must be written before the queue is closed.
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				got, err := db.GetEvents(context.Background(), EventFilter{}, -1, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) == 1 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("event not written by a writer")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestEventQueueWriteRetry(t *testing.T) {
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB(db, t)
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make([]event, 3)
+	for i := range events {
+		events[i] = event{
+			eventID:     fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			phase:       "pre_update",
+			startedAt:   time.Date(2020, time.July, 15, 17, 16, i, 0, time.UTC),
+			endedAt:     time.Date(2020, time.July, 15, 17, 17, i, 0, time.UTC),
+			machineID:   fmt.Sprintf("00000000-0000-0000-0000-%012d", i),
+			coreVersion: "3.0.156",
+		}
+	}
+	// Writing the second event again fails on its primary key, which fails
+	// the batch holding it.
+	if err := db.InsertEventBatch(context.Background(), events[1:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fakePublisher{}
+	q := newEventQueue(db, p, len(events), 1, len(events), time.Hour)
+	for _, e := range events {
+		if !q.enqueue(e) {
+			t.Fatal("enqueue failed")
+		}
+	}
+	q.close()
+
+	got, err := db.GetEvents(context.Background(), EventFilter{}, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(events) {
+		t.Errorf("stored %v events, want %v", len(got), len(events))
+	}
+
+	var published []string
+	for _, m := range p.Messages() {
+		published = append(published, string(m.Key))
+	}
+	if want := []string{events[0].machineID, events[2].machineID}; !cmp.Equal(published, want) {
+		t.Errorf("%v", cmp.Diff(published, want))
+	}
+}
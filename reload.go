@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// seedStatus describes the seed file most recently loaded into the database,
+// and the most recent failure to load it, if any.
+type seedStatus struct {
+	Path     string     `json:"path"`
+	Checksum string     `json:"checksum,omitempty"`
+	LoadedAt *time.Time `json:"loaded_at,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	FailedAt *time.Time `json:"failed_at,omitempty"`
+}
+
+// seedLoader loads the seed file at path into db, and reloads it whenever its
+// contents change. A seed file that fails to load leaves the database as it
+// was, so the previously loaded seed remains in effect.
+type seedLoader struct {
+	db   *DB
+	path string
+
+	mu             sync.RWMutex
+	status         seedStatus
+	failedChecksum string
+}
+
+// newSeedLoader creates a seedLoader for the seed file at path.
+func newSeedLoader(db *DB, path string) *seedLoader {
+	return &seedLoader{
+		db:     db,
+		path:   path,
+		status: seedStatus{Path: path},
+	}
+}
+
+// Status returns the current status of the loader.
+func (l *seedLoader) Status() seedStatus {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.status
+}
+
+// errSeedNotReloadable is returned when reloading a raw SQL seed file, which
+// cannot be applied atomically nor run twice.
+var errSeedNotReloadable = errors.New("seed: raw SQL seed files are only loaded at startup; use a YAML or JSON seed file to reload it")
+
+// reloadable reports whether the seed file can be reloaded once loaded. Only
+// YAML and JSON seed files can, since they are applied in a single transaction
+// that leaves the database as it was if it fails.
+func (l *seedLoader) reloadable() bool {
+	return isStructuredSeed(l.path)
+}
+
+// load applies the seed file to the database if its checksum differs from the
+// one last loaded, or unconditionally if force is true. A file that failed to
+// load is not retried until its contents change, unless force is true. A raw
+// SQL seed file is only loaded once; later loads return errSeedNotReloadable.
+func (l *seedLoader) load(ctx context.Context, force bool) error {
+	l.mu.RLock()
+	loaded := l.status.LoadedAt != nil
+	l.mu.RUnlock()
+	if loaded && !l.reloadable() {
+		return errSeedNotReloadable
+	}
+
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		err = fmt.Errorf("seed: os.ReadFile failed: %w", err)
+		l.fail("", err)
+		return err
+	}
+	sum := sha256.Sum256(data)
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+
+	l.mu.RLock()
+	unchanged := checksum == l.status.Checksum || checksum == l.failedChecksum
+	l.mu.RUnlock()
+	if unchanged && !force {
+		return nil
+	}
+
+	if err := l.db.seed(ctx, l.path, data); err != nil {
+		l.fail(checksum, err)
+		return err
+	}
+
+	now := time.Now().UTC()
+	l.mu.Lock()
+	l.status = seedStatus{Path: l.path, Checksum: checksum, LoadedAt: &now}
+	l.failedChecksum = ""
+	l.mu.Unlock()
+
+	setSeedLoaded(checksum, now)
+	incSeedLoads("success")
+	log.WithFields(log.Fields{"path": l.path, "checksum": checksum}).Info("loaded seed file")
+	return nil
+}
+
+// fail records err as the most recent failure to load the seed file with the
+// given checksum.
+func (l *seedLoader) fail(checksum string, err error) {
+	now := time.Now().UTC()
+	l.mu.Lock()
+	l.status.Error = err.Error()
+	l.status.FailedAt = &now
+	l.failedChecksum = checksum
+	l.mu.Unlock()
+
+	incSeedLoads("failure")
+}
+
+// watch reloads the seed file whenever its contents change, checking every
+// interval, and whenever a value is received on reload, until ctx is done. If
+// interval is not positive, the file is only reloaded on request.
+func (l *seedLoader) watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	logger := log.WithFields(log.Fields{
+		"routine": "seed-loader",
+		"path":    l.path,
+	})
+	logger.Debug("started seed loader")
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			logger.Debug("stopped seed loader")
+			return
+		case <-tick:
+			err = l.load(ctx, false)
+		case <-reload:
+			logger.Info("reloading seed file")
+			err = l.load(ctx, true)
+		}
+		if err != nil {
+			logger.WithError(err).Error("cannot load seed file; keeping the previous seed")
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSeedLoader(t *testing.T) {
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB(db, t)
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "seed.yaml")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantChannels := func(want map[string]string) {
+		t.Helper()
+		for orgID, want := range want {
+			got, err := db.Route(context.Background(), "insights-core", orgID, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("org %v: %v != %v", orgID, got, want)
+			}
+		}
+	}
+
+	loader := newSeedLoader(db, path)
+
+	write(`{"modules": [{"name": "insights-core"}], "enrollments": [{"module": "insights-core", "channel": "beta", "orgs": ["1"]}]}`)
+	if err := loader.load(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	wantChannels(map[string]string{"1": "beta", "2": "release"})
+	loaded := loader.Status()
+	if loaded.Checksum == "" || loaded.LoadedAt == nil || loaded.Error != "" {
+		t.Fatalf("unexpected status: %+v", loaded)
+	}
+	if got := testutil.ToFloat64(seedInfo.WithLabelValues(loaded.Checksum)); got != 1 {
+		t.Errorf("seed info: %v != 1", got)
+	}
+
+	failures := testutil.ToFloat64(seedLoads.WithLabelValues("failure"))
+	write(`{"modules": [{"name": "insights-core"}], "enrollments": [{"module": "insights-core", "orgs": ["1", "not-an-org"]}]}`)
+	if err := loader.load(context.Background(), false); err == nil {
+		t.Fatal("loaded an invalid seed file")
+	}
+	if err := loader.load(context.Background(), false); err != nil {
+		t.Fatalf("retried an unchanged invalid seed file: %v", err)
+	}
+	wantChannels(map[string]string{"1": "beta", "2": "release"})
+	failed := loader.Status()
+	if failed.Checksum != loaded.Checksum || failed.Error == "" || failed.FailedAt == nil {
+		t.Errorf("unexpected status: %+v", failed)
+	}
+	if got := testutil.ToFloat64(seedLoads.WithLabelValues("failure")) - failures; got != 1 {
+		t.Errorf("failures: %v != 1", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan os.Signal, 1)
+	go loader.watch(ctx, 0, reload)
+
+	write(`{"modules": [{"name": "insights-core"}], "enrollments": [{"module": "insights-core", "channel": "beta", "orgs": ["2"]}]}`)
+	reload <- syscall.SIGHUP
+	deadline := time.Now().Add(5 * time.Second)
+	for loader.Status().Checksum == loaded.Checksum {
+		if time.Now().After(deadline) {
+			t.Fatal("seed file was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	wantChannels(map[string]string{"1": "release", "2": "beta"})
+	if status := loader.Status(); status.Error != "" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestSeedLoaderSQL(t *testing.T) {
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB(db, t)
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "seed.sql")
+	if err := os.WriteFile(path, []byte(`INSERT INTO channels (module_name, channel_name, is_default) VALUES ('insights-core-sql', 'stable', TRUE);`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loader := newSeedLoader(db, path)
+	if loader.reloadable() {
+		t.Error("raw SQL seed file is reloadable")
+	}
+	if err := loader.load(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+	loaded := loader.Status()
+
+	if err := os.WriteFile(path, []byte(`DELETE FROM channels WHERE module_name = 'insights-core-sql';`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, force := range []bool{false, true} {
+		if err := loader.load(context.Background(), force); !errors.Is(err, errSeedNotReloadable) {
+			t.Errorf("force %v: %v != %v", force, err, errSeedNotReloadable)
+		}
+	}
+	channel, err := db.Route(context.Background(), "insights-core-sql", "1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel != "stable" {
+		t.Errorf("%v != %v", channel, "stable")
+	}
+	if status := loader.Status(); status.Checksum != loaded.Checksum {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestAdminSeed(t *testing.T) {
+	associate := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "type": "Associate", "associate": { "email": "jdoe@redhat.com" } } }`))
+
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "seed.yaml")
+	if err := os.WriteFile(path, []byte(`modules: []`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loader := newSeedLoader(db, path)
+	if err := loader.load(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateResponses(t, srv)
+	defer func() {
+		if err := srv.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	tests := []struct {
+		description string
+		seed        *seedLoader
+		wantCode    int
+	}{
+		{"no seed file", nil, http.StatusNotFound},
+		{"seed file", loader, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			srv.seed = test.seed
+
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/admin/seed", nil)
+			req.Header.Add("X-Rh-Identity", associate)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			if rr.Code != test.wantCode {
+				t.Fatalf("%v != %v: %v", rr.Code, test.wantCode, rr.Body.String())
+			}
+			if test.seed == nil {
+				return
+			}
+
+			var got seedStatus
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			want := test.seed.Status()
+			if got.Path != want.Path || got.Checksum != want.Checksum || !got.LoadedAt.Equal(*want.LoadedAt) {
+				t.Errorf("%+v != %+v", got, want)
+			}
+		})
+	}
+}
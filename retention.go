@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pruneEvents deletes events older than retention from store every interval
+// until ctx is done. If retention or interval is not positive, events are never
+// deleted.
+func pruneEvents(ctx context.Context, store Store, interval, retention time.Duration) {
+	if retention <= 0 || interval <= 0 {
+		return
+	}
+
+	logger := log.WithField("routine", "event-pruner")
+	logger.Debug("started event pruner")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := pruneEventsOnce(ctx, store, time.Now().Add(-retention)); err != nil {
+			logger.WithError(err).Error("cannot prune events")
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Debug("stopped event pruner")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pruneEventsOnce deletes events that started before older, logging and
+// counting the number deleted.
+func pruneEventsOnce(ctx context.Context, store Store, older time.Time) (int64, error) {
+	deleted, err := store.DeleteEvents(ctx, older)
+	if err != nil {
+		return 0, err
+	}
+
+	log.WithFields(log.Fields{
+		"older_than": older.UTC().Format(time.RFC3339),
+		"count":      deleted,
+	}).Info("pruned events")
+	addEventsPruned(deleted)
+	return deleted, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newRetentionStore creates a MemoryStore holding one event started on each of
+// the given days.
+func newRetentionStore(t *testing.T, days ...time.Time) *MemoryStore {
+	store := NewMemoryStore()
+	events := make([]event, 0, len(days))
+	for _, day := range days {
+		events = append(events, event{
+			eventID:     day.Format(time.DateOnly),
+			phase:       "pre_update",
+			startedAt:   day,
+			endedAt:     day.Add(time.Minute),
+			machineID:   "60654767-dfba-47af-8bca-cb2d1d01d9a6",
+			coreVersion: "3.0.156",
+		})
+	}
+	if err := store.InsertEventBatch(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestPruneEventsOnce(t *testing.T) {
+	now := time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC)
+	store := newRetentionStore(t, now.AddDate(0, 0, -100), now.AddDate(0, 0, -91), now.AddDate(0, 0, -89), now)
+
+	before := testutil.ToFloat64(eventsPruned)
+	got, err := pruneEventsOnce(context.Background(), store, now.AddDate(0, 0, -90))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 2 {
+		t.Errorf("%v != %v", got, 2)
+	}
+	if pruned := testutil.ToFloat64(eventsPruned) - before; pruned != 2 {
+		t.Errorf("%v != %v", pruned, 2)
+	}
+
+	events, err := store.GetEvents(context.Background(), EventFilter{}, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("%v events remain, want 2", len(events))
+	}
+}
+
+func TestAdminPruneEvents(t *testing.T) {
+	associate := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "type": "Associate", "associate": { "email": "jdoe@redhat.com" } } }`))
+	user := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))
+
+	tests := []struct {
+		description   string
+		url           string
+		identity      string
+		retention     time.Duration
+		wantCode      int
+		wantBody      string
+		wantRemaining int
+	}{
+		{
+			description:   "not an associate",
+			url:           "/api/module-update-router/v1/admin/events/prune",
+			identity:      user,
+			retention:     24 * time.Hour,
+			wantCode:      http.StatusUnauthorized,
+			wantRemaining: 3,
+		},
+		{
+			description:   "dry run",
+			url:           "/api/module-update-router/v1/admin/events/prune?dry_run=true&older_than=2020-07-01T00:00:00Z",
+			identity:      associate,
+			retention:     24 * time.Hour,
+			wantCode:      http.StatusOK,
+			wantBody:      `{"older_than":"2020-07-01T00:00:00Z","dry_run":true,"count":2}`,
+			wantRemaining: 3,
+		},
+		{
+			description:   "prune older than",
+			url:           "/api/module-update-router/v1/admin/events/prune?older_than=2020-07-01T00:00:00Z",
+			identity:      associate,
+			retention:     24 * time.Hour,
+			wantCode:      http.StatusOK,
+			wantBody:      `{"older_than":"2020-07-01T00:00:00Z","dry_run":false,"count":2}`,
+			wantRemaining: 1,
+		},
+		{
+			description:   "prune with retention period",
+			url:           "/api/module-update-router/v1/admin/events/prune",
+			identity:      associate,
+			retention:     24 * time.Hour,
+			wantCode:      http.StatusOK,
+			wantRemaining: 0,
+		},
+		{
+			description:   "retention disabled",
+			url:           "/api/module-update-router/v1/admin/events/prune",
+			identity:      associate,
+			wantCode:      http.StatusBadRequest,
+			wantBody:      `{"errors":[{"status":"Bad Request","code":"missing_parameter","title":"Missing required parameter","detail":"missing required parameter: 'older_than': event retention is disabled","request_id":"test-request-id"}]}`,
+			wantRemaining: 3,
+		},
+		{
+			description:   "invalid dry_run",
+			url:           "/api/module-update-router/v1/admin/events/prune?dry_run=maybe",
+			identity:      associate,
+			retention:     24 * time.Hour,
+			wantCode:      http.StatusBadRequest,
+			wantBody:      `{"errors":[{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid parameter 'dry_run': must be 'true' or 'false'","request_id":"test-request-id"}]}`,
+			wantRemaining: 3,
+		},
+		{
+			description:   "invalid older_than",
+			url:           "/api/module-update-router/v1/admin/events/prune?older_than=2020-07-01",
+			identity:      associate,
+			retention:     24 * time.Hour,
+			wantCode:      http.StatusBadRequest,
+			wantBody:      `{"errors":[{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid parameter 'older_than': must be RFC 3339 formatted","request_id":"test-request-id"}]}`,
+			wantRemaining: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			store := newRetentionStore(t,
+				time.Date(2020, time.June, 19, 11, 18, 3, 0, time.UTC),
+				time.Date(2020, time.June, 20, 11, 18, 3, 0, time.UTC),
+				time.Date(2020, time.July, 21, 13, 1, 4, 0, time.UTC))
+			srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, store, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			validateResponses(t, srv)
+			defer func() {
+				if err := srv.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}()
+			srv.eventRetention = test.retention
+
+			req := httptest.NewRequest(http.MethodPost, test.url, nil)
+			req.Header.Set("X-Request-Id", testRequestID)
+			req.Header.Add("X-Rh-Identity", test.identity)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			if rr.Code != test.wantCode {
+				t.Fatalf("%v != %v: %v", rr.Code, test.wantCode, rr.Body.String())
+			}
+			if test.wantBody != "" && rr.Body.String() != test.wantBody {
+				t.Errorf("\ngot:  %v\nwant: %v", rr.Body.String(), test.wantBody)
+			}
+
+			events, err := store.GetEvents(context.Background(), EventFilter{}, -1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != test.wantRemaining {
+				t.Errorf("%v events remain, want %v", len(events), test.wantRemaining)
+			}
+		})
+	}
+}
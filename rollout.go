@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// rolloutBuckets is the number of buckets orgs are hashed into. Each bucket
+// represents one percent of all orgs.
+const rolloutBuckets = 100
+
+// Rollout describes a staged rollout of a module's channel to a percentage of
+// all orgs.
+type Rollout struct {
+	ModuleName string `db:"module_name" json:"module_name"`
+	Channel    string `db:"channel" json:"channel"`
+	Percentage int    `db:"percentage" json:"percentage"`
+	Salt       string `db:"salt" json:"salt"`
+}
+
+// Includes reports whether orgID falls within the rollout. An org is included
+// when its bucket is less than the rollout percentage, so the same org is
+// always either in or out for a given salt, and raising the percentage only
+// ever adds orgs.
+func (r Rollout) Includes(orgID string) bool {
+	salt := r.Salt
+	if salt == "" {
+		salt = r.ModuleName
+	}
+	return rolloutBucket(salt, orgID) < r.Percentage
+}
+
+// rolloutBucket deterministically hashes orgID, salted with salt, into one of
+// rolloutBuckets buckets.
+func rolloutBucket(salt, orgID string) int {
+	sum := sha256.Sum256([]byte(salt + "\x00" + orgID))
+	return int(binary.BigEndian.Uint64(sum[:8]) % rolloutBuckets)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRolloutIncludes(t *testing.T) {
+	tests := []struct {
+		description string
+		input       Rollout
+		wantMin     int
+		wantMax     int
+	}{
+		{
+			description: "0 percent",
+			input:       Rollout{ModuleName: "insights-core", Percentage: 0},
+			wantMin:     0,
+			wantMax:     0,
+		},
+		{
+			description: "5 percent",
+			input:       Rollout{ModuleName: "insights-core", Percentage: 5},
+			wantMin:     400,
+			wantMax:     600,
+		},
+		{
+			description: "50 percent",
+			input:       Rollout{ModuleName: "insights-core", Percentage: 50},
+			wantMin:     4700,
+			wantMax:     5300,
+		},
+		{
+			description: "100 percent",
+			input:       Rollout{ModuleName: "insights-core", Percentage: 100},
+			wantMin:     10000,
+			wantMax:     10000,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var got int
+			for i := 0; i < 10000; i++ {
+				if test.input.Includes(strconv.Itoa(1000000 + i)) {
+					got++
+				}
+			}
+			if got < test.wantMin || got > test.wantMax {
+				t.Errorf("%v orgs included, want between %v and %v", got, test.wantMin, test.wantMax)
+			}
+		})
+	}
+}
+
+func TestRolloutIncludesMonotonic(t *testing.T) {
+	for i := 0; i < 10000; i++ {
+		orgID := strconv.Itoa(1000000 + i)
+		included := false
+		for _, percentage := range []int{5, 25, 50, 100} {
+			r := Rollout{ModuleName: "insights-core", Percentage: percentage}
+			if included && !r.Includes(orgID) {
+				t.Fatalf("org %v removed when raising rollout to %v%%", orgID, percentage)
+			}
+			included = r.Includes(orgID)
+		}
+	}
+}
+
+func TestRolloutBucketSalt(t *testing.T) {
+	var same int
+	for i := 0; i < 1000; i++ {
+		orgID := strconv.Itoa(1000000 + i)
+		if rolloutBucket("insights-core", orgID) != rolloutBucket("insights-core", orgID) {
+			t.Fatalf("bucket for org %v is not deterministic", orgID)
+		}
+		if rolloutBucket("insights-core", orgID) == rolloutBucket("other-module", orgID) {
+			same++
+		}
+	}
+	if same > 50 {
+		t.Errorf("%v of 1000 orgs share a bucket across salts", same)
+	}
+}
@@ -4,13 +4,17 @@ import (
 	"context"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redhatinsights/module-update-router/internal/config"
 	"github.com/redhatinsights/platform-go-middlewares/v2/identity"
 
 	log "github.com/sirupsen/logrus"
@@ -20,6 +24,7 @@ import (
 	"github.com/slok/go-http-metrics/middleware/std"
 
 	request "github.com/redhatinsights/platform-go-middlewares/v2/request_id"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //go:embed openapi.json
@@ -28,52 +33,172 @@ var openAPISpec []byte
 var r metrics.Recorder = httpmetrics.NewRecorder(httpmetrics.Config{})
 
 // Server is the application's HTTP server. It is comprised of an HTTP
-// multiplexer for routing HTTP requests to appropriate handlers and a database
-// handle for looking up application data.
+// multiplexer for routing HTTP requests to appropriate handlers, a store for
+// looking up application data, a publisher for forwarding events,
+// a queue of events waiting to be written and published, the loader of the
+// seed file, the retention period of events and the listeners serving the
+// application and its metrics.
 type Server struct {
-	mux  *http.ServeMux
-	db   *DB
-	addr string
+	mux       *http.ServeMux
+	db        Store
+	publisher Publisher
+	events    *eventQueue
+	seed      *seedLoader
+
+	// eventRetention is the age after which events are pruned, or 0 if they
+	// are kept forever.
+	eventRetention time.Duration
+
+	httpServer    *http.Server
+	metricsServer *http.Server
+
+	// spec validates requests under the API roots against openapi.json.
+	spec *specValidator
+
+	// readiness holds the checks run by /ready.
+	readiness []readinessCheck
+
+	// draining is set once Shutdown is called, to fail readiness checks.
+	draining atomic.Bool
+
+	// shutdownDelay is how long Shutdown keeps serving requests after
+	// failing readiness checks, so that load balancers can stop routing
+	// requests to s.
+	shutdownDelay time.Duration
 }
 
 // NewServer creates a new instance of the application, configured with the
-// provided addr, API roots and database handle.
-func NewServer(addr string, apiroots []string, db *DB) (*Server, error) {
+// provided addr, API roots, store, publisher and seed loader.
+// publisher may be nil, in which case events are not published. seed may be
+// nil if no seed file is configured. The event queue, the retention period of
+// events, the HTTP timeouts, the shutdown delay and the metrics listener are
+// configured according to config.DefaultConfig.
+func NewServer(addr string, apiroots []string, db Store, publisher Publisher, seed *seedLoader) (*Server, error) {
+	spec, err := newSpecValidator(openAPISpec, apiroots)
+	if err != nil {
+		return nil, err
+	}
+
 	srv := &Server{
-		mux:  &http.ServeMux{},
-		db:   db,
-		addr: addr,
+		mux:       &http.ServeMux{},
+		db:        db,
+		publisher: publisher,
+		seed:      seed,
+		spec:      spec,
+		events: newEventQueue(db, publisher,
+			config.DefaultConfig.EventBuffer,
+			config.DefaultConfig.EventWorkers,
+			config.DefaultConfig.EventBatchSize,
+			config.DefaultConfig.EventFlushInterval),
+		eventRetention: config.DefaultConfig.EventRetention,
+		shutdownDelay:  config.DefaultConfig.ShutdownDelay,
+	}
+	srv.httpServer = &http.Server{
+		Addr:              addr,
+		Handler:           srv,
+		ReadHeaderTimeout: config.DefaultConfig.HTTPReadHeaderTimeout,
+		ReadTimeout:       config.DefaultConfig.HTTPReadTimeout,
+		WriteTimeout:      config.DefaultConfig.HTTPWriteTimeout,
+		IdleTimeout:       config.DefaultConfig.HTTPIdleTimeout,
+	}
+	srv.metricsServer = &http.Server{
+		Addr:              config.DefaultConfig.MAddr,
+		Handler:           promhttp.Handler(),
+		ReadHeaderTimeout: config.DefaultConfig.HTTPReadHeaderTimeout,
+	}
+	srv.addReadinessCheck("shutdown", srv.checkShutdown)
+	if seed != nil {
+		srv.addReadinessCheck("seed", srv.checkSeed)
 	}
 	srv.routes(apiroots...)
 	return srv, nil
 }
 
-func (s Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.mux.ServeHTTP(w, r)
 }
 
-// ListenAndServe simply calls http.ListenAndServe with the configured TCP
-// address and s as the handler.
-func (s Server) ListenAndServe() error {
-	return http.ListenAndServe(s.addr, s)
+// ListenAndServe listens on the configured TCP address and serves requests
+// with s. It returns nil once Shutdown or Close is called.
+func (s *Server) ListenAndServe() error {
+	if err := s.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// ListenAndServeMetrics listens on the configured metrics address and serves
+// Prometheus metrics. It returns nil once Shutdown or Close is called.
+func (s *Server) ListenAndServeMetrics() error {
+	if err := s.metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown gracefully stops s. It first fails the readiness check and keeps
+// serving for the shutdown delay, so that load balancers stop routing requests
+// to s. It then closes the application and metrics listeners, waits for
+// in-flight requests to complete and flushes the event queue. If ctx is done
+// first, Shutdown returns the context's error, and Close finishes the flush.
+// Either way, Close must be called afterwards to release the publisher and
+// the store.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+
+	delay := time.NewTimer(s.shutdownDelay)
+	defer delay.Stop()
+	select {
+	case <-delay.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := errors.Join(s.httpServer.Shutdown(ctx), s.metricsServer.Shutdown(ctx)); err != nil {
+		return err
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		s.events.close()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("cannot flush event queue: %w", ctx.Err())
+	}
 }
 
-// Close closes the database handle.
+// Close closes the listeners and any connections they still hold, flushes all
+// queued events, closes the publisher and closes the store.
 func (s *Server) Close() error {
+	if err := errors.Join(s.httpServer.Close(), s.metricsServer.Close()); err != nil {
+		log.WithError(err).Error("cannot close listeners")
+	}
+	s.events.close()
+	if s.publisher != nil {
+		if err := s.publisher.Close(); err != nil {
+			log.WithError(err).Error("cannot close publisher")
+		}
+	}
 	return s.db.Close()
 }
 
 // routes registers handlerFuncs for the server paths under the given prefixes.
 func (s *Server) routes(prefixes ...string) {
 	s.mux.HandleFunc("/ping", s.handlePing())
+	s.mux.HandleFunc("/ready", s.handleReady())
 	for _, prefix := range prefixes {
 		s.mux.HandleFunc(path.Join(prefix, "openapi.json"), s.handleOpenAPI())
-		s.mux.HandleFunc(prefix+"/", s.metrics(s.requestID(s.log(s.auth(s.handleAPI(prefix))))))
+		s.mux.HandleFunc(prefix+"/", s.trace(s.metrics(s.requestID(s.log(s.auth(s.validate(s.handleAPI(prefix))))))))
 	}
 }
 
-// handlePing creates an http.HandlerFunc that handles the health check endpoint
-// /ping.
+// handlePing creates an http.HandlerFunc that handles the liveness check
+// endpoint /ping. It succeeds as long as the server can answer requests; see
+// handleReady for whether it should be sent any.
 func (s *Server) handlePing() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if _, err := w.Write([]byte(`OK`)); err != nil {
@@ -99,8 +224,20 @@ func (s *Server) handleAPI(prefix string) http.HandlerFunc {
 
 	m.HandleFunc(path.Join(prefix, "channel"), s.handleChannel())
 	m.HandleFunc(path.Join(prefix, "event"), s.handleEvent())
+	m.HandleFunc(path.Join(prefix, "admin/modules/{module}/enrollments"), s.associate(s.handleModuleEnrollments()))
+	m.HandleFunc(path.Join(prefix, "admin/modules/{module}/enrollments/{org_id}"), s.associate(s.handleModuleEnrollment()))
+	m.HandleFunc(path.Join(prefix, "admin/orgs/{org_id}/enrollments"), s.associate(s.handleOrgEnrollments()))
+	m.HandleFunc(path.Join(prefix, "admin/audit"), s.associate(s.handleAudit()))
+	m.HandleFunc(path.Join(prefix, "admin/seed"), s.associate(s.handleSeed()))
+	m.HandleFunc(path.Join(prefix, "admin/events/prune"), s.associate(s.handlePruneEvents()))
+	m.HandleFunc(path.Join(prefix, "admin/events/stats"), s.associate(s.handleEventStats()))
+	m.HandleFunc(prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, codeNotFound, fmt.Sprintf("no such endpoint: '%s'", r.URL.Path))
+	})
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := m.Handler(r)
+		setRoute(r, pattern)
 		m.ServeHTTP(w, r)
 	}
 }
@@ -113,28 +250,27 @@ func (s *Server) handleChannel() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		module := r.URL.Query().Get("module")
 		if len(module) < 1 {
-			formatJSONError(w, http.StatusBadRequest, "missing required parameter: 'module'")
+			writeError(w, http.StatusBadRequest, codeMissingParameter, "missing required parameter: 'module'")
 			return
 		}
 
-		resp := response{
-			URL: "/release",
-		}
 		id := identity.GetIdentity(r.Context())
 		if id.Identity.OrgID == "" {
-			formatJSONError(w, http.StatusBadRequest, "missing org_id identity field")
+			writeError(w, http.StatusBadRequest, codeInvalidIdentity, "missing org_id identity field")
 			return
 		}
-		count, err := s.db.Count(module, id.Identity.OrgID)
+		channel, err := s.db.Route(r.Context(), module, id.Identity.OrgID, time.Now())
 		if err != nil {
 			log.Error(err)
+			channel = DefaultChannel
 		}
-		if count > 0 {
-			resp.URL = "/testing"
+		annotate(r.Context(), attrModule.String(module), attrOrgID.String(id.Identity.OrgID), attrChannel.String(channel))
+		resp := response{
+			URL: "/" + channel,
 		}
 		data, err := json.Marshal(resp)
 		if err != nil {
-			formatJSONError(w, http.StatusInternalServerError, err.Error())
+			writeInternalError(w, err)
 			return
 		}
 		incRequests(resp.URL)
@@ -150,54 +286,91 @@ func (s *Server) handleEvent() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
+			var body eventRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&body); err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidBody, fmt.Sprintf("cannot decode request body: %v", err))
+				return
+			}
+
+			e, errs := body.validate()
+			if len(errs) > 0 {
+				writeFieldErrors(w, errs)
+				return
+			}
+
+			eventID, err := newUUID()
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			e.eventID = eventID.String()
+			e.orgID = identity.GetIdentity(r.Context()).Identity.OrgID
+			e.requestID = request.GetReqID(r.Context())
+			e.spanContext = trace.SpanContextFromContext(r.Context())
+			annotate(r.Context(), attrOrgID.String(e.orgID))
+
+			if !s.events.enqueue(e) {
+				w.Header().Set("Retry-After", retryAfter(s.events.flushInterval))
+				writeError(w, http.StatusServiceUnavailable, codeQueueFull, "event queue is full")
+				return
+			}
+
+			data, err := json.Marshal(eventResponse{EventID: e.eventID})
+			if err != nil {
+				writeInternalError(w, err)
+				return
+			}
+			w.Header().Add("Content-Type", "application/json")
 			w.WriteHeader(http.StatusCreated)
+			if _, err := w.Write(data); err != nil {
+				log.Errorf("cannot write HTTP response: %v", err)
+			}
 		case http.MethodGet:
-			id := identity.GetIdentity(r.Context())
-
-			if id.Identity.Type != "Associate" {
-				formatJSONError(w, http.StatusUnauthorized, "")
+			if !isAssociate(r.Context()) {
+				writeError(w, http.StatusUnauthorized, codeUnauthorized, "identity must be of type 'Associate'")
 				return
 			}
 
 			params, err := url.ParseQuery(r.URL.RawQuery)
 			if err != nil {
-				formatJSONError(w, http.StatusBadRequest, err.Error())
+				writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
 				return
 			}
-			var limit, offset int64
-			{
-				var err error
-				p := params.Get("limit")
-				if p == "" {
-					p = "-1"
-				}
-				limit, err = strconv.ParseInt(p, 10, 64)
-				if err != nil {
-					formatJSONError(w, http.StatusBadRequest, err.Error())
-					return
-				}
+			limit, offset, err := parseLimitOffset(params)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
+				return
 			}
-			{
-				var err error
-				p := params.Get("offset")
-				if p == "" {
-					p = "0"
-				}
-				offset, err = strconv.ParseInt(p, 10, 64)
+			filter, err := parseEventFilter(params)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
+				return
+			}
+
+			// Callers that opt in with envelope=true, or follow a link
+			// holding a cursor, get an eventListResponse. Others get the
+			// bare array of events.
+			envelope := params.Has("cursor")
+			if p := params.Get("envelope"); p != "" {
+				envelope, err = strconv.ParseBool(p)
 				if err != nil {
-					formatJSONError(w, http.StatusBadRequest, err.Error())
+					writeError(w, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("invalid parameter 'envelope': %v", err))
 					return
 				}
 			}
+			if envelope {
+				s.writeEventPage(w, r, params, filter, limit)
+				return
+			}
 
-			events, err := s.db.GetEvents(int(limit), int(offset))
+			events, err := s.db.GetEvents(r.Context(), filter, limit, offset)
 			if err != nil {
-				formatJSONError(w, http.StatusInternalServerError, err.Error())
+				writeInternalError(w, err)
 				return
 			}
 			data, err := json.Marshal(&events)
 			if err != nil {
-				formatJSONError(w, http.StatusInternalServerError, err.Error())
+				writeInternalError(w, err)
 				return
 			}
 			w.Header().Add("Content-Type", "application/json")
@@ -205,10 +378,55 @@ func (s *Server) handleEvent() http.HandlerFunc {
 				log.Errorf("cannot write HTTP response: %v", err)
 			}
 		default:
-			formatJSONError(w, http.StatusMethodNotAllowed, fmt.Sprintf("error: '%s' not allowed", r.Method))
+			writeError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, fmt.Sprintf("method '%s' not allowed", r.Method))
+			return
+		}
+	}
+}
+
+// writeEventPage writes the page of events matching filter that is located by
+// the cursor parameter in params, as an eventListResponse. Its links repeat
+// the query of r with the cursor of the adjacent pages.
+func (s *Server) writeEventPage(w http.ResponseWriter, r *http.Request, params url.Values, filter EventFilter, limit int) {
+	if params.Has("offset") {
+		writeError(w, http.StatusBadRequest, codeInvalidParameter, "invalid parameter 'offset': cannot be combined with envelope; use 'cursor'")
+		return
+	}
+	var cursor *EventCursor
+	if p := params.Get("cursor"); p != "" {
+		c, err := parseEventCursor(p)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
 			return
 		}
+		cursor = &c
+	}
+
+	page, err := s.db.GetEventPage(r.Context(), filter, cursor, limit)
+	if err != nil {
+		writeInternalError(w, err)
+		return
 	}
+
+	link := func(c *EventCursor) *string {
+		if c == nil {
+			return nil
+		}
+		query := url.Values{}
+		for k, v := range params {
+			query[k] = v
+		}
+		query.Set("cursor", c.String())
+		l := r.URL.Path + "?" + query.Encode()
+		return &l
+	}
+
+	var resp eventListResponse
+	resp.Data = page.Events
+	resp.Meta.Count = page.Count
+	resp.Links.Next = link(page.Next)
+	resp.Links.Prev = link(page.Prev)
+	writeJSON(w, http.StatusOK, resp)
 }
 
 // log is an http HandlerFunc middlware handler that creates a responseWriter
@@ -258,18 +476,42 @@ func (s *Server) requestID(next http.HandlerFunc) http.HandlerFunc {
 }
 
 // auth is an http HandlerFunc middleware handler that ensures a valid
-// X-Rh-Identity header is present in the request.
+// X-Rh-Identity header is present in the request, and stores the identity in
+// the request context. Unlike identity.EnforceIdentity, it reports invalid
+// identities in the same JSON format as any other error.
 func (s *Server) auth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		identity.EnforceIdentityWithLogger(func(ctx context.Context, rawIdentity, message string) {
+		rawIdentity := r.Header.Get("X-Rh-Identity")
+		ctx, err := identity.DecodeIdentityCtx(r.Context(), rawIdentity)
+		if err != nil {
 			log.WithFields(log.Fields{
 				"identity": rawIdentity,
-				"message":  message,
+				"message":  err.Error(),
 			}).Log(log.InfoLevel)
-		})(next).ServeHTTP(w, r)
+			writeError(w, http.StatusBadRequest, codeInvalidIdentity, err.Error())
+			return
+		}
+		next(w, r.WithContext(ctx))
 	}
 }
 
+// associate is an http HandlerFunc middleware handler that ensures the request
+// identity is of type Associate.
+func (s *Server) associate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAssociate(r.Context()) {
+			writeError(w, http.StatusUnauthorized, codeUnauthorized, "identity must be of type 'Associate'")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// isAssociate reports whether the identity stored in ctx is of type Associate.
+func isAssociate(ctx context.Context) bool {
+	return identity.GetIdentity(ctx).Identity.Type == "Associate"
+}
+
 // metrics is an http HandlerFunc middleware handler that creates and enables
 // a metrics recorder.
 func (s *Server) metrics(next http.HandlerFunc) http.HandlerFunc {
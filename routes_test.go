@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
 )
 
+// testRequestID is sent as the X-Request-Id of test requests, so that the
+// request ID in error responses is predictable.
+const testRequestID = "test-request-id"
+
 func TestRouter(t *testing.T) {
 	type request struct {
 		method, url, body string
@@ -45,25 +58,55 @@ func TestRouter(t *testing.T) {
 			input: request{http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", "", map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979711", "account_number": "540156", "type": "User", "internal": { "org_id": "1979711" } } }`))}},
 			want:  response{http.StatusOK, `{"url":"/release"}`},
 		},
+		{
+			desc:  "GET /channel - want /beta",
+			input: request{http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", "", map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979712", "account_number": "540157", "type": "User", "internal": { "org_id": "1979712" } } }`))}},
+			want:  response{http.StatusOK, `{"url":"/beta"}`},
+		},
+		{
+			desc:  "GET /channel - want module default /stable",
+			input: request{http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core-next", "", map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979711", "account_number": "540156", "type": "User", "internal": { "org_id": "1979711" } } }`))}},
+			want:  response{http.StatusOK, `{"url":"/stable"}`},
+		},
 		{
 			desc:  "POST /event - want CREATED",
 			input: request{http.MethodPost, "/api/module-update-router/v1/event", `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03-04:00", "exit": 1, "exception": "OSPermissionError", "ended_at": "2020-06-19T11:19:03-04:00", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156", "core_path": "/etc/rpm/insights.egg"}`, map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
-			want:  response{http.StatusCreated, ""},
+			want:  response{http.StatusCreated, `{"event_id":"0b6fb3a4-5a7e-4d8e-9f4c-8a6a1e2f3b4c"}`},
 		},
 		{
 			desc:  "POST /event - want CREATED - exception is null",
 			input: request{http.MethodPost, "/api/module-update-router/v1/event", `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03-04:00", "exit": 0, "exception": null, "ended_at": "2020-06-19T11:19:03-04:00", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156", "core_path": "/etc/rpm/insights.egg"}`, map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
-			want:  response{http.StatusCreated, ""},
+			want:  response{http.StatusCreated, `{"event_id":"0b6fb3a4-5a7e-4d8e-9f4c-8a6a1e2f3b4c"}`},
 		},
 		{
 			desc:  "POST /event - want CREATED - exception is omitted",
 			input: request{http.MethodPost, "/api/module-update-router/v1/event", `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03-04:00", "exit": 0, "ended_at": "2020-06-19T11:19:03-04:00", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156", "core_path": "/etc/rpm/insights.egg"}`, map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
-			want:  response{http.StatusCreated, ""},
+			want:  response{http.StatusCreated, `{"event_id":"0b6fb3a4-5a7e-4d8e-9f4c-8a6a1e2f3b4c"}`},
 		},
 		{
 			desc:  "POST /event - want CREATED - date format Z",
 			input: request{http.MethodPost, "/api/module-update-router/v1/event", `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 0, "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156", "core_path": "/etc/rpm/insights.egg"}`, map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
-			want:  response{http.StatusCreated, ""},
+			want:  response{http.StatusCreated, `{"event_id":"0b6fb3a4-5a7e-4d8e-9f4c-8a6a1e2f3b4c"}`},
+		},
+		{
+			desc:  "POST /event - want BAD REQUEST - missing fields",
+			input: request{http.MethodPost, "/api/module-update-router/v1/event", `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "ended_at": "2020-06-19T11:19:03Z"}`, map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","code":"invalid_field","title":"Invalid field in request body","detail":"missing required field: 'exit'","source":{"pointer":"/exit"},"request_id":"test-request-id"},{"status":"Bad Request","code":"invalid_field","title":"Invalid field in request body","detail":"missing required field: 'machine_id'","source":{"pointer":"/machine_id"},"request_id":"test-request-id"},{"status":"Bad Request","code":"invalid_field","title":"Invalid field in request body","detail":"missing required field: 'core_version'","source":{"pointer":"/core_version"},"request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "POST /event - want BAD REQUEST - invalid timestamp",
+			input: request{http.MethodPost, "/api/module-update-router/v1/event", `{"phase": "pre_update", "started_at": "2020-06-19 11:18:03", "exit": 0, "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156"}`, map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","code":"invalid_field","title":"Invalid field in request body","detail":"invalid timestamp in field 'started_at': must be RFC 3339 formatted","source":{"pointer":"/started_at"},"request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "POST /event - want BAD REQUEST - fields too long",
+			input: request{http.MethodPost, "/api/module-update-router/v1/event", `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 1, "exception": "` + strings.Repeat("x", 1025) + `", "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6a", "core_version": "3.0.156"}`, map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","code":"invalid_field","title":"Invalid field in request body","detail":"invalid field 'exception': must be at most 1024 characters long","source":{"pointer":"/exception"},"request_id":"test-request-id"},{"status":"Bad Request","code":"invalid_field","title":"Invalid field in request body","detail":"invalid field 'machine_id': must be at most 36 characters long","source":{"pointer":"/machine_id"},"request_id":"test-request-id"}]}`},
+		},
+		{
+			desc:  "POST /event - want BAD REQUEST - malformed JSON",
+			input: request{http.MethodPost, "/api/module-update-router/v1/event", `{"phase": `, map[string]string{"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))}},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","code":"invalid_body","title":"Invalid request body","detail":"cannot decode request body: unexpected EOF","request_id":"test-request-id"}]}`},
 		},
 		{
 			desc: "GET /event - limit 1",
@@ -110,39 +153,207 @@ func TestRouter(t *testing.T) {
 				body: `[{"core_path":"/var/lib/insights/latest.egg","core_version":"3.0.156","ended_at":"2020-07-21T13:02:31Z","event_id":"89d9352c-0f53-49c0-9f7c-27a9ee3e2dff","exception":"OSError","exit":1,"machine_id":"21f3e7da-6e33-41dd-b25f-0eab2242ae27","phase":"pre_update","started_at":"2020-07-21T13:01:04Z"}]`,
 			},
 		},
+		{
+			desc: "GET /event - filter by machine_id and exception",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/event?machine_id=21f3e7da-6e33-41dd-b25f-0eab2242ae27&has_exception=true&exit=nonzero",
+				body:   ``,
+				headers: map[string]string{
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{
+				code: http.StatusOK,
+				body: `[{"core_path":"/var/lib/insights/latest.egg","core_version":"3.0.156","ended_at":"2020-07-21T13:02:31Z","event_id":"89d9352c-0f53-49c0-9f7c-27a9ee3e2dff","exception":"OSError","exit":1,"machine_id":"21f3e7da-6e33-41dd-b25f-0eab2242ae27","phase":"pre_update","started_at":"2020-07-21T13:01:04Z"}]`,
+			},
+		},
+		{
+			desc: "GET /event - filter by started_at range - no match",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/event?started_after=2020-06-20T00:00:00Z&started_before=2020-07-21T13:01:04Z",
+				body:   ``,
+				headers: map[string]string{
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{
+				code: http.StatusOK,
+				body: `[]`,
+			},
+		},
+		{
+			desc: "GET /event - envelope - first page",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/event?envelope=true&limit=1",
+				body:   ``,
+				headers: map[string]string{
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{
+				code: http.StatusOK,
+				body: `{"data":[{"core_path":"/etc/insights-client/rpm.egg","core_version":"3.0.156","ended_at":"2020-07-15T17:17:37Z","event_id":"af3b8e13-6b65-45d8-8310-a45e0821bd62","exit":1,"machine_id":"a9ab0a44-1241-43ae-9c02-1850acf0c36c","phase":"pre_update","started_at":"2020-06-19T11:18:03Z"}],"meta":{"count":2},"links":{"next":"/api/module-update-router/v1/event?cursor=eyJzdGFydGVkX2F0IjoiMjAyMC0wNi0xOVQxMToxODowM1oiLCJldmVudF9pZCI6ImFmM2I4ZTEzLTZiNjUtNDVkOC04MzEwLWE0NWUwODIxYmQ2MiJ9\u0026envelope=true\u0026limit=1","prev":null}}`,
+			},
+		},
+		{
+			desc: "GET /event - envelope - next page",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/event?cursor=eyJzdGFydGVkX2F0IjoiMjAyMC0wNi0xOVQxMToxODowM1oiLCJldmVudF9pZCI6ImFmM2I4ZTEzLTZiNjUtNDVkOC04MzEwLWE0NWUwODIxYmQ2MiJ9&limit=1",
+				body:   ``,
+				headers: map[string]string{
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{
+				code: http.StatusOK,
+				body: `{"data":[{"core_path":"/var/lib/insights/latest.egg","core_version":"3.0.156","ended_at":"2020-07-21T13:02:31Z","event_id":"89d9352c-0f53-49c0-9f7c-27a9ee3e2dff","exception":"OSError","exit":1,"machine_id":"21f3e7da-6e33-41dd-b25f-0eab2242ae27","phase":"pre_update","started_at":"2020-07-21T13:01:04Z"}],"meta":{"count":2},"links":{"next":null,"prev":"/api/module-update-router/v1/event?cursor=eyJzdGFydGVkX2F0IjoiMjAyMC0wNy0yMVQxMzowMTowNFoiLCJldmVudF9pZCI6Ijg5ZDkzNTJjLTBmNTMtNDljMC05ZjdjLTI3YTllZTNlMmRmZiIsImJlZm9yZSI6dHJ1ZX0\u0026limit=1"}}`,
+			},
+		},
+		{
+			desc: "GET /event - want BAD REQUEST - envelope with offset",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/event?envelope=true&offset=1",
+				body:   ``,
+				headers: map[string]string{
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{
+				code: http.StatusBadRequest,
+				body: `{"errors":[{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid parameter 'offset': cannot be combined with envelope; use 'cursor'","request_id":"test-request-id"}]}`,
+			},
+		},
+		{
+			desc: "GET /event - want BAD REQUEST - invalid cursor",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/event?cursor=!!!",
+				body:   ``,
+				headers: map[string]string{
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{
+				code: http.StatusBadRequest,
+				body: `{"errors":[{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid parameter 'cursor': illegal base64 data at input byte 0","request_id":"test-request-id"}]}`,
+			},
+		},
+		{
+			desc: "GET /event - want BAD REQUEST - invalid exit",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/event?exit=failed",
+				body:   ``,
+				headers: map[string]string{
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{
+				code: http.StatusBadRequest,
+				body: `{"errors":[{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid parameter 'exit': must be an integer or 'nonzero'","request_id":"test-request-id"}]}`,
+			},
+		},
+		{
+			desc: "GET /event - want BAD REQUEST - invalid ended_before",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/event?ended_before=2020-07-21",
+				body:   ``,
+				headers: map[string]string{
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{
+				code: http.StatusBadRequest,
+				body: `{"errors":[{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid parameter 'ended_before': must be RFC 3339 formatted","request_id":"test-request-id"}]}`,
+			},
+		},
+		{
+			desc:  "GET /event - want BAD REQUEST - missing identity",
+			input: request{http.MethodGet, "/api/module-update-router/v1/event", "", nil},
+			want:  response{http.StatusBadRequest, `{"errors":[{"status":"Bad Request","code":"invalid_identity","title":"Invalid identity","detail":"missing x-rh-identity header","request_id":"test-request-id"}]}`},
+		},
+		{
+			desc: "GET /nonexistent - want NOT FOUND",
+			input: request{
+				method: http.MethodGet,
+				url:    "/api/module-update-router/v1/nonexistent",
+				headers: map[string]string{
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{http.StatusNotFound, `{"errors":[{"status":"Not Found","code":"not_found","title":"Not found","detail":"no such endpoint: '/api/module-update-router/v1/nonexistent'","request_id":"test-request-id"}]}`},
+		},
+		{
+			desc: "PUT /event - want METHOD NOT ALLOWED",
+			input: request{
+				method: http.MethodPut,
+				url:    "/api/module-update-router/v1/event",
+				headers: map[string]string{
+					"X-Rh-Identity": base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "Associate", "internal": { "org_id": "1979710" } } }`)),
+				},
+			},
+			want: response{http.StatusMethodNotAllowed, `{"errors":[{"status":"Method Not Allowed","code":"method_not_allowed","title":"Method not allowed","detail":"method 'PUT' not allowed","request_id":"test-request-id"}]}`},
+		},
+	}
+
+	newUUID = func() (uuid.UUID, error) {
+		return uuid.MustParse("0b6fb3a4-5a7e-4d8e-9f4c-8a6a1e2f3b4c"), nil
 	}
+	defer func() { newUUID = uuid.NewUUID }()
 
 	for _, test := range tests {
 		t.Run(test.desc, func(t *testing.T) {
-			// Bootstrap a server and seed the database
-			db, err := Open("sqlite", "file::memory:?cache=shared")
-			if err != nil {
-				t.Fatal(err)
-			}
-			defer func() {
-				if err := db.Close(); err != nil {
+			// Bootstrap a server and seed the store
+			store := NewMemoryStore()
+			ctx := context.Background()
+			for _, e := range []Enrollment{
+				{ModuleName: "insights-core", OrgID: "1979710", Channel: "testing"},
+				{ModuleName: "insights-core", OrgID: "1979712", Channel: "beta"},
+			} {
+				if err := store.InsertOrgsModules(ctx, e, Change{Actor: systemActor}); err != nil {
 					t.Fatal(err)
 				}
-			}()
-			if err := db.Migrate(false); err != nil {
-				t.Fatal(err)
-			}
-			if err := db.seedData([]byte(`INSERT INTO orgs_modules (org_id, module_name) VALUES ('1979710', 'insights-core');`)); err != nil {
-				t.Fatal(err)
 			}
-			if err := db.seedData([]byte(`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path)
-			VALUES ("af3b8e13-6b65-45d8-8310-a45e0821bd62", "pre_update", "2020-06-19T11:18:03Z", 1, NULL, "2020-07-15T17:17:37Z", "a9ab0a44-1241-43ae-9c02-1850acf0c36c", "3.0.156", "/etc/insights-client/rpm.egg");`)); err != nil {
+			if err := store.InsertChannel(ctx, "insights-core-next", "stable", true); err != nil {
 				t.Fatal(err)
 			}
-			if err := db.seedData([]byte(`INSERT INTO events (event_id, phase, started_at, exit, exception, ended_at, machine_id, core_version, core_path)
-			VALUES ("89d9352c-0f53-49c0-9f7c-27a9ee3e2dff", "pre_update", "2020-07-21T13:01:04Z", 1, "OSError", "2020-07-21T13:02:31Z", "21f3e7da-6e33-41dd-b25f-0eab2242ae27", "3.0.156", "/var/lib/insights/latest.egg");`)); err != nil {
+			if err := store.InsertEventBatch(ctx, []event{
+				{
+					eventID:     "af3b8e13-6b65-45d8-8310-a45e0821bd62",
+					phase:       "pre_update",
+					startedAt:   time.Date(2020, 6, 19, 11, 18, 3, 0, time.UTC),
+					exit:        1,
+					endedAt:     time.Date(2020, 7, 15, 17, 17, 37, 0, time.UTC),
+					machineID:   "a9ab0a44-1241-43ae-9c02-1850acf0c36c",
+					coreVersion: "3.0.156",
+					corePath:    sql.NullString{String: "/etc/insights-client/rpm.egg", Valid: true},
+				},
+				{
+					eventID:     "89d9352c-0f53-49c0-9f7c-27a9ee3e2dff",
+					phase:       "pre_update",
+					startedAt:   time.Date(2020, 7, 21, 13, 1, 4, 0, time.UTC),
+					exit:        1,
+					exception:   sql.NullString{String: "OSError", Valid: true},
+					endedAt:     time.Date(2020, 7, 21, 13, 2, 31, 0, time.UTC),
+					machineID:   "21f3e7da-6e33-41dd-b25f-0eab2242ae27",
+					coreVersion: "3.0.156",
+					corePath:    sql.NullString{String: "/var/lib/insights/latest.egg", Valid: true},
+				},
+			}); err != nil {
 				t.Fatal(err)
 			}
 
-			srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db)
+			srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, store, nil, nil)
 			if err != nil {
 				t.Fatal(err)
 			}
+			validateResponses(t, srv)
 			defer func() {
 				if err := srv.Close(); err != nil {
 					t.Fatal(err)
@@ -151,6 +362,7 @@ func TestRouter(t *testing.T) {
 
 			reader := strings.NewReader(test.input.body)
 			req := httptest.NewRequest(test.input.method, test.input.url, reader)
+			req.Header.Set("X-Request-Id", testRequestID)
 			for k, v := range test.input.headers {
 				req.Header.Add(k, v)
 			}
@@ -164,3 +376,420 @@ func TestRouter(t *testing.T) {
 		})
 	}
 }
+
+func TestEventBackpressure(t *testing.T) {
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateResponses(t, srv)
+	defer func() {
+		if err := srv.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	srv.events.close()
+	srv.events = newIdleEventQueue(db, nil, 1, 1, 2500*time.Millisecond)
+
+	body := `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 0, "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156"}`
+	wantCodes := []int{http.StatusCreated, http.StatusServiceUnavailable}
+	for i, want := range wantCodes {
+		req := httptest.NewRequest(http.MethodPost, "/api/module-update-router/v1/event", strings.NewReader(body))
+		req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`)))
+		rr := httptest.NewRecorder()
+		srv.ServeHTTP(rr, req)
+
+		if rr.Code != want {
+			t.Errorf("request %v: %v != %v", i, rr.Code, want)
+		}
+		if want == http.StatusServiceUnavailable && rr.Header().Get("Retry-After") != "3" {
+			t.Errorf("request %v: Retry-After %q != %q", i, rr.Header().Get("Retry-After"), "3")
+		}
+	}
+}
+
+func TestEventPublish(t *testing.T) {
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &fakePublisher{}
+	srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateResponses(t, srv)
+
+	body := `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 1, "exception": "OSError", "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/module-update-router/v1/event", strings.NewReader(body))
+	req.Header.Add("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`)))
+	req.Header.Add("X-Request-Id", "test-request-id")
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("%v != %v", rr.Code, http.StatusCreated)
+	}
+
+	var resp eventResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.closed {
+		t.Error("publisher was not closed")
+	}
+
+	messages := p.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("published %v messages, want 1", len(messages))
+	}
+	if got := string(messages[0].Key); got != "60654767-dfba-47af-8bca-cb2d1d01d9a6" {
+		t.Errorf("key %v != %v", got, "60654767-dfba-47af-8bca-cb2d1d01d9a6")
+	}
+	want := `{"event_id":"` + resp.EventID + `","phase":"pre_update","started_at":"2020-06-19T11:18:03Z","exit":1,"exception":"OSError","ended_at":"2020-06-19T11:19:03Z","machine_id":"60654767-dfba-47af-8bca-cb2d1d01d9a6","core_version":"3.0.156","org_id":"1979710","request_id":"test-request-id"}`
+	if got := string(messages[0].Value); got != want {
+		t.Errorf("\ngot:  %v\nwant: %v", got, want)
+	}
+}
+
+func TestRouterParallel(t *testing.T) {
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validateResponses(t, srv)
+	defer func() {
+		if err := srv.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	user := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))
+	associate := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "type": "Associate", "associate": { "email": "jdoe@redhat.com" } } }`))
+
+	const requests = 20
+	tests := []struct {
+		desc    string
+		request func(i int) *http.Request
+		want    int
+	}{
+		{
+			desc: "GET /channel",
+			request: func(i int) *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+				req.Header.Add("X-Rh-Identity", user)
+				return req
+			},
+			want: http.StatusOK,
+		},
+		{
+			desc: "POST /event",
+			request: func(i int) *http.Request {
+				body := `{"phase": "pre_update", "started_at": "2020-06-19T11:18:03Z", "exit": 0, "ended_at": "2020-06-19T11:19:03Z", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156"}`
+				req := httptest.NewRequest(http.MethodPost, "/api/module-update-router/v1/event", strings.NewReader(body))
+				req.Header.Add("X-Rh-Identity", user)
+				return req
+			},
+			want: http.StatusCreated,
+		},
+		{
+			desc: "GET /event",
+			request: func(i int) *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/event?limit=10", nil)
+				req.Header.Add("X-Rh-Identity", associate)
+				return req
+			},
+			want: http.StatusOK,
+		},
+		{
+			desc: "POST /admin/modules/{module}/enrollments",
+			request: func(i int) *http.Request {
+				body := fmt.Sprintf(`{"org_id": "%v", "channel": "beta"}`, 1000+i)
+				req := httptest.NewRequest(http.MethodPost, "/api/module-update-router/v1/admin/modules/insights-core/enrollments", strings.NewReader(body))
+				req.Header.Add("X-Rh-Identity", associate)
+				return req
+			},
+			want: http.StatusCreated,
+		},
+		{
+			desc: "GET /admin/modules/{module}/enrollments",
+			request: func(i int) *http.Request {
+				req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/module-update-router/v1/admin/modules/insights-core/enrollments?limit=5&offset=%v", i), nil)
+				req.Header.Add("X-Rh-Identity", associate)
+				return req
+			},
+			want: http.StatusOK,
+		},
+		{
+			desc: "GET /admin/audit",
+			request: func(i int) *http.Request {
+				req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/admin/audit?module=insights-core", nil)
+				req.Header.Add("X-Rh-Identity", associate)
+				return req
+			},
+			want: http.StatusOK,
+		},
+	}
+
+	t.Run("group", func(t *testing.T) {
+		for _, test := range tests {
+			t.Run(test.desc, func(t *testing.T) {
+				t.Parallel()
+				for i := 0; i < requests; i++ {
+					rr := httptest.NewRecorder()
+					srv.ServeHTTP(rr, test.request(i))
+					if rr.Code != test.want {
+						t.Errorf("request %v: %v != %v: %v", i, rr.Code, test.want, rr.Body.String())
+					}
+				}
+			})
+		}
+	})
+
+	enrolled, err := db.ListEnrollments(context.Background(), EnrollmentFilter{ModuleName: "insights-core", OrgID: "1000"}, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enrolled) != 1 {
+		t.Errorf("%v != %v", len(enrolled), 1)
+	}
+	enrollments, err := db.ListEnrollments(context.Background(), EnrollmentFilter{ModuleName: "insights-core"}, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enrollments) != requests {
+		t.Errorf("%v != %v", len(enrollments), requests)
+	}
+}
+
+// benchmarkOrgs is the number of orgs enrolled in the routing benchmarks.
+const benchmarkOrgs = 10000
+
+// newBenchmarkDB opens a database with benchmarkOrgs orgs enrolled in
+// insights-core, a rollout to 10% of the remaining orgs and a default channel.
+func newBenchmarkDB(b *testing.B) *DB {
+	b.Helper()
+
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := db.Migrate(context.Background(), false); err != nil {
+		b.Fatal(err)
+	}
+
+	seed := seedFile{
+		Modules: []seedModule{{
+			Name:     "insights-core",
+			Channels: []seedChannel{{Name: "release", Default: true}, {Name: "testing"}},
+			Rollout:  &seedRollout{Channel: "testing", Percentage: 10},
+		}},
+		Enrollments: []seedEnrollment{{Module: "insights-core", Orgs: make([]string, 0, benchmarkOrgs)}},
+	}
+	for i := 0; i < benchmarkOrgs; i++ {
+		seed.Enrollments[0].Orgs = append(seed.Enrollments[0].Orgs, fmt.Sprint(i))
+	}
+	if err := db.applySeed(context.Background(), seed); err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+// BenchmarkRoutingTableChannel measures routing decisions made from the
+// in-memory routing table by concurrent readers.
+func BenchmarkRoutingTableChannel(b *testing.B) {
+	db := newBenchmarkDB(b)
+	defer func() {
+		if err := db.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}()
+
+	routes, err := db.Routes(context.Background())
+	if err != nil {
+		b.Fatal(err)
+	}
+	orgs := make([]string, 2*benchmarkOrgs)
+	for i := range orgs {
+		orgs[i] = fmt.Sprint(i)
+	}
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			routes.Channel("insights-core", orgs[i%len(orgs)], now)
+			i++
+		}
+	})
+}
+
+// BenchmarkHandleChannel measures complete GET /channel requests, including
+// identity decoding, logging and metrics, served concurrently.
+func BenchmarkHandleChannel(b *testing.B) {
+	db := newBenchmarkDB(b)
+
+	srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, db, nil, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		if err := srv.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}()
+
+	identities := make([]string, 2*benchmarkOrgs)
+	for i := range identities {
+		identities[i] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(`{ "identity": { "account_number": "540155", "type": "User", "internal": { "org_id": "%v" }, "org_id": "%v" } }`, i, i)))
+	}
+
+	log.SetLevel(log.ErrorLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodGet, "/api/module-update-router/v1/channel?module=insights-core", nil)
+			req.Header.Add("X-Rh-Identity", identities[i%len(identities)])
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				b.Errorf("%v != %v: %v", rr.Code, http.StatusOK, rr.Body.String())
+			}
+			i++
+		}
+	})
+}
+
+func TestServerShutdown(t *testing.T) {
+	tests := []struct {
+		desc    string
+		timeout time.Duration
+		release bool
+		wantErr error
+	}{
+		{
+			desc:    "request completes",
+			timeout: time.Minute,
+			release: true,
+		},
+		{
+			desc:    "request outlasts timeout",
+			timeout: 50 * time.Millisecond,
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			srv, err := NewServer("127.0.0.1:0", []string{"/api/module-update-router/v1"}, NewMemoryStore(), nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := srv.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}()
+			srv.shutdownDelay = 0
+
+			// /slow stands in for a request that is still being handled
+			// when the server is asked to shut down.
+			started := make(chan struct{})
+			release := make(chan struct{})
+			srv.mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+				fmt.Fprint(w, "done")
+			})
+			defer close(release)
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				if err := srv.httpServer.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+					t.Error(err)
+				}
+			}()
+
+			type result struct {
+				code int
+				err  error
+			}
+			results := make(chan result, 1)
+			go func() {
+				resp, err := http.Get("http://" + l.Addr().String() + "/slow")
+				if err != nil {
+					results <- result{err: err}
+					return
+				}
+				resp.Body.Close()
+				results <- result{code: resp.StatusCode}
+			}()
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+			shutdown := make(chan error, 1)
+			go func() { shutdown <- srv.Shutdown(ctx) }()
+
+			// Readiness fails as soon as shutdown begins.
+			deadline := time.Now().Add(time.Second)
+			for {
+				rr := httptest.NewRecorder()
+				srv.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/ready", nil))
+				if rr.Code == http.StatusServiceUnavailable {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%v != %v", rr.Code, http.StatusServiceUnavailable)
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			if test.release {
+				release <- struct{}{}
+				if r := <-results; r.err != nil || r.code != http.StatusOK {
+					t.Errorf("in-flight request failed: %v %v", r.code, r.err)
+				}
+			}
+			err = <-shutdown
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("%v != %v", err, test.wantErr)
+			}
+			if err == nil && srv.events.enqueue(event{}) {
+				t.Error("event queue accepted an event after shutdown")
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// routingTable is an immutable snapshot of the state used to route orgs to
+// channels: enrollments, rollouts and default channels. A routingTable must not
+// be modified once it has been built, so that it can be read concurrently
+// without locking; changes are made by building a new table and swapping it in.
+type routingTable struct {
+	// enrollments maps a module name and then an org ID to the org's
+	// enrollment in the module.
+	enrollments map[string]map[string]Enrollment
+
+	// rollouts maps a module name to the module's rollout.
+	rollouts map[string]Rollout
+
+	// defaults maps a module name to the module's default channel.
+	defaults map[string]string
+}
+
+// newRoutingTable builds a routingTable from the given enrollments, rollouts and
+// default channels, keyed by module name.
+func newRoutingTable(enrollments []Enrollment, rollouts []Rollout, defaults map[string]string) *routingTable {
+	t := &routingTable{
+		enrollments: make(map[string]map[string]Enrollment),
+		rollouts:    make(map[string]Rollout, len(rollouts)),
+		defaults:    defaults,
+	}
+	for _, e := range enrollments {
+		orgs := t.enrollments[e.ModuleName]
+		if orgs == nil {
+			orgs = make(map[string]Enrollment)
+			t.enrollments[e.ModuleName] = orgs
+		}
+		orgs[e.OrgID] = e
+	}
+	for _, r := range rollouts {
+		t.rollouts[r.ModuleName] = r
+	}
+	return t
+}
+
+// Channel returns the name of the channel orgID should use for moduleName at
+// now. An active enrollment takes precedence over a rollout that includes the
+// org, which takes precedence over the module's default channel.
+// DefaultChannel is returned if none apply.
+func (t *routingTable) Channel(moduleName, orgID string, now time.Time) string {
+	if e, ok := t.enrollments[moduleName][orgID]; ok && e.Active(now) {
+		return e.Channel
+	}
+	if r, ok := t.rollouts[moduleName]; ok && r.Includes(orgID) {
+		return r.Channel
+	}
+	if channel, ok := t.defaults[moduleName]; ok {
+		return channel
+	}
+	return DefaultChannel
+}
+
+// refreshRoutes reloads the routing table of db every interval until ctx is
+// done, picking up changes made to the database by other replicas. If interval
+// is not positive, the table is never refreshed.
+func refreshRoutes(ctx context.Context, db *DB, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	logger := log.WithField("routine", "routing-refresher")
+	logger.Debug("started routing refresher")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debug("stopped routing refresher")
+			return
+		case <-ticker.C:
+			if err := db.refreshRoutes(ctx); err != nil {
+				logger.WithError(err).Error("cannot refresh routing table")
+			}
+		}
+	}
+}
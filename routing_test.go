@@ -0,0 +1,153 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoutingTableChannel(t *testing.T) {
+	now := time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	tests := []struct {
+		description string
+		input       struct {
+			enrollments []Enrollment
+			rollouts    []Rollout
+			defaults    map[string]string
+		}
+		want string
+	}{
+		{
+			description: "not enrolled, no default",
+			want:        DefaultChannel,
+		},
+		{
+			description: "not enrolled, module default",
+			input: struct {
+				enrollments []Enrollment
+				rollouts    []Rollout
+				defaults    map[string]string
+			}{
+				enrollments: []Enrollment{{ModuleName: "insights-core", OrgID: "2", Channel: "canary"}},
+				defaults:    map[string]string{"insights-core": "stable"},
+			},
+			want: "stable",
+		},
+		{
+			description: "enrolled in named channel",
+			input: struct {
+				enrollments []Enrollment
+				rollouts    []Rollout
+				defaults    map[string]string
+			}{
+				enrollments: []Enrollment{{ModuleName: "insights-core", OrgID: "1", Channel: "hotfix-1234"}},
+				defaults:    map[string]string{"insights-core": "stable"},
+			},
+			want: "hotfix-1234",
+		},
+		{
+			description: "enrolled in other module",
+			input: struct {
+				enrollments []Enrollment
+				rollouts    []Rollout
+				defaults    map[string]string
+			}{
+				enrollments: []Enrollment{{ModuleName: "other", OrgID: "1", Channel: "canary"}},
+			},
+			want: DefaultChannel,
+		},
+		{
+			description: "not enrolled, rollout 100 percent",
+			input: struct {
+				enrollments []Enrollment
+				rollouts    []Rollout
+				defaults    map[string]string
+			}{
+				rollouts: []Rollout{{ModuleName: "insights-core", Channel: "canary", Percentage: 100}},
+				defaults: map[string]string{"insights-core": "stable"},
+			},
+			want: "canary",
+		},
+		{
+			description: "not enrolled, rollout 0 percent",
+			input: struct {
+				enrollments []Enrollment
+				rollouts    []Rollout
+				defaults    map[string]string
+			}{
+				rollouts: []Rollout{{ModuleName: "insights-core", Channel: "canary", Percentage: 0}},
+				defaults: map[string]string{"insights-core": "stable"},
+			},
+			want: "stable",
+		},
+		{
+			description: "enrolled, rollout 100 percent",
+			input: struct {
+				enrollments []Enrollment
+				rollouts    []Rollout
+				defaults    map[string]string
+			}{
+				enrollments: []Enrollment{{ModuleName: "insights-core", OrgID: "1", Channel: "beta"}},
+				rollouts:    []Rollout{{ModuleName: "insights-core", Channel: "canary", Percentage: 100}},
+			},
+			want: "beta",
+		},
+		{
+			description: "enrollment expired",
+			input: struct {
+				enrollments []Enrollment
+				rollouts    []Rollout
+				defaults    map[string]string
+			}{
+				enrollments: []Enrollment{{ModuleName: "insights-core", OrgID: "1", Channel: "beta", ExpiresAt: &past}},
+				rollouts:    []Rollout{{ModuleName: "insights-core", Channel: "canary", Percentage: 100}},
+			},
+			want: "canary",
+		},
+		{
+			description: "enrollment expiring now",
+			input: struct {
+				enrollments []Enrollment
+				rollouts    []Rollout
+				defaults    map[string]string
+			}{
+				enrollments: []Enrollment{{ModuleName: "insights-core", OrgID: "1", Channel: "beta", ExpiresAt: &now}},
+			},
+			want: DefaultChannel,
+		},
+		{
+			description: "enrollment not yet started",
+			input: struct {
+				enrollments []Enrollment
+				rollouts    []Rollout
+				defaults    map[string]string
+			}{
+				enrollments: []Enrollment{{ModuleName: "insights-core", OrgID: "1", Channel: "beta", StartsAt: &future}},
+				defaults:    map[string]string{"insights-core": "stable"},
+			},
+			want: "stable",
+		},
+		{
+			description: "enrollment within window",
+			input: struct {
+				enrollments []Enrollment
+				rollouts    []Rollout
+				defaults    map[string]string
+			}{
+				enrollments: []Enrollment{{ModuleName: "insights-core", OrgID: "1", Channel: "beta", StartsAt: &past, ExpiresAt: &future}},
+			},
+			want: "beta",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			routes := newRoutingTable(test.input.enrollments, test.input.rollouts, test.input.defaults)
+			if got := routes.Channel("insights-core", "1", now); got != test.want {
+				t.Errorf("%+v != %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// seedActor is the actor recorded for enrollment changes made by applying a
+// seed file.
+const seedActor = "seed"
+
+// seedFile is the declarative seed format. It describes modules, with their
+// channels and rollouts, and the orgs enrolled in each of them. Because JSON is
+// a subset of YAML, a seed file may be written in either.
+type seedFile struct {
+	Modules     []seedModule     `json:"modules"`
+	Enrollments []seedEnrollment `json:"enrollments"`
+}
+
+// seedModule declares a module, the channels it publishes and its rollout.
+type seedModule struct {
+	Name     string        `json:"name"`
+	Channels []seedChannel `json:"channels"`
+	Rollout  *seedRollout  `json:"rollout"`
+}
+
+// seedChannel declares a channel of a module. At most one channel of a module
+// may be the default.
+type seedChannel struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+}
+
+// seedRollout declares a percentage-based rollout of a module to a channel.
+type seedRollout struct {
+	Channel    string `json:"channel"`
+	Percentage int    `json:"percentage"`
+	Salt       string `json:"salt"`
+}
+
+// seedEnrollment enrolls a list of orgs in a channel of a declared module.
+// Channel defaults to "testing".
+type seedEnrollment struct {
+	Module    string     `json:"module"`
+	Channel   string     `json:"channel"`
+	Orgs      []string   `json:"orgs"`
+	StartsAt  *time.Time `json:"starts_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Reason    string     `json:"reason"`
+	Ticket    string     `json:"ticket"`
+}
+
+// isStructuredSeed reports whether the seed file at path is in the declarative
+// format, based on its extension. Any other file is treated as raw SQL.
+func isStructuredSeed(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	default:
+		return false
+	}
+}
+
+// parseSeed decodes data as a YAML or JSON seed file and validates it. Unknown
+// fields are rejected so that a misspelled key is not silently ignored.
+func parseSeed(data []byte) (seedFile, error) {
+	var s seedFile
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return seedFile{}, fmt.Errorf("seed: yaml.UnmarshalStrict failed: %w", err)
+	}
+	if err := s.validate(); err != nil {
+		return seedFile{}, err
+	}
+	return s, nil
+}
+
+// validate checks s for malformed names and org IDs, duplicate modules,
+// channels and orgs, and references to undeclared modules or channels. All
+// problems found are returned together.
+func (s seedFile) validate() error {
+	var errs []error
+	invalid := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	channels := make(map[string]map[string]bool)
+	for i, m := range s.Modules {
+		field := fmt.Sprintf("modules[%v]", i)
+		if !validName.MatchString(m.Name) {
+			invalid("%v: invalid module name: '%v'", field, m.Name)
+		}
+		_, duplicate := channels[m.Name]
+		if duplicate {
+			invalid("%v: duplicate module: '%v'", field, m.Name)
+		}
+
+		declared := make(map[string]bool)
+		defaults := 0
+		for j, c := range m.Channels {
+			field := fmt.Sprintf("%v.channels[%v]", field, j)
+			if !validName.MatchString(c.Name) {
+				invalid("%v: invalid channel name: '%v'", field, c.Name)
+			}
+			if declared[c.Name] {
+				invalid("%v: duplicate channel: '%v'", field, c.Name)
+			}
+			declared[c.Name] = true
+			if c.Default {
+				defaults++
+			}
+		}
+		if defaults > 1 {
+			invalid("%v: more than one default channel", field)
+		}
+		if !duplicate {
+			channels[m.Name] = declared
+		}
+
+		if r := m.Rollout; r != nil {
+			if r.Channel == "" {
+				invalid("%v.rollout: missing required field: 'channel'", field)
+			} else if len(declared) > 0 && !declared[r.Channel] {
+				invalid("%v.rollout: unknown channel: '%v'", field, r.Channel)
+			}
+			if r.Percentage < 0 || r.Percentage > 100 {
+				invalid("%v.rollout: invalid percentage: %v", field, r.Percentage)
+			}
+		}
+	}
+
+	enrolled := make(map[string]map[string]bool)
+	for i, e := range s.Enrollments {
+		field := fmt.Sprintf("enrollments[%v]", i)
+		declared, ok := channels[e.Module]
+		if !ok {
+			invalid("%v: unknown module: '%v'", field, e.Module)
+		}
+		channel := e.channel()
+		if !validName.MatchString(channel) {
+			invalid("%v: invalid channel name: '%v'", field, channel)
+		} else if len(declared) > 0 && !declared[channel] {
+			invalid("%v: unknown channel: '%v'", field, channel)
+		}
+		if e.StartsAt != nil && e.ExpiresAt != nil && !e.ExpiresAt.After(*e.StartsAt) {
+			invalid("%v: invalid expiry: 'expires_at' must be after 'starts_at'", field)
+		}
+		if len(e.Orgs) == 0 {
+			invalid("%v: missing required field: 'orgs'", field)
+		}
+
+		if enrolled[e.Module] == nil {
+			enrolled[e.Module] = make(map[string]bool)
+		}
+		for j, orgID := range e.Orgs {
+			if !validOrgID.MatchString(orgID) {
+				invalid("%v.orgs[%v]: invalid org ID: '%v'", field, j, orgID)
+			}
+			if enrolled[e.Module][orgID] {
+				invalid("%v.orgs[%v]: duplicate org: '%v' is enrolled for module '%v' more than once", field, j, orgID, e.Module)
+			}
+			enrolled[e.Module][orgID] = true
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("seed: invalid seed file: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// channel returns the channel e enrolls orgs in.
+func (e seedEnrollment) channel() string {
+	if e.Channel == "" {
+		return "testing"
+	}
+	return e.Channel
+}
+
+// enrollments returns an Enrollment for each org listed in e.
+func (e seedEnrollment) enrollments() []Enrollment {
+	enrollments := make([]Enrollment, 0, len(e.Orgs))
+	for _, orgID := range e.Orgs {
+		enrollments = append(enrollments, Enrollment{
+			ModuleName: e.Module,
+			OrgID:      orgID,
+			Channel:    e.channel(),
+			StartsAt:   utc(e.StartsAt),
+			ExpiresAt:  utc(e.ExpiresAt),
+		})
+	}
+	return enrollments
+}
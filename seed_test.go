@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseSeed(t *testing.T) {
+	tests := []struct {
+		description string
+		input       string
+		want        []Enrollment
+		wantErrs    []string
+	}{
+		{
+			description: "valid YAML",
+			input: `
+modules:
+  - name: insights-core
+    channels:
+      - name: release
+        default: true
+      - name: testing
+      - name: beta
+    rollout:
+      channel: testing
+      percentage: 5
+enrollments:
+  - module: insights-core
+    orgs: ["1", "2"]
+  - module: insights-core
+    channel: beta
+    orgs: ["3"]
+`,
+			want: []Enrollment{
+				{ModuleName: "insights-core", OrgID: "1", Channel: "testing"},
+				{ModuleName: "insights-core", OrgID: "2", Channel: "testing"},
+				{ModuleName: "insights-core", OrgID: "3", Channel: "beta"},
+			},
+		},
+		{
+			description: "valid JSON",
+			input:       `{"modules": [{"name": "insights-core"}], "enrollments": [{"module": "insights-core", "channel": "canary", "orgs": ["1"]}]}`,
+			want: []Enrollment{
+				{ModuleName: "insights-core", OrgID: "1", Channel: "canary"},
+			},
+		},
+		{
+			description: "unknown field",
+			input:       `{"modules": [{"name": "insights-core", "chanels": []}]}`,
+			wantErrs:    []string{`unknown field "chanels"`},
+		},
+		{
+			description: "invalid",
+			input: `
+modules:
+  - name: insights-core
+    channels:
+      - name: release
+        default: true
+      - name: stable
+        default: true
+      - name: release
+    rollout:
+      channel: canary
+      percentage: 101
+  - name: insights-core
+enrollments:
+  - module: insights-core
+    channel: release
+    orgs: ["1", "abc", "1"]
+  - module: other
+    orgs: ["2"]
+  - module: insights-core
+    channel: beta
+    orgs: []
+`,
+			wantErrs: []string{
+				"modules[0].channels[2]: duplicate channel: 'release'",
+				"modules[0]: more than one default channel",
+				"modules[0].rollout: unknown channel: 'canary'",
+				"modules[0].rollout: invalid percentage: 101",
+				"modules[1]: duplicate module: 'insights-core'",
+				"enrollments[0].orgs[1]: invalid org ID: 'abc'",
+				"enrollments[0].orgs[2]: duplicate org: '1' is enrolled for module 'insights-core' more than once",
+				"enrollments[1]: unknown module: 'other'",
+				"enrollments[2]: unknown channel: 'beta'",
+				"enrollments[2]: missing required field: 'orgs'",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := parseSeed([]byte(test.input))
+			if len(test.wantErrs) > 0 {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				for _, want := range test.wantErrs {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q does not contain %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var enrollments []Enrollment
+			for _, e := range got.Enrollments {
+				enrollments = append(enrollments, e.enrollments()...)
+			}
+			if !cmp.Equal(enrollments, test.want) {
+				t.Errorf("%v", cmp.Diff(enrollments, test.want))
+			}
+		})
+	}
+}
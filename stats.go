@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// defaultStatsBucket is the width of the time buckets events are aggregated
+// into if none is requested.
+const defaultStatsBucket = 24 * time.Hour
+
+// EventStats summarizes the events of one core version and phase that started
+// within one time bucket.
+type EventStats struct {
+	CoreVersion string `json:"core_version"`
+	Phase       string `json:"phase"`
+
+	// Bucket is the start of the time bucket.
+	Bucket time.Time `json:"bucket"`
+
+	Count    int64 `json:"count"`
+	Failures int64 `json:"failures"`
+
+	// FailureRate is Failures divided by Count.
+	FailureRate float64 `json:"failure_rate"`
+
+	// MedianDuration is the median time between the start and end of the
+	// events, in seconds.
+	MedianDuration float64 `json:"median_duration"`
+}
+
+// parseStatsBucket reads the width of the time buckets from the bucket query
+// parameter, a Go duration such as "1h".
+func parseStatsBucket(params url.Values) (time.Duration, error) {
+	p := params.Get("bucket")
+	if p == "" {
+		return defaultStatsBucket, nil
+	}
+	bucket, err := time.ParseDuration(p)
+	if err != nil {
+		return 0, fmt.Errorf("invalid parameter 'bucket': %w", err)
+	}
+	if bucket < time.Second {
+		return 0, fmt.Errorf("invalid parameter 'bucket': must be at least 1s")
+	}
+	return bucket, nil
+}
+
+// aggregateEvents groups events by core version, phase and the bucket of their
+// start time, and summarizes each group. Buckets are aligned to multiples of
+// bucket since the zero time, so daily buckets start at midnight UTC. Groups
+// are ordered by bucket, core version and phase.
+func aggregateEvents(events []event, bucket time.Duration) []EventStats {
+	type key struct {
+		coreVersion string
+		phase       string
+		bucket      time.Time
+	}
+	groups := make(map[key][]event)
+	for _, e := range events {
+		k := key{e.coreVersion, e.phase, e.startedAt.UTC().Truncate(bucket)}
+		groups[k] = append(groups[k], e)
+	}
+
+	stats := make([]EventStats, 0, len(groups))
+	for k, group := range groups {
+		s := EventStats{
+			CoreVersion: k.coreVersion,
+			Phase:       k.phase,
+			Bucket:      k.bucket,
+			Count:       int64(len(group)),
+		}
+		durations := make([]time.Duration, 0, len(group))
+		for _, e := range group {
+			if e.exit != 0 {
+				s.Failures++
+			}
+			durations = append(durations, e.endedAt.Sub(e.startedAt))
+		}
+		s.FailureRate = float64(s.Failures) / float64(s.Count)
+		s.MedianDuration = median(durations).Seconds()
+		stats = append(stats, s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		switch {
+		case !stats[i].Bucket.Equal(stats[j].Bucket):
+			return stats[i].Bucket.Before(stats[j].Bucket)
+		case stats[i].CoreVersion != stats[j].CoreVersion:
+			return stats[i].CoreVersion < stats[j].CoreVersion
+		default:
+			return stats[i].Phase < stats[j].Phase
+		}
+	})
+	return stats
+}
+
+// median returns the median of durations, or 0 if there are none. durations is
+// sorted in place.
+func median(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	mid := len(durations) / 2
+	if len(durations)%2 == 1 {
+		return durations[mid]
+	}
+	return (durations[mid-1] + durations[mid]) / 2
+}
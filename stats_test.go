@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// statsEvents returns events of two core versions over two days, of which the
+// 3.0.160 ones mostly fail.
+func statsEvents() []event {
+	day := time.Date(2020, 7, 21, 0, 0, 0, 0, time.UTC)
+	newEvent := func(id, coreVersion string, startedAt time.Time, duration time.Duration, exit int) event {
+		return event{
+			eventID:     id,
+			phase:       "pre_update",
+			startedAt:   startedAt,
+			exit:        exit,
+			endedAt:     startedAt.Add(duration),
+			machineID:   "21f3e7da-6e33-41dd-b25f-0eab2242ae27",
+			coreVersion: coreVersion,
+		}
+	}
+	return []event{
+		newEvent("1", "3.0.156", day.Add(1*time.Hour), 10*time.Second, 0),
+		newEvent("2", "3.0.156", day.Add(2*time.Hour), 30*time.Second, 0),
+		newEvent("3", "3.0.156", day.Add(3*time.Hour), 20*time.Second, 1),
+		newEvent("4", "3.0.160", day.Add(4*time.Hour), 5*time.Second, 1),
+		newEvent("5", "3.0.160", day.Add(5*time.Hour), 15*time.Second, 2),
+		newEvent("6", "3.0.160", day.Add(5*time.Hour), 10*time.Second, 0),
+		newEvent("7", "3.0.160", day.Add(6*time.Hour), 40*time.Second, 1),
+		newEvent("8", "3.0.156", day.Add(25*time.Hour), 10*time.Second, 0),
+	}
+}
+
+func TestAggregateEvents(t *testing.T) {
+	day := time.Date(2020, 7, 21, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		desc   string
+		bucket time.Duration
+		want   []EventStats
+	}{
+		{
+			desc:   "daily",
+			bucket: 24 * time.Hour,
+			want: []EventStats{
+				{CoreVersion: "3.0.156", Phase: "pre_update", Bucket: day, Count: 3, Failures: 1, FailureRate: 1.0 / 3, MedianDuration: 20},
+				{CoreVersion: "3.0.160", Phase: "pre_update", Bucket: day, Count: 4, Failures: 3, FailureRate: 0.75, MedianDuration: 12.5},
+				{CoreVersion: "3.0.156", Phase: "pre_update", Bucket: day.Add(24 * time.Hour), Count: 1, Failures: 0, FailureRate: 0, MedianDuration: 10},
+			},
+		},
+		{
+			desc:   "weekly",
+			bucket: 7 * 24 * time.Hour,
+			want: []EventStats{
+				{CoreVersion: "3.0.156", Phase: "pre_update", Bucket: time.Date(2020, 7, 20, 0, 0, 0, 0, time.UTC), Count: 4, Failures: 1, FailureRate: 0.25, MedianDuration: 15},
+				{CoreVersion: "3.0.160", Phase: "pre_update", Bucket: time.Date(2020, 7, 20, 0, 0, 0, 0, time.UTC), Count: 4, Failures: 3, FailureRate: 0.75, MedianDuration: 12.5},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			got := aggregateEvents(statsEvents(), test.bucket)
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("%v", cmp.Diff(got, test.want))
+			}
+		})
+	}
+}
+
+func TestAdminEventStats(t *testing.T) {
+	associate := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "type": "Associate", "associate": { "email": "jdoe@redhat.com" } } }`))
+	user := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))
+
+	tests := []struct {
+		description string
+		url         string
+		identity    string
+		wantCode    int
+		wantBody    string
+	}{
+		{
+			description: "not an associate",
+			url:         "/api/module-update-router/v1/admin/events/stats",
+			identity:    user,
+			wantCode:    http.StatusUnauthorized,
+		},
+		{
+			description: "filtered by core_version",
+			url:         "/api/module-update-router/v1/admin/events/stats?core_version=3.0.160",
+			identity:    associate,
+			wantCode:    http.StatusOK,
+			wantBody:    `[{"core_version":"3.0.160","phase":"pre_update","bucket":"2020-07-21T00:00:00Z","count":4,"failures":3,"failure_rate":0.75,"median_duration":12.5}]`,
+		},
+		{
+			description: "hourly, filtered by started_at",
+			url:         "/api/module-update-router/v1/admin/events/stats?bucket=1h&started_after=2020-07-21T05:00:00Z&started_before=2020-07-21T06:00:00Z",
+			identity:    associate,
+			wantCode:    http.StatusOK,
+			wantBody:    `[{"core_version":"3.0.160","phase":"pre_update","bucket":"2020-07-21T05:00:00Z","count":2,"failures":1,"failure_rate":0.5,"median_duration":12.5}]`,
+		},
+		{
+			description: "no events",
+			url:         "/api/module-update-router/v1/admin/events/stats?phase=post_update",
+			identity:    associate,
+			wantCode:    http.StatusOK,
+			wantBody:    `[]`,
+		},
+		{
+			description: "invalid bucket",
+			url:         "/api/module-update-router/v1/admin/events/stats?bucket=0s",
+			identity:    associate,
+			wantCode:    http.StatusBadRequest,
+			wantBody:    `{"errors":[{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid parameter 'bucket': must be at least 1s","request_id":"test-request-id"}]}`,
+		},
+		{
+			description: "invalid filter",
+			url:         "/api/module-update-router/v1/admin/events/stats?has_exception=maybe",
+			identity:    associate,
+			wantCode:    http.StatusBadRequest,
+			wantBody:    `{"errors":[{"status":"Bad Request","code":"invalid_parameter","title":"Invalid parameter","detail":"invalid parameter 'has_exception': must be 'true' or 'false'","request_id":"test-request-id"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			store := NewMemoryStore()
+			if err := store.InsertEventBatch(context.Background(), statsEvents()); err != nil {
+				t.Fatal(err)
+			}
+			srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, store, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			validateResponses(t, srv)
+			defer func() {
+				if err := srv.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}()
+
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			req.Header.Set("X-Request-Id", testRequestID)
+			req.Header.Add("X-Rh-Identity", test.identity)
+			rr := httptest.NewRecorder()
+			srv.ServeHTTP(rr, req)
+			if rr.Code != test.wantCode {
+				t.Fatalf("%v != %v: %v", rr.Code, test.wantCode, rr.Body.String())
+			}
+			if test.wantBody != "" && rr.Body.String() != test.wantBody {
+				t.Errorf("\ngot:  %v\nwant: %v", rr.Body.String(), test.wantBody)
+			}
+		})
+	}
+}
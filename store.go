@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the storage behind the HTTP handlers: routing orgs to channels,
+// managing enrollments and persisting events. DB implements it on top of SQL;
+// MemoryStore implements it in memory for tests.
+type Store interface {
+	// Route returns the name of the channel orgID should use for moduleName
+	// at now.
+	Route(ctx context.Context, moduleName, orgID string, now time.Time) (string, error)
+
+	// InsertOrgsModules creates enrollment and records change in the audit
+	// log. If the org is already enrolled for the module,
+	// ErrEnrollmentExists is returned.
+	InsertOrgsModules(ctx context.Context, enrollment Enrollment, change Change) error
+
+	// UpdateOrgsModules moves orgID to channel in its enrollment in
+	// moduleName, records change in the audit log and returns the updated
+	// enrollment. If no such enrollment exists, ErrEnrollmentNotFound is
+	// returned.
+	UpdateOrgsModules(ctx context.Context, moduleName, orgID, channel string, change Change) (Enrollment, error)
+
+	// DeleteOrgsModules deletes the enrollment of orgID in moduleName and
+	// records change in the audit log. If no such enrollment exists,
+	// ErrEnrollmentNotFound is returned.
+	DeleteOrgsModules(ctx context.Context, moduleName, orgID string, change Change) error
+
+	// ListEnrollments returns the enrollments matching filter, ordered by
+	// module name and org ID. If limit is negative, all matching enrollments
+	// after offset are returned.
+	ListEnrollments(ctx context.Context, filter EnrollmentFilter, limit, offset int) ([]Enrollment, error)
+
+	// AuditLog returns the audit log entries matching filter, newest first.
+	// If limit is negative, all matching entries after offset are returned.
+	AuditLog(ctx context.Context, filter AuditFilter, limit, offset int) ([]AuditEntry, error)
+
+	// InsertEventBatch stores all of events, or none of them.
+	InsertEventBatch(ctx context.Context, events []event) error
+
+	// GetEvents returns the stored events matching filter, ordered by their
+	// start time. If limit is negative, all matching events after offset are
+	// returned.
+	GetEvents(ctx context.Context, filter EventFilter, limit int, offset int) ([]map[string]interface{}, error)
+
+	// GetEventPage returns a page of at most limit stored events matching
+	// filter, ordered by start time and event ID, starting beyond cursor. If
+	// cursor is nil, the first page is returned. If limit is negative, all
+	// matching events beyond cursor are returned.
+	GetEventPage(ctx context.Context, filter EventFilter, cursor *EventCursor, limit int) (EventPage, error)
+
+	// AggregateEvents returns statistics of the stored events matching
+	// filter, grouped by core version, phase and time bucket of width bucket.
+	AggregateEvents(ctx context.Context, filter EventFilter, bucket time.Duration) ([]EventStats, error)
+
+	// DeleteEvents deletes stored events that started before older and
+	// returns the number deleted.
+	DeleteEvents(ctx context.Context, older time.Time) (int64, error)
+
+	// CountEvents returns the number of stored events that started before
+	// older.
+	CountEvents(ctx context.Context, older time.Time) (int64, error)
+
+	// Close releases the resources held by the store.
+	Close() error
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sweepEnrollments deletes expired enrollments from db every interval until ctx
+// is done. After each sweep it updates the count of enrollments expiring within
+// warn. If interval is not positive, enrollments are never swept.
+func sweepEnrollments(ctx context.Context, db *DB, interval, warn time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	logger := log.WithField("routine", "enrollment-sweeper")
+	logger.Debug("started enrollment sweeper")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		sweepEnrollmentsOnce(ctx, db, time.Now(), warn)
+
+		select {
+		case <-ctx.Done():
+			logger.Debug("stopped enrollment sweeper")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweepEnrollmentsOnce deletes enrollments that have expired at now, logging
+// each one, and records the number of enrollments per module that expire
+// between now and now+warn.
+func sweepEnrollmentsOnce(ctx context.Context, db *DB, now time.Time, warn time.Duration) {
+	logger := log.WithField("routine", "enrollment-sweeper")
+
+	expired, err := db.DeleteExpiredEnrollments(ctx, now)
+	if err != nil {
+		logger.WithError(err).Error("cannot delete expired enrollments")
+	}
+	for _, e := range expired {
+		logger.WithFields(log.Fields{
+			"module_name": e.ModuleName,
+			"org_id":      e.OrgID,
+			"channel":     e.Channel,
+			"expires_at":  e.ExpiresAt,
+		}).Info("deleted expired enrollment")
+	}
+	addEnrollmentsExpired(len(expired))
+
+	enrollments, err := db.ExpiringEnrollments(ctx)
+	if err != nil {
+		logger.WithError(err).Error("cannot list expiring enrollments")
+		return
+	}
+	expiring := make(map[string]int)
+	for _, e := range enrollments {
+		if !e.Expired(now) && e.Expired(now.Add(warn)) {
+			expiring[e.ModuleName]++
+		}
+	}
+	setEnrollmentsExpiring(expiring)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSweepEnrollmentsOnce(t *testing.T) {
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB(db, t)
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2026, time.October, 17, 12, 0, 0, 0, time.UTC)
+	expired := now.Add(-time.Hour)
+	soon := now.Add(48 * time.Hour)
+	later := now.Add(30 * 24 * time.Hour)
+	for _, e := range []Enrollment{
+		{ModuleName: "insights-core", OrgID: "1", Channel: "testing", ExpiresAt: &expired},
+		{ModuleName: "insights-core", OrgID: "2", Channel: "testing", ExpiresAt: &soon},
+		{ModuleName: "insights-core", OrgID: "3", Channel: "testing", ExpiresAt: &later},
+		{ModuleName: "other", OrgID: "1", Channel: "testing", ExpiresAt: &soon},
+		{ModuleName: "other", OrgID: "2", Channel: "testing", ExpiresAt: &soon},
+	} {
+		if err := db.InsertOrgsModules(context.Background(), e, Change{Actor: "test"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sweepEnrollmentsOnce(context.Background(), db, now, 7*24*time.Hour)
+
+	for module, want := range map[string]float64{"insights-core": 1, "other": 2} {
+		if got := testutil.ToFloat64(enrollmentsExpiring.WithLabelValues(module)); got != want {
+			t.Errorf("module %v: %v != %v", module, got, want)
+		}
+	}
+
+	channel, err := db.Route(context.Background(), "insights-core", "1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel != DefaultChannel {
+		t.Errorf("%v != %v", channel, DefaultChannel)
+	}
+	remaining, err := db.ExpiringEnrollments(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 4 {
+		t.Errorf("%v enrollments remain, want 4", len(remaining))
+	}
+
+	entries, err := db.AuditLog(context.Background(), AuditFilter{ModuleName: "insights-core", OrgID: "1"}, -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Action != AuditActionExpire || entries[0].Actor != systemActor || *entries[0].OldChannel != "testing" {
+		t.Errorf("unexpected audit log: %+v", entries)
+	}
+}
+
+func TestSweepEnrollmentsDisabled(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Hour} {
+		done := make(chan struct{})
+		go func() {
+			sweepEnrollments(context.Background(), nil, interval, time.Hour)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("sweeper with interval %v did not return", interval)
+		}
+	}
+}
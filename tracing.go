@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the instrumentation scope of the spans started by
+// the application itself.
+const tracerName = "github.com/redhatinsights/module-update-router"
+
+// Attribute keys identifying the module, channel and org a span is about.
+const (
+	attrModule  = attribute.Key("module")
+	attrChannel = attribute.Key("channel")
+	attrOrgID   = attribute.Key("org_id")
+)
+
+// propagator reads and writes W3C trace context and baggage, both in the
+// headers of HTTP requests and in those of published messages.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// tracer returns the tracer used to start spans, from the global tracer
+// provider.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// TracingConfig holds the settings used by setupTracing.
+type TracingConfig struct {
+	// Exporter is "otlp", "stdout" or "none".
+	Exporter string
+
+	// Endpoint is the URL spans are sent to by the "otlp" exporter. If empty,
+	// the OTEL_EXPORTER_OTLP_* environment variables apply.
+	Endpoint string
+
+	// SampleRatio is the fraction of new traces that are sampled. Traces
+	// propagated by callers are sampled if the caller sampled them.
+	SampleRatio float64
+
+	// ServiceName is the default service.name of the spans, unless
+	// OTEL_SERVICE_NAME or OTEL_RESOURCE_ATTRIBUTES set it.
+	ServiceName string
+}
+
+// setupTracing installs a global tracer provider exporting spans as configured
+// in cfg, and the W3C trace context propagator. It returns the function that
+// flushes pending spans and stops the provider. If cfg.Exporter is "none", no
+// spans are recorded, but trace context is still propagated.
+func setupTracing(ctx context.Context, cfg TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("tracing: otlptracehttp.New failed: %w", err)
+		}
+	case "stdout":
+		exporter, err = stdouttrace.New()
+		if err != nil {
+			return nil, fmt.Errorf("tracing: stdouttrace.New failed: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("tracing: unsupported exporter: %v", cfg.Exporter)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(cfg.ServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv())
+	if err != nil {
+		return nil, fmt.Errorf("tracing: resource.New failed: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// trace is an http HandlerFunc middleware handler that records a span for each
+// request, continuing the trace propagated by the caller, if any. The span is
+// named after the request method; handleAPI adds the route it matches.
+func (s *Server) trace(next http.HandlerFunc) http.HandlerFunc {
+	h := otelhttp.NewHandler(next, "",
+		otelhttp.WithPropagators(propagator),
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method
+		}))
+	return func(w http.ResponseWriter, r *http.Request) {
+		// otelhttp renames the span once next returns if s.mux set a
+		// pattern, which would replace the route set by handleAPI with
+		// the API root.
+		r = r.WithContext(r.Context())
+		r.Pattern = ""
+		h.ServeHTTP(w, r)
+	}
+}
+
+// setRoute names the span of r after its method and the route pattern it
+// matched.
+func setRoute(r *http.Request, pattern string) {
+	span := trace.SpanFromContext(r.Context())
+	span.SetName(r.Method + " " + pattern)
+	span.SetAttributes(semconv.HTTPRoute(pattern))
+}
+
+// annotate sets attrs on the span in ctx, if any.
+func annotate(ctx context.Context, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+}
+
+// recordError records err on span and marks the span as failed.
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// testTraceparent is the W3C trace context propagated by test requests.
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+var (
+	spanExporter = tracetest.NewInMemoryExporter()
+	spansOnce    sync.Once
+)
+
+// recordSpans installs a global tracer provider that records every span, and
+// returns the exporter holding the spans ended since. The provider is only
+// installed once, since instrumentation set up before it would keep using the
+// first one.
+func recordSpans() *tracetest.InMemoryExporter {
+	spansOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spanExporter)))
+	})
+	spanExporter.Reset()
+	return spanExporter
+}
+
+// findSpan returns the recorded span with the given name, failing t if there
+// is none.
+func findSpan(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	names := make([]string, 0, len(spans))
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	t.Fatalf("no span named %q in %v", name, names)
+	return tracetest.SpanStub{}
+}
+
+// spanAttributes returns the attributes of span as a map of strings.
+func spanAttributes(span tracetest.SpanStub) map[attribute.Key]string {
+	attrs := make(map[attribute.Key]string, len(span.Attributes))
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	return attrs
+}
+
+func TestTraceRequest(t *testing.T) {
+	user := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`))
+	associate := base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "type": "Associate", "associate": { "email": "jdoe@redhat.com" } } }`))
+
+	tests := []struct {
+		description string
+		method      string
+		url         string
+		identity    string
+		wantName    string
+		wantAttrs   map[attribute.Key]string
+	}{
+		{
+			description: "channel",
+			method:      http.MethodGet,
+			url:         "/api/module-update-router/v1/channel?module=insights-core",
+			identity:    user,
+			wantName:    "GET /api/module-update-router/v1/channel",
+			wantAttrs: map[attribute.Key]string{
+				attrModule:   "insights-core",
+				attrOrgID:    "1979710",
+				attrChannel:  "testing",
+				"http.route": "/api/module-update-router/v1/channel",
+			},
+		},
+		{
+			description: "enrollment",
+			method:      http.MethodGet,
+			url:         "/api/module-update-router/v1/admin/modules/insights-core/enrollments/1979710",
+			identity:    associate,
+			wantName:    "GET /api/module-update-router/v1/admin/modules/{module}/enrollments/{org_id}",
+			wantAttrs: map[attribute.Key]string{
+				attrModule:   "insights-core",
+				attrOrgID:    "1979710",
+				"http.route": "/api/module-update-router/v1/admin/modules/{module}/enrollments/{org_id}",
+			},
+		},
+		{
+			description: "no such endpoint",
+			method:      http.MethodGet,
+			url:         "/api/module-update-router/v1/nonexistent",
+			identity:    user,
+			wantName:    "GET /api/module-update-router/v1/",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			spans := recordSpans()
+
+			store := NewMemoryStore()
+			if err := store.InsertOrgsModules(context.Background(), Enrollment{ModuleName: "insights-core", OrgID: "1979710", Channel: "testing"}, Change{}); err != nil {
+				t.Fatal(err)
+			}
+			srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, store, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := srv.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}()
+
+			req := httptest.NewRequest(test.method, test.url, nil)
+			req.Header.Set("X-Rh-Identity", test.identity)
+			req.Header.Set("Traceparent", testTraceparent)
+			srv.ServeHTTP(httptest.NewRecorder(), req)
+
+			span := findSpan(t, spans.GetSpans(), test.wantName)
+			if got := span.Parent.TraceID().String(); !strings.Contains(testTraceparent, got) {
+				t.Errorf("trace ID %v not propagated from %v", got, testTraceparent)
+			}
+			if span.SpanKind != trace.SpanKindServer {
+				t.Errorf("%v != %v", span.SpanKind, trace.SpanKindServer)
+			}
+			attrs := spanAttributes(span)
+			for k, v := range test.wantAttrs {
+				if attrs[k] != v {
+					t.Errorf("attribute %v: %q != %q", k, attrs[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestTraceUntracedEndpoints(t *testing.T) {
+	spans := recordSpans()
+
+	srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, NewMemoryStore(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := srv.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	for _, url := range []string{"/ping", "/ready", "/api/module-update-router/v1/openapi.json"} {
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+	}
+	if got := spans.GetSpans(); len(got) != 0 {
+		t.Errorf("recorded %v spans, want none", len(got))
+	}
+}
+
+func TestTraceEvent(t *testing.T) {
+	spans := recordSpans()
+
+	p := &fakePublisher{}
+	srv, err := NewServer(":8080", []string{"/api/module-update-router/v1"}, NewMemoryStore(), p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/module-update-router/v1/event", strings.NewReader(`{"phase": "pre_update", "started_at": "2020-06-19T11:18:03-04:00", "exit": 0, "ended_at": "2020-06-19T11:19:03-04:00", "machine_id": "60654767-dfba-47af-8bca-cb2d1d01d9a6", "core_version": "3.0.156"}`))
+	req.Header.Set("X-Rh-Identity", base64.StdEncoding.EncodeToString([]byte(`{ "identity": { "org_id": "1979710", "account_number": "540155", "type": "User", "internal": { "org_id": "1979710" } } }`)))
+	req.Header.Set("Traceparent", testTraceparent)
+	rr := httptest.NewRecorder()
+	srv.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("%v != %v: %v", rr.Code, http.StatusCreated, rr.Body.String())
+	}
+	if err := srv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := spans.GetSpans()
+	request := findSpan(t, recorded, "POST /api/module-update-router/v1/event")
+	if got := spanAttributes(request)[attrOrgID]; got != "1979710" {
+		t.Errorf("%q != %q", got, "1979710")
+	}
+
+	write := findSpan(t, recorded, "write events")
+	if len(write.Links) != 1 || write.Links[0].SpanContext.SpanID() != request.SpanContext.SpanID() {
+		t.Errorf("write span links to %v, want the request span", write.Links)
+	}
+
+	publish := findSpan(t, recorded, "publish events")
+	if publish.Parent.SpanID() != write.SpanContext.SpanID() {
+		t.Errorf("publish span is not a child of the write span")
+	}
+	if publish.SpanKind != trace.SpanKindProducer {
+		t.Errorf("%v != %v", publish.SpanKind, trace.SpanKindProducer)
+	}
+
+	messages := p.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("published %v messages, want 1", len(messages))
+	}
+	want := "00-" + request.SpanContext.TraceID().String() + "-" + request.SpanContext.SpanID().String() + "-01"
+	if got := messages[0].Headers["traceparent"]; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestTraceDB(t *testing.T) {
+	spans := recordSpans()
+
+	db, err := Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeDB(db, t)
+	if err := db.Migrate(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	spans.Reset()
+	if _, err := db.ListEnrollments(context.Background(), EnrollmentFilter{ModuleName: "insights-core"}, -1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := spans.GetSpans(); len(got) != 0 {
+		t.Errorf("recorded %v spans outside a trace, want none", len(got))
+	}
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	if _, err := db.ListEnrollments(ctx, EnrollmentFilter{ModuleName: "insights-core"}, -1, 0); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	var queries int
+	for _, span := range spans.GetSpans() {
+		if span.Name == "parent" {
+			continue
+		}
+		if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("span %v is not a child of the calling span", span.Name)
+		}
+		attrs := spanAttributes(span)
+		if attrs["db.system.name"] != "sqlite" {
+			t.Errorf("span %v: db.system.name %q != %q", span.Name, attrs["db.system.name"], "sqlite")
+		}
+		if strings.HasPrefix(attrs["db.query.text"], "SELECT module_name, org_id, channel, starts_at, expires_at FROM orgs_modules") {
+			queries++
+		}
+	}
+	if queries == 0 {
+		t.Error("no span recorded for the query")
+	}
+}